@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// ACLRule allows, or denies, the clients within Network.
+type ACLRule struct {
+	Network netip.Prefix
+	Allow   bool
+}
+
+// ACL is an ordered list of rules, of which the first to match a client applies.
+// An empty ACL allows every client; otherwise clients not matching any rule are denied.
+type ACL []ACLRule
+
+// ParseACL parses rules of the form "allow 192.0.2.0/24" or "deny 2001:db8::/32".
+// A bare address, without a prefix length, matches that single host.
+func ParseACL(rules ...string) (ACL, error) {
+	acl := make(ACL, 0, len(rules))
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidACLRule, rule)
+		}
+
+		var allow bool
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			allow = true
+		case "deny":
+			allow = false
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrInvalidACLRule, rule)
+		}
+
+		var network netip.Prefix
+		var err error
+		if strings.Contains(fields[1], "/") {
+			network, err = netip.ParsePrefix(fields[1])
+		} else {
+			var addr netip.Addr
+			if addr, err = netip.ParseAddr(fields[1]); err == nil {
+				network = netip.PrefixFrom(addr, addr.BitLen())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidACLRule, rule, err)
+		}
+
+		acl = append(acl, ACLRule{Network: network.Masked(), Allow: allow})
+	}
+	return acl, nil
+}
+
+// Allows returns true if client is permitted by the ACL.
+func (acl ACL) Allows(client netip.Addr) bool {
+	if len(acl) == 0 {
+		return true
+	}
+	client = client.Unmap()
+	for _, rule := range acl {
+		if rule.Network.Contains(client) {
+			return rule.Allow
+		}
+	}
+	return false
+}
+
+//---
+
+// acl returns the ACL that applies to query r: CHAOS class queries are administrative, and queries without
+// the RD bit can only be answered from the cache.
+func (s *Server) acl(r *dns.Msg) ACL {
+	switch {
+	case len(r.Question) > 0 && r.Question[0].Qclass == dns.ClassCHAOS:
+		return s.config.AdminACL
+	case !r.RecursionDesired:
+		return s.config.CacheOnlyACL
+	default:
+		return s.config.RecursionACL
+	}
+}
+
+// admit returns true if the client on w is permitted to make query r. Otherwise the client is sent REFUSED.
+// Queries with a malformed cookie are sent FORMERR (RFC 7873 5.2.2).
+func (s *Server) admit(w dns.ResponseWriter, r *dns.Msg) bool {
+	rcode := dns.RcodeRefused
+	if s.cookies != nil && malformedCookie(r) {
+		rcode = dns.RcodeFormatError
+	} else if s.acl(r).Allows(clientAddr(w.RemoteAddr())) {
+		return true
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(MaxUDPResponseSize, opt.Do())
+		if rcode == dns.RcodeRefused {
+			setExtendedError(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeProhibited})
+		}
+	}
+	s.writeMsg(w, r, m)
+	return false
+}
+
+// clientAddr returns the IP address of addr, or the zero Addr if it has none. The zero Addr matches no ACL rule.
+func clientAddr(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return netip.Addr{}
+		}
+		addrPort, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return netip.Addr{}
+		}
+		return addrPort.Addr().Unmap()
+	}
+
+	client, _ := netip.AddrFromSlice(ip)
+	return client.Unmap()
+}
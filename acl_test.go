@@ -0,0 +1,162 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseACL(t *testing.T) {
+	acl, err := ParseACL("allow 192.0.2.0/24", "DENY 2001:db8::/32", "allow 198.51.100.7", "deny 192.0.2.77/16")
+	require.NoError(t, err)
+	assert.Equal(t, ACL{
+		{Network: netip.MustParsePrefix("192.0.2.0/24"), Allow: true},
+		{Network: netip.MustParsePrefix("2001:db8::/32"), Allow: false},
+		{Network: netip.MustParsePrefix("198.51.100.7/32"), Allow: true},
+		{Network: netip.MustParsePrefix("192.0.0.0/16"), Allow: false},
+	}, acl)
+
+	for _, rule := range []string{"", "allow", "permit 192.0.2.0/24", "allow 192.0.2.0/33", "deny example.com", "allow 192.0.2.0/24 extra"} {
+		_, err := ParseACL(rule)
+		assert.ErrorIs(t, err, ErrInvalidACLRule, rule)
+	}
+}
+
+func TestACL_Allows(t *testing.T) {
+	acl, err := ParseACL("deny 192.0.2.66", "allow 192.0.2.0/24", "allow 2001:db8::/32")
+	require.NoError(t, err)
+
+	assert.True(t, acl.Allows(netip.MustParseAddr("192.0.2.1")))
+	assert.True(t, acl.Allows(netip.MustParseAddr("::ffff:192.0.2.1")))
+	assert.True(t, acl.Allows(netip.MustParseAddr("2001:db8::1")))
+
+	// The first matching rule applies.
+	assert.False(t, acl.Allows(netip.MustParseAddr("192.0.2.66")))
+
+	// Clients not matched are denied, as is an unknown client.
+	assert.False(t, acl.Allows(netip.MustParseAddr("198.51.100.1")))
+	assert.False(t, acl.Allows(netip.Addr{}))
+
+	// An empty ACL allows everyone.
+	assert.True(t, ACL(nil).Allows(netip.MustParseAddr("198.51.100.1")))
+}
+
+func TestClientAddr(t *testing.T) {
+	assert.Equal(t, netip.MustParseAddr("192.0.2.1"), clientAddr(&net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53}))
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), clientAddr(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}))
+	assert.False(t, clientAddr(nil).IsValid())
+	assert.False(t, clientAddr(&net.TCPAddr{}).IsValid())
+}
+
+func TestServer_HandleDNS_ACLs(t *testing.T) {
+	// Setup - mock clients are at 192.0.2.1.
+	allow, err := ParseACL("allow 192.0.2.0/24")
+	require.NoError(t, err)
+	deny, err := ParseACL("deny 192.0.2.0/24")
+	require.NoError(t, err)
+
+	recursive := new(dns.Msg)
+	recursive.SetQuestion("example.com.", dns.TypeA)
+
+	cacheOnly := recursive.Copy()
+	cacheOnly.RecursionDesired = false
+
+	chaos := new(dns.Msg)
+	chaos.SetQuestion("version.bind.", dns.TypeTXT)
+	chaos.Question[0].Qclass = dns.ClassCHAOS
+
+	tests := []struct {
+		name    string
+		config  Config
+		query   *dns.Msg
+		refused bool
+	}{
+		{"recursion denied", Config{RecursionACL: deny, CacheOnlyACL: allow, AdminACL: allow}, recursive, true},
+		{"recursion allowed", Config{RecursionACL: allow, CacheOnlyACL: deny, AdminACL: deny}, recursive, false},
+		{"cache-only denied", Config{RecursionACL: allow, CacheOnlyACL: deny, AdminACL: allow}, cacheOnly, true},
+		{"cache-only allowed", Config{RecursionACL: deny, CacheOnlyACL: allow, AdminACL: deny}, cacheOnly, false},
+		{"admin denied", Config{RecursionACL: allow, CacheOnlyACL: allow, AdminACL: deny}, chaos, true},
+		{"admin allowed", Config{RecursionACL: deny, CacheOnlyACL: deny, AdminACL: allow}, chaos, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithConfig(&tt.config)
+			defer s.Shutdown(context.Background())
+
+			// Anything admitted is answered from the cache, rather than being resolved.
+			answer := new(dns.Msg)
+			answer.SetReply(tt.query)
+			answer.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: tt.query.Question[0].Name, Rrtype: dns.TypeTXT, Class: tt.query.Question[0].Qclass, Ttl: 300}, Txt: []string{"cached"}}}
+			s.cache.set(tt.query.Question[0], answer)
+
+			// Execute
+			w := newMockUDPResponseWriter()
+			s.handleDNS(w, tt.query)
+
+			// Assertions
+			require.NotNil(t, w.msg())
+			if tt.refused {
+				assert.Equal(t, dns.RcodeRefused, w.msg().Rcode)
+			} else {
+				assert.Equal(t, dns.RcodeSuccess, w.msg().Rcode)
+			}
+		})
+	}
+}
+
+func TestDoH_ACLRefused(t *testing.T) {
+	// Setup - httptest requests come from 192.0.2.1.
+	s, q := newDoHTestServer()
+	defer s.Shutdown(context.Background())
+	var err error
+	s.config.RecursionACL, err = ParseACL("allow 198.51.100.0/24")
+	require.NoError(t, err)
+
+	wire, err := q.Pack()
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", dohContentType)
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.DoHHandler().ServeHTTP(rec, req)
+
+	// Assertions
+	require.Equal(t, http.StatusOK, rec.Code)
+	m := new(dns.Msg)
+	require.NoError(t, m.Unpack(rec.Body.Bytes()))
+	assert.Equal(t, dns.RcodeRefused, m.Rcode)
+	assert.Empty(t, m.Answer)
+}
+
+func TestJSON_ACLRefused(t *testing.T) {
+	// Setup
+	s, _ := newDoHTestServer()
+	defer s.Shutdown(context.Background())
+	var err error
+	s.config.RecursionACL, err = ParseACL("deny 192.0.2.0/24")
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.JSONHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JSONPath+"?name=example.com", nil))
+
+	// Assertions - the lookup is refused as a DNS query would be, rather than answered from the cache.
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body JSONResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, dns.RcodeRefused, body.Status)
+	assert.Empty(t, body.Answer)
+}
@@ -0,0 +1,373 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"github.com/nsmithuk/resolver/dnssec/doe"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Aggressive use of DNSSEC-validated cache. See https://datatracker.ietf.org/doc/html/rfc8198
+//
+// The NSEC and NSEC3 records from Secure negative responses are kept, per zone. A later query for a name they already
+// prove doesn't exist (or has no records of the type asked for) is answered from them, without asking the zone again.
+// This is what stops random-subdomain floods against signed zones from reaching their nameservers.
+
+// nsecCache holds the validated denial of existence records for each zone, keyed by the zone's canonical name.
+type nsecCache struct {
+	lock  sync.RWMutex
+	zones map[string]*nsecZone
+}
+
+type nsecZone struct {
+	// soa is the zone's SOA record, along with its signatures. It's returned in the authority section of every
+	// response we synthesise.
+	soa        []dns.RR
+	soaExpires time.Time
+
+	// Only one of nsec or nsec3 is expected to be populated for a given zone.
+	nsec  map[string]*nsecRecord
+	nsec3 map[string]*nsecRecord
+}
+
+type nsecRecord struct {
+	rr      dns.RR
+	sigs    []dns.RR
+	expires time.Time
+}
+
+func newNSECCache() *nsecCache {
+	return &nsecCache{zones: make(map[string]*nsecZone)}
+}
+
+// add keeps the NSEC or NSEC3 records from rmsg, a Secure response with the denial of existence state state.
+// Records are kept for no longer than the negative TTL of the zone's SOA. See https://datatracker.ietf.org/doc/html/rfc9077
+func (c *nsecCache) add(rmsg *dns.Msg, state dnssec.DenialOfExistenceState) {
+	if c == nil || !AggressiveNSEC {
+		return
+	}
+
+	switch state {
+	case dnssec.NsecNoData, dnssec.NsecNxDomain, dnssec.Nsec3NoData, dnssec.Nsec3NxDomain:
+	default:
+		return
+	}
+
+	soas := extractRecords[*dns.SOA](rmsg.Ns)
+	if len(soas) != 1 {
+		return
+	}
+	soa := soas[0]
+	zoneName := canonicalName(soa.Hdr.Name)
+	ttl := min(soa.Hdr.Ttl, soa.Minttl)
+
+	now := time.Now()
+	records := make([]*nsecRecord, 0, 4)
+	for _, rr := range rmsg.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+		case *dns.NSEC3:
+			// Opted-out NSEC3 records don't prove that names in the range they cover don't exist.
+			// See https://datatracker.ietf.org/doc/html/rfc8198#section-5.3
+			if rr.Hash != dns.SHA1 || rr.Flags != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if !dns.IsSubDomain(zoneName, canonicalName(rr.Header().Name)) {
+			continue
+		}
+
+		sigs := nsecSignatures(rmsg.Ns, rr.Header().Name, rr.Header().Rrtype, zoneName)
+		if len(sigs) == 0 {
+			continue
+		}
+
+		records = append(records, &nsecRecord{
+			rr:      rr,
+			sigs:    sigs,
+			expires: now.Add(time.Duration(min(rr.Header().Ttl, ttl)) * time.Second),
+		})
+	}
+
+	if len(records) == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	z, found := c.zones[zoneName]
+	if !found {
+		z = &nsecZone{
+			nsec:  make(map[string]*nsecRecord),
+			nsec3: make(map[string]*nsecRecord),
+		}
+		c.zones[zoneName] = z
+	}
+
+	z.soa = append([]dns.RR{soa}, nsecSignatures(rmsg.Ns, soa.Hdr.Name, dns.TypeSOA, zoneName)...)
+	z.soaExpires = now.Add(time.Duration(ttl) * time.Second)
+
+	for _, record := range records {
+		set := z.nsec
+		if nsec3, ok := record.rr.(*dns.NSEC3); ok {
+			set = z.nsec3
+			// Hashes with different parameters can't be compared, so we only keep those in use now.
+			for owner, existing := range set {
+				if e := existing.rr.(*dns.NSEC3); e.Iterations != nsec3.Iterations || e.Salt != nsec3.Salt {
+					delete(set, owner)
+				}
+			}
+		}
+		z.store(set, record, now)
+	}
+}
+
+// store adds record to records, making space for it if needed.
+func (z *nsecZone) store(records map[string]*nsecRecord, record *nsecRecord, now time.Time) {
+	owner := canonicalName(record.rr.Header().Name)
+	if _, found := records[owner]; !found && len(records) >= MaxAggressiveNSECRecordsPerZone {
+		var soonest string
+		for key, existing := range records {
+			if now.After(existing.expires) {
+				delete(records, key)
+			} else if soonest == "" || existing.expires.Before(records[soonest].expires) {
+				soonest = key
+			}
+		}
+		if len(records) >= MaxAggressiveNSECRecordsPerZone {
+			delete(records, soonest)
+		}
+	}
+	records[owner] = record
+}
+
+// nsecSignatures returns the RRSIGs in rrs covering the rtype RRSet at name, signed by zoneName.
+func nsecSignatures(rrs []dns.RR, name string, rtype uint16, zoneName string) []dns.RR {
+	sigs := make([]dns.RR, 0, 1)
+	for _, sig := range extractRecords[*dns.RRSIG](rrs) {
+		if sig.TypeCovered == rtype && canonicalName(sig.Hdr.Name) == canonicalName(name) && canonicalName(sig.SignerName) == zoneName {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs
+}
+
+//---
+
+// synthesise returns a response to qmsg built from the records kept for zoneName, or nil if they don't
+// prove the answer.
+func (c *nsecCache) synthesise(qmsg *dns.Msg, zoneName string) *Response {
+	if c == nil || !AggressiveNSEC {
+		return nil
+	}
+
+	q := qmsg.Question[0]
+
+	// A zone's DS records are held by its parent, so the zone's own records say nothing about them.
+	if q.Qtype == dns.TypeDS {
+		return nil
+	}
+
+	zoneName = canonicalName(zoneName)
+	qname := canonicalName(q.Name)
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	z, found := c.zones[zoneName]
+	if !found {
+		return nil
+	}
+
+	now := time.Now()
+	if now.After(z.soaExpires) {
+		return nil
+	}
+
+	var rcode int
+	var state dnssec.DenialOfExistenceState
+	var proof []*nsecRecord
+
+	if nsec := z.current(z.nsec, now); len(nsec) > 0 {
+		rcode, state, proof = nsecProof(zoneName, qname, q.Qtype, nsec)
+	} else if nsec3 := z.current(z.nsec3, now); len(nsec3) > 0 {
+		rcode, state, proof = nsec3Proof(zoneName, qname, q.Qtype, nsec3)
+	}
+
+	if len(proof) == 0 {
+		return nil
+	}
+
+	Debug(fmt.Sprintf("%s for %s synthesised from the %s records cached for zone [%s]", RcodeToString(rcode), q.Name, state.String(), zoneName))
+
+	m := new(dns.Msg)
+	m.SetRcode(qmsg, rcode)
+
+	do := isSetDO(qmsg)
+	m.Ns = append(m.Ns, withRemainingTTL(z.soa[:1], z.soaExpires, now)...)
+	if do {
+		m.Ns = append(m.Ns, withRemainingTTL(z.soa[1:], z.soaExpires, now)...)
+		for _, record := range proof {
+			m.Ns = append(m.Ns, withRemainingTTL([]dns.RR{record.rr}, record.expires, now)...)
+			m.Ns = append(m.Ns, withRemainingTTL(record.sigs, record.expires, now)...)
+		}
+	}
+
+	if opt := qmsg.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), do)
+	}
+
+	// The records were validated when we received them.
+	m.AuthenticatedData = do && !qmsg.CheckingDisabled
+
+	return &Response{
+		Msg:  m,
+		Auth: dnssec.Secure,
+		Doe:  state,
+	}
+}
+
+// current returns the records that haven't yet expired.
+func (z *nsecZone) current(records map[string]*nsecRecord, now time.Time) []*nsecRecord {
+	result := make([]*nsecRecord, 0, len(records))
+	for _, record := range records {
+		if now.Before(record.expires) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// withRemainingTTL returns copies of rrs, with their TTL set to the time remaining until expires.
+func withRemainingTTL(rrs []dns.RR, expires, now time.Time) []dns.RR {
+	ttl := uint32(expires.Sub(now).Seconds())
+	result := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		result[i] = dns.Copy(rr)
+		result[i].Header().Ttl = ttl
+	}
+	return result
+}
+
+//---
+
+// nsecProof returns the response code, and the records proving it, for qname and qtype from the NSEC records.
+func nsecProof(zoneName, qname string, qtype uint16, records []*nsecRecord) (int, dnssec.DenialOfExistenceState, []*nsecRecord) {
+	rrs := make([]*dns.NSEC, len(records))
+	for i, record := range records {
+		rrs[i] = record.rr.(*dns.NSEC)
+	}
+	nsec := doe.NewDenialOfExistenceNSEC(context.Background(), zoneName, rrs)
+
+	// covers returns the record, if any, proving name doesn't exist.
+	covers := func(name string) *nsecRecord {
+		for i, rr := range rrs {
+			single := doe.NewDenialOfExistenceNSEC(context.Background(), zoneName, []*dns.NSEC{rr})
+			if single.PerformQNameDoesNotExistProof(name) || single.PerformExpandedWildcardProof(name) {
+				return records[i]
+			}
+		}
+		return nil
+	}
+
+	if nameSeen, typeSeen := nsec.TypeBitMapContainsAnyOf(qname, []uint16{dns.TypeCNAME, qtype}); nameSeen {
+		for i, rr := range rrs {
+			if canonicalName(rr.Hdr.Name) == qname && !typeSeen && !nsecIsDelegation(rr.TypeBitMap) {
+				return dns.RcodeSuccess, dnssec.NsecNoData, records[i : i+1]
+			}
+		}
+		return 0, 0, nil
+	}
+
+	if !nsec.PerformQNameDoesNotExistProof(qname) {
+		return 0, 0, nil
+	}
+
+	covering := covers(qname)
+	if covering == nil {
+		return 0, 0, nil
+	}
+
+	// The record covering the name can't be used if its owner is a delegation, or DNAME, above qname; the names
+	// below it are in another zone. If the next name is below qname, qname is an empty non-terminal, so exists.
+	rr := covering.rr.(*dns.NSEC)
+	if dns.IsSubDomain(canonicalName(rr.Hdr.Name), qname) && (nsecIsDelegation(rr.TypeBitMap) || slices.Contains(rr.TypeBitMap, dns.TypeDNAME)) {
+		return 0, 0, nil
+	}
+	if dns.IsSubDomain(qname, canonicalName(rr.NextDomain)) {
+		return 0, 0, nil
+	}
+
+	// The closest encloser is the longest ancestor of qname that exists, which is the longest it shares with
+	// either end of the covering record. There must also be no wildcard there that could have matched qname.
+	// See https://datatracker.ietf.org/doc/html/rfc8198#section-5.3
+	labels := max(dns.CompareDomainName(qname, rr.Hdr.Name), dns.CompareDomainName(qname, rr.NextDomain))
+	indexes := dns.Split(qname)
+	closestEncloser := "."
+	if labels > 0 && labels <= len(indexes) {
+		closestEncloser = qname[indexes[len(indexes)-labels]:]
+	}
+
+	wildcard := covers(dns.Fqdn("*." + closestEncloser))
+	if wildcard == nil {
+		return 0, 0, nil
+	}
+
+	proof := []*nsecRecord{covering}
+	if wildcard != covering {
+		proof = append(proof, wildcard)
+	}
+	return dns.RcodeNameError, dnssec.NsecNxDomain, proof
+}
+
+// nsec3Proof returns the response code, and the records proving it, for qname and qtype from the NSEC3 records.
+func nsec3Proof(zoneName, qname string, qtype uint16, records []*nsecRecord) (int, dnssec.DenialOfExistenceState, []*nsecRecord) {
+	rrs := make([]*dns.NSEC3, len(records))
+	for i, record := range records {
+		rrs[i] = record.rr.(*dns.NSEC3)
+	}
+	nsec3 := doe.NewDenialOfExistenceNSEC3(context.Background(), zoneName, rrs)
+
+	// matching returns the records matching any of names, or covering any of covered.
+	matching := func(names []string, covered []string) []*nsecRecord {
+		result := make([]*nsecRecord, 0, 3)
+		for i, rr := range rrs {
+			if slices.ContainsFunc(names, rr.Match) || slices.ContainsFunc(covered, rr.Cover) {
+				result = append(result, records[i])
+			}
+		}
+		return result
+	}
+
+	if nameSeen, typeSeen := nsec3.TypeBitMapContainsAnyOf(qname, []uint16{dns.TypeCNAME, qtype}); nameSeen {
+		proof := matching([]string{qname}, nil)
+		for _, record := range proof {
+			if typeSeen || nsecIsDelegation(record.rr.(*dns.NSEC3).TypeBitMap) {
+				return 0, 0, nil
+			}
+		}
+		return dns.RcodeSuccess, dnssec.Nsec3NoData, proof
+	}
+
+	optedOut, closestEncloserProof, nextCloserNameProof, wildcardProof := nsec3.PerformClosestEncloserProof(qname)
+	if optedOut || !closestEncloserProof || !nextCloserNameProof || !wildcardProof {
+		return 0, 0, nil
+	}
+
+	closestEncloser, nextCloserName, _ := nsec3.FindClosestEncloser(qname)
+	proof := matching([]string{closestEncloser}, []string{nextCloserName, "*." + closestEncloser})
+	return dns.RcodeNameError, dnssec.Nsec3NxDomain, proof
+}
+
+// nsecIsDelegation returns true if the type bitmap is that of a delegation; NS, without SOA.
+func nsecIsDelegation(types []uint16) bool {
+	return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+}
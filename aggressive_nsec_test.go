@@ -0,0 +1,251 @@
+package resolver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func nsecTestRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+// nsecTestResponse returns a negative response from example.com., with records, and an RRSIG over each of them.
+func nsecTestResponse(records ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("b.example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = []dns.RR{nsecTestRR("example.com. 3600 IN SOA ns.example.com. hostmaster.example.com. 1 7200 3600 1209600 300")}
+	for _, record := range records {
+		m.Ns = append(m.Ns, nsecTestRR(record))
+	}
+	for _, rr := range m.Ns {
+		m.Ns = append(m.Ns, &dns.RRSIG{
+			Hdr:         dns.RR_Header{Name: rr.Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rr.Header().Ttl},
+			TypeCovered: rr.Header().Rrtype,
+			SignerName:  "example.com.",
+		})
+	}
+	return m
+}
+
+func nsecTestQuery(name string, qtype uint16, do bool) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	q.SetEdns0(dns.DefaultMsgSize, do)
+	return q
+}
+
+func TestNSECCache_NSEC(t *testing.T) {
+	// Setup
+	c := newNSECCache()
+	c.add(nsecTestResponse(
+		"example.com. 3600 IN NSEC a.example.com. NS SOA RRSIG NSEC DNSKEY",
+		"a.example.com. 3600 IN NSEC m.example.com. A RRSIG NSEC",
+		"m.example.com. 3600 IN NSEC sub.example.com. A RRSIG NSEC",
+		"sub.example.com. 3600 IN NSEC t.example.com. NS RRSIG NSEC",
+		"t.example.com. 3600 IN NSEC x.y.example.com. A RRSIG NSEC",
+	), dnssec.NsecNxDomain)
+
+	// Execute - b is between a and m, and the wildcard between the apex and a.
+	response := c.synthesise(nsecTestQuery("b.example.com.", dns.TypeA, true), "example.com.")
+
+	// Assertions
+	require.NotNil(t, response)
+	assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+	assert.Equal(t, dnssec.Secure, response.Auth)
+	assert.Equal(t, dnssec.NsecNxDomain, response.Doe)
+	assert.True(t, response.Msg.AuthenticatedData)
+	assert.Len(t, extractRecords[*dns.NSEC](response.Msg.Ns), 2)
+	assert.Len(t, extractRecords[*dns.RRSIG](response.Msg.Ns), 3)
+	require.Len(t, extractRecords[*dns.SOA](response.Msg.Ns), 1)
+	for _, rr := range response.Msg.Ns {
+		// Limited by the SOA's minimum.
+		assert.LessOrEqual(t, rr.Header().Ttl, uint32(300))
+	}
+
+	// Without DO, only the SOA is returned.
+	response = c.synthesise(nsecTestQuery("c.example.com.", dns.TypeA, false), "example.com.")
+	require.NotNil(t, response)
+	assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+	assert.False(t, response.Msg.AuthenticatedData)
+	assert.Len(t, response.Msg.Ns, 1)
+
+	// a exists, but without TXT records.
+	response = c.synthesise(nsecTestQuery("a.example.com.", dns.TypeTXT, true), "example.com.")
+	require.NotNil(t, response)
+	assert.Equal(t, dns.RcodeSuccess, response.Msg.Rcode)
+	assert.Equal(t, dnssec.NsecNoData, response.Doe)
+	assert.Len(t, extractRecords[*dns.NSEC](response.Msg.Ns), 1)
+
+	// Things we can't prove.
+	for _, q := range []*dns.Msg{
+		nsecTestQuery("a.example.com.", dns.TypeA, true),     // It exists.
+		nsecTestQuery("z.example.com.", dns.TypeA, true),     // Not covered.
+		nsecTestQuery("y.example.com.", dns.TypeA, true),     // An empty non-terminal.
+		nsecTestQuery("a.sub.example.com.", dns.TypeA, true), // Below a delegation.
+		nsecTestQuery("sub.example.com.", dns.TypeA, true),   // At a delegation.
+		nsecTestQuery("b.example.com.", dns.TypeDS, true),    // DS records are in the parent.
+	} {
+		assert.Nil(t, c.synthesise(q, "example.com."), q.Question[0].String())
+	}
+
+	// Nothing is known about other zones.
+	assert.Nil(t, c.synthesise(nsecTestQuery("b.example.net.", dns.TypeA, true), "example.net."))
+	assert.Nil(t, c.synthesise(nsecTestQuery("b.sub.example.com.", dns.TypeA, true), "sub.example.com."))
+}
+
+func TestNSECCache_NSEC_Wildcard(t *testing.T) {
+	// Setup - *.example.com. exists, so names that don't could still match it.
+	c := newNSECCache()
+	c.add(nsecTestResponse(
+		"*.example.com. 3600 IN NSEC a.example.com. A RRSIG NSEC",
+		"a.example.com. 3600 IN NSEC m.example.com. A RRSIG NSEC",
+	), dnssec.NsecNxDomain)
+
+	// Assertions
+	assert.Nil(t, c.synthesise(nsecTestQuery("b.example.com.", dns.TypeA, true), "example.com."))
+}
+
+func TestNSECCache_NSEC3(t *testing.T) {
+	/*
+		hash(example.com.) = 111NOTAB271SNH4EA8ESDKBF1C2QINH1
+		hash(*.example.com.) = 3MFPR9I7C49K59BM8VU2HM71CCR7BH0B
+		hash(test.example.com.) = L72QU4B0R4USH96QN17VTCD8395QILEQ
+	*/
+	closestEncloser := "111NOTAB271SNH4EA8ESDKBF1C2QINH1.example.com. 3600 IN NSEC3 1 0 2 ABCDEF 211NOTAB271SNH4EA8ESDKBF1C2QINH1 NS SOA RRSIG"
+	nextCloserName := "K72QU4B0R4USH96QN17VTCD8395QILEQ.example.com. 3600 IN NSEC3 1 0 2 ABCDEF M72QU4B0R4USH96QN17VTCD8395QILEQ A RRSIG"
+	wildcard := "2MFPR9I7C49K59BM8VU2HM71CCR7BH0B.example.com. 3600 IN NSEC3 1 0 2 ABCDEF 4MFPR9I7C49K59BM8VU2HM71CCR7BH0B A RRSIG"
+
+	t.Run("nxdomain", func(t *testing.T) {
+		// Setup
+		c := newNSECCache()
+		c.add(nsecTestResponse(closestEncloser, nextCloserName, wildcard), dnssec.Nsec3NxDomain)
+
+		// Execute
+		response := c.synthesise(nsecTestQuery("test.example.com.", dns.TypeA, true), "example.com.")
+
+		// Assertions
+		require.NotNil(t, response)
+		assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+		assert.Equal(t, dnssec.Nsec3NxDomain, response.Doe)
+		assert.Len(t, extractRecords[*dns.NSEC3](response.Msg.Ns), 3)
+	})
+
+	t.Run("nodata", func(t *testing.T) {
+		// Setup
+		c := newNSECCache()
+		c.add(nsecTestResponse(
+			"L72QU4B0R4USH96QN17VTCD8395QILEQ.example.com. 3600 IN NSEC3 1 0 2 ABCDEF T0B6SHHJ0JQRI032RVVLMCGGNHCVF5UM A RRSIG",
+		), dnssec.Nsec3NoData)
+
+		// Execute
+		response := c.synthesise(nsecTestQuery("test.example.com.", dns.TypeTXT, true), "example.com.")
+
+		// Assertions
+		require.NotNil(t, response)
+		assert.Equal(t, dns.RcodeSuccess, response.Msg.Rcode)
+		assert.Equal(t, dnssec.Nsec3NoData, response.Doe)
+		assert.Nil(t, c.synthesise(nsecTestQuery("test.example.com.", dns.TypeA, true), "example.com."))
+	})
+
+	t.Run("opt-out", func(t *testing.T) {
+		// Setup - the next closer name is covered by an opt-out record, so there may be an unsigned delegation.
+		c := newNSECCache()
+		c.add(nsecTestResponse(
+			closestEncloser,
+			"K72QU4B0R4USH96QN17VTCD8395QILEQ.example.com. 3600 IN NSEC3 1 1 2 ABCDEF M72QU4B0R4USH96QN17VTCD8395QILEQ A RRSIG",
+			wildcard,
+		), dnssec.Nsec3NxDomain)
+
+		// Assertions
+		assert.Nil(t, c.synthesise(nsecTestQuery("test.example.com.", dns.TypeA, true), "example.com."))
+	})
+}
+
+func TestNSECCache_Add(t *testing.T) {
+	record := "a.example.com. 3600 IN NSEC m.example.com. A RRSIG NSEC"
+	query := nsecTestQuery("a.example.com.", dns.TypeTXT, true)
+
+	// Only records from negative responses are kept.
+	c := newNSECCache()
+	c.add(nsecTestResponse(record), dnssec.NotFound)
+	assert.Nil(t, c.synthesise(query, "example.com."))
+
+	// Records must be signed by the zone.
+	c = newNSECCache()
+	m := nsecTestResponse(record)
+	for _, sig := range extractRecords[*dns.RRSIG](m.Ns) {
+		sig.SignerName = "com."
+	}
+	c.add(m, dnssec.NsecNoData)
+	assert.Nil(t, c.synthesise(query, "example.com."))
+
+	// Not when disabled.
+	defer func(enabled bool) { AggressiveNSEC = enabled }(AggressiveNSEC)
+	AggressiveNSEC = false
+	c = newNSECCache()
+	c.add(nsecTestResponse(record), dnssec.NsecNoData)
+	AggressiveNSEC = true
+	assert.Nil(t, c.synthesise(query, "example.com."))
+
+	// And a nil cache is fine.
+	var disabled *nsecCache
+	disabled.add(nsecTestResponse(record), dnssec.NsecNoData)
+	assert.Nil(t, disabled.synthesise(query, "example.com."))
+}
+
+func TestNSECCache_MaxRecordsPerZone(t *testing.T) {
+	// Setup
+	defer func(max int) { MaxAggressiveNSECRecordsPerZone = max }(MaxAggressiveNSECRecordsPerZone)
+	MaxAggressiveNSECRecordsPerZone = 2
+	c := newNSECCache()
+
+	// Execute
+	c.add(nsecTestResponse("a.example.com. 60 IN NSEC b.example.com. A RRSIG NSEC"), dnssec.NsecNxDomain)
+	c.add(nsecTestResponse("c.example.com. 3600 IN NSEC d.example.com. A RRSIG NSEC"), dnssec.NsecNxDomain)
+	c.add(nsecTestResponse("e.example.com. 3600 IN NSEC f.example.com. A RRSIG NSEC"), dnssec.NsecNxDomain)
+
+	// Assertions - the record closest to expiring made way.
+	z := c.zones["example.com."]
+	require.NotNil(t, z)
+	assert.Len(t, z.nsec, 2)
+	assert.NotContains(t, z.nsec, "a.example.com.")
+}
+
+func TestResolver_Exchange_AggressiveNSEC(t *testing.T) {
+	// Setup
+	z := &mockZone{mockName: func() string { return "example.com." }}
+	r := &Resolver{
+		zones: mockZoneStore{
+			mockZoneList: func(name string) []zone { return []zone{z} },
+			mockGet:      func(name string) zone { return nil },
+		},
+		nsec: newNSECCache(),
+	}
+	r.funcs.resolveLabel = func(ctx context.Context, d *domain, z zone, qmsg *dns.Msg, auth *authenticator) (zone, *Response) {
+		t.Error("the zone shouldn't be asked")
+		return nil, newResponseError(ErrUnableToResolveAnswer)
+	}
+	r.nsec.add(nsecTestResponse(
+		"example.com. 3600 IN NSEC a.example.com. NS SOA RRSIG NSEC DNSKEY",
+		"a.example.com. 3600 IN NSEC m.example.com. A RRSIG NSEC",
+	), dnssec.NsecNxDomain)
+
+	// Execute
+	response := r.Exchange(context.Background(), nsecTestQuery("c.example.com.", dns.TypeA, true))
+
+	// Assertions
+	require.NoError(t, response.Err)
+	assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+	assert.True(t, response.Msg.RecursionAvailable)
+	assert.True(t, response.Msg.AuthenticatedData)
+}
@@ -36,7 +36,7 @@ func newAuthenticator(ctx context.Context, question dns.Question) *authenticator
 		queue:      make(chan authenticatorInput, 8),
 		processing: &sync.WaitGroup{},
 	}
-	go auth.start()
+	go auth.start(auth.queue)
 	return auth
 }
 
@@ -80,8 +80,9 @@ func (a *authenticator) addResponse(z zone, msg *dns.Msg) error {
 	return nil
 }
 
-func (a *authenticator) start() {
-	for in := range a.queue {
+// start processes the queue until it's closed. It's passed the queue, as close() then clears a.queue.
+func (a *authenticator) start(queue <-chan authenticatorInput) {
+	for in := range queue {
 		err := a.auth.AddResponse(&authZoneWrapper{ctx: a.ctx, zone: in.z}, in.msg)
 		if err != nil {
 			// `Errors` is only accessible from this thread when processing is !Done().
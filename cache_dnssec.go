@@ -0,0 +1,153 @@
+package resolver
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// cacheVariant is the DNSSEC variant of a cached answer. The answer to each question is cached separately for each,
+// as they differ in both the records they hold, and whether they've been validated.
+type cacheVariant uint8
+
+const (
+	// cachePlain answers are for clients that didn't set DO. They hold no DNSSEC records, and aren't validated.
+	cachePlain cacheVariant = iota
+
+	// cacheValidated answers are for clients that set DO, but not CD. They hold the DNSSEC records, and have been
+	// validated; they're never Bogus.
+	cacheValidated
+
+	// cacheUnchecked answers are for clients that set both DO and CD. They may be Bogus, so are never returned to
+	// clients that didn't set CD.
+	cacheUnchecked
+)
+
+// queryVariant returns the variant of the answer r should be cached as.
+func queryVariant(r *dns.Msg) cacheVariant {
+	switch {
+	case !isSetDO(r):
+		return cachePlain
+	case r.CheckingDisabled:
+		return cacheUnchecked
+	default:
+		return cacheValidated
+	}
+}
+
+// baseKey returns the key the variant of the answer to q is cached at. Plain answers keep the original key.
+func (v cacheVariant) baseKey(q dns.Question) string {
+	key := fmt.Sprintf("%s-%d-%d", q.Name, q.Qtype, q.Qclass)
+	switch v {
+	case cacheValidated:
+		return key + "-do"
+	case cacheUnchecked:
+		return key + "-cd"
+	default:
+		return key
+	}
+}
+
+// keyVariant returns the variant of the answer cached at baseKey.
+func keyVariant(baseKey string) cacheVariant {
+	switch {
+	case strings.HasSuffix(baseKey, "-do"):
+		return cacheValidated
+	case strings.HasSuffix(baseKey, "-cd"):
+		return cacheUnchecked
+	default:
+		return cachePlain
+	}
+}
+
+// answerVariants returns the variants that can answer r, most preferred first. A validated answer can be returned
+// to any client; with its DNSSEC records removed for those that didn't set DO.
+func answerVariants(r *dns.Msg) []cacheVariant {
+	switch queryVariant(r) {
+	case cachePlain:
+		return []cacheVariant{cachePlain, cacheValidated}
+	case cacheUnchecked:
+		return []cacheVariant{cacheUnchecked, cacheValidated}
+	default:
+		return []cacheVariant{cacheValidated}
+	}
+}
+
+// getAnswer returns the cached answer to r for a client at addr, along with its ECS scope. AD is only set on
+// answers validated as Secure, and DNSSEC records are only returned to clients that set DO.
+func (c *DNSCache) getAnswer(r *dns.Msg, client netip.Addr) (*dns.Msg, int) {
+	if resp, scope := c.getResponse(r, client); resp != nil {
+		return resp.Msg, scope
+	}
+	return nil, 0
+}
+
+// getResponse returns the cached answer to r, as getAnswer does, along with the DNSSEC state it was validated with.
+// The state is returned even where the reply doesn't show it, as r didn't set DO.
+func (c *DNSCache) getResponse(r *dns.Msg, client netip.Addr) (*Response, int) {
+	q := r.Question[0]
+	for _, variant := range answerVariants(r) {
+		if resp, scope := c.find(variant.baseKey(q), r.Id, client); resp != nil {
+			resp.Msg = dnssecReply(resp.Msg, r)
+			return resp, scope
+		}
+	}
+
+	atomic.AddUint64(&c.stats.Misses, 1)
+	return nil, 0
+}
+
+// setAnswer caches resp as the answer to r for clients within subnet, as the variant r asked for.
+func (c *DNSCache) setAnswer(r *dns.Msg, resp *Response, subnet netip.Prefix) {
+	variant := queryVariant(r)
+	if variant == cacheValidated && resp.Auth == dnssec.Bogus {
+		// Validated answers are also returned to clients that didn't set CD.
+		return
+	}
+	c.store(r.Question[0], variant, resp, subnet)
+}
+
+// dnssecReply adapts the cached answer msg for r. Clients that didn't set DO aren't sent DNSSEC records they didn't
+// ask for, nor AD, unless they set it. See https://datatracker.ietf.org/doc/html/rfc4035#section-3.2.1 and
+// https://datatracker.ietf.org/doc/html/rfc6840#section-5.7
+func dnssecReply(msg, r *dns.Msg) *dns.Msg {
+	if isSetDO(r) {
+		return msg
+	}
+
+	if !r.AuthenticatedData {
+		msg.AuthenticatedData = false
+	}
+
+	qtype := r.Question[0].Qtype
+	msg.Answer = removeDNSSECRecords(msg.Answer, qtype)
+	msg.Ns = removeDNSSECRecords(msg.Ns, 0)
+	msg.Extra = removeDNSSECRecords(msg.Extra, 0)
+
+	if opt := msg.IsEdns0(); opt != nil {
+		if r.IsEdns0() == nil {
+			msg.Extra = removeRecordsOfType(msg.Extra, dns.TypeOPT)
+		} else {
+			opt.SetDo(false)
+		}
+	}
+	return msg
+}
+
+// removeDNSSECRecords returns records without any RRSIG, NSEC or NSEC3 records, other than those of qtype.
+func removeDNSSECRecords(records []dns.RR, qtype uint16) []dns.RR {
+	result := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		switch rtype := rr.Header().Rrtype; rtype {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if rtype != qtype {
+				continue
+			}
+		}
+		result = append(result, rr)
+	}
+	return result
+}
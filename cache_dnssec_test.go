@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dnssecTestQuery returns a query for example.com. A, with EDNS if do or cd are set.
+func dnssecTestQuery(do, cd bool) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	if do {
+		r.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	r.CheckingDisabled = cd
+	return r
+}
+
+// dnssecTestAnswer returns a signed answer to r.
+func dnssecTestAnswer(r *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300}, TypeCovered: dns.TypeA, OrigTtl: 300, Expiration: ^uint32(0) >> 1, SignerName: "example.com."},
+	}
+	m.Ns = []dns.RR{
+		&dns.NSEC{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300}, NextDomain: "a.example.com.", TypeBitMap: []uint16{dns.TypeA}},
+	}
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	return m
+}
+
+func TestCacheVariant_BaseKey(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	assert.Equal(t, "example.com.-1-1", queryVariant(dnssecTestQuery(false, false)).baseKey(q))
+	assert.Equal(t, "example.com.-1-1", queryVariant(dnssecTestQuery(false, true)).baseKey(q))
+	assert.Equal(t, "example.com.-1-1-do", queryVariant(dnssecTestQuery(true, false)).baseKey(q))
+	assert.Equal(t, "example.com.-1-1-cd", queryVariant(dnssecTestQuery(true, true)).baseKey(q))
+}
+
+func TestDNSCache_Answer_Validated(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{}).cache
+	r := dnssecTestQuery(true, false)
+	c.setAnswer(r, &Response{Msg: dnssecTestAnswer(r), Auth: dnssec.Secure, Doe: dnssec.NsecNoData}, netip.Prefix{})
+
+	// Execute & Assertions - DO clients get the DNSSEC records, and AD.
+	m, _ := c.getAnswer(r, netip.Addr{})
+	require.NotNil(t, m)
+	assert.True(t, m.AuthenticatedData)
+	assert.Len(t, m.Answer, 2)
+	assert.Len(t, m.Ns, 1)
+
+	entry := c.getShard("example.com.-1-1-do").items["example.com.-1-1-do"]
+	require.NotNil(t, entry)
+	assert.Equal(t, dnssec.Secure, entry.auth)
+	assert.Equal(t, dnssec.NsecNoData, entry.doe)
+
+	// Clients without DO get neither, nor an OPT record if they didn't send one.
+	m, _ = c.getAnswer(dnssecTestQuery(false, false), netip.Addr{})
+	require.NotNil(t, m)
+	assert.False(t, m.AuthenticatedData)
+	require.Len(t, m.Answer, 1)
+	assert.Equal(t, dns.TypeA, m.Answer[0].Header().Rrtype)
+	assert.Empty(t, m.Ns)
+	assert.Nil(t, m.IsEdns0())
+
+	plain := dnssecTestQuery(false, false)
+	plain.SetEdns0(dns.DefaultMsgSize, false)
+	plain.AuthenticatedData = true
+	m, _ = c.getAnswer(plain, netip.Addr{})
+	require.NotNil(t, m)
+	assert.True(t, m.AuthenticatedData)
+	require.NotNil(t, m.IsEdns0())
+	assert.False(t, m.IsEdns0().Do())
+
+	// Clients setting CD can be given validated answers too.
+	m, _ = c.getAnswer(dnssecTestQuery(true, true), netip.Addr{})
+	require.NotNil(t, m)
+	assert.Len(t, m.Answer, 2)
+
+	// The cached copy is left as it was.
+	assert.Len(t, entry.msg.Answer, 2)
+	assert.True(t, entry.msg.IsEdns0().Do())
+}
+
+func TestDNSCache_Answer_Variants(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{})
+	defer c.Shutdown(context.Background())
+
+	plain := dnssecTestQuery(false, false)
+	answer := dnssecTestAnswer(plain)
+	answer.Answer = answer.Answer[:1]
+	c.cache.setAnswer(plain, &Response{Msg: answer}, netip.Prefix{})
+
+	// Execute & Assertions - a plain answer doesn't hold the DNSSEC records, so isn't returned to DO clients.
+	assert.NotNil(t, getAnswer(c.cache, plain))
+	assert.Nil(t, getAnswer(c.cache, dnssecTestQuery(true, false)))
+	assert.Nil(t, getAnswer(c.cache, dnssecTestQuery(true, true)))
+	assert.Equal(t, uint64(2), c.cache.Stats().Misses)
+
+	// Insecure answers are returned without AD.
+	do := dnssecTestQuery(true, false)
+	c.cache.setAnswer(do, &Response{Msg: dnssecTestAnswer(do), Auth: dnssec.Insecure}, netip.Prefix{})
+	m := getAnswer(c.cache, do)
+	require.NotNil(t, m)
+	assert.False(t, m.AuthenticatedData)
+
+	// Bogus answers are only cached for, and returned to, clients that set CD.
+	c.cache.Clear()
+	cd := dnssecTestQuery(true, true)
+	c.cache.setAnswer(do, &Response{Msg: dnssecTestAnswer(do), Auth: dnssec.Bogus}, netip.Prefix{})
+	c.cache.setAnswer(cd, &Response{Msg: dnssecTestAnswer(cd), Auth: dnssec.Bogus}, netip.Prefix{})
+	assert.Nil(t, getAnswer(c.cache, do))
+	assert.Nil(t, getAnswer(c.cache, plain))
+	m = getAnswer(c.cache, cd)
+	require.NotNil(t, m)
+	assert.False(t, m.AuthenticatedData)
+}
+
+func getAnswer(c *DNSCache, r *dns.Msg) *dns.Msg {
+	m, _ := c.getAnswer(r, netip.Addr{})
+	return m
+}
+
+func TestServer_ProcessQuery_DNSSECCache(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		m := dnssecTestAnswer(qmsg)
+		if !isSetDO(qmsg) {
+			m.Answer = m.Answer[:1]
+			m.Ns = nil
+			m.Extra = nil
+			return &Response{Msg: m}
+		}
+		m.AuthenticatedData = true
+		return &Response{Msg: m, Auth: dnssec.Secure}
+	})
+
+	w := newMockUDPResponseWriter()
+
+	// Execute - a plain query, then two with DO, then another plain one.
+	s.processQuery(w, dnssecTestQuery(false, false))
+	s.processQuery(w, dnssecTestQuery(true, false))
+	s.processQuery(w, dnssecTestQuery(true, false))
+	s.processQuery(w, dnssecTestQuery(false, false))
+
+	// Assertions - the plain answer isn't returned to the DO query; the second DO query is answered from the
+	// cache, with AD, as it was Secure.
+	assert.Equal(t, int32(2), calls.Load())
+	require.Len(t, w.msgs, 4)
+	assert.Len(t, w.msgs[0].Answer, 1)
+	assert.False(t, w.msgs[0].AuthenticatedData)
+	for _, m := range w.msgs[1:3] {
+		assert.Len(t, m.Answer, 2)
+		assert.True(t, m.AuthenticatedData)
+	}
+	assert.Len(t, w.msgs[3].Answer, 1)
+	assert.False(t, w.msgs[3].AuthenticatedData)
+}
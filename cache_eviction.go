@@ -0,0 +1,390 @@
+package resolver
+
+import (
+	"container/heap"
+	"container/list"
+	"sync/atomic"
+)
+
+// EvictionPolicy chooses which entries are evicted from the DNSCache once it's full.
+type EvictionPolicy uint8
+
+const (
+	// EvictionLRU evicts the least recently used entry.
+	EvictionLRU EvictionPolicy = iota
+
+	// EvictionLFU evicts the least frequently used entry; the least recently used of those on a tie.
+	EvictionLFU
+
+	// EvictionTinyLFU is W-TinyLFU. New entries are held in a small LRU window. Those leaving it are only admitted
+	// to the main cache if they've been used more often, per a count-min sketch, than the entry they'd replace.
+	// See https://arxiv.org/abs/1512.00727
+	EvictionTinyLFU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictionLRU:
+		return "lru"
+	case EvictionLFU:
+		return "lfu"
+	case EvictionTinyLFU:
+		return "tinylfu"
+	default:
+		return "unknown"
+	}
+}
+
+// cacheEntryOverhead and cacheRecordOverhead approximate the memory a cached entry uses beyond its records' wire
+// format; the entry itself, and each record's header and Go structure.
+const (
+	cacheEntryOverhead  = 256
+	cacheRecordOverhead = 64
+)
+
+// entrySize estimates the memory, in bytes, used by entry.
+func entrySize(entry *cacheEntry) int64 {
+	size := cacheEntryOverhead + len(entry.key) + len(entry.baseKey)
+	if entry.msg != nil {
+		records := len(entry.msg.Answer) + len(entry.msg.Ns) + len(entry.msg.Extra)
+		size += entry.msg.Len() + records*cacheRecordOverhead
+	}
+	return int64(size)
+}
+
+//---
+
+// evictionPolicy tracks the entries in a cacheShard, choosing which to evict once the shard is over its budget.
+// All methods are called with the shard's lock held.
+type evictionPolicy interface {
+	// add records a new entry.
+	add(entry *cacheEntry)
+	// hit records entry being returned from the cache.
+	hit(entry *cacheEntry)
+	// remove forgets entry, once it's been evicted, expired, or replaced.
+	remove(entry *cacheEntry)
+	// victim returns the entry to evict next, or nil if there are none. The entry is not removed.
+	victim() *cacheEntry
+}
+
+// newEvictionPolicy returns policy for a shard of capacity, as measured by weigh, expected to hold around entries.
+func newEvictionPolicy(policy EvictionPolicy, capacity int64, entries int, weigh func(*cacheEntry) int64, stats *CacheStats) evictionPolicy {
+	switch policy {
+	case EvictionLFU:
+		return newLFUPolicy()
+	case EvictionTinyLFU:
+		return newTinyLFUPolicy(capacity, entries, weigh, stats)
+	default:
+		return newLRUPolicy()
+	}
+}
+
+//---
+
+type lruPolicy struct {
+	list     *list.List
+	elements map[*cacheEntry]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		list:     list.New(),
+		elements: make(map[*cacheEntry]*list.Element),
+	}
+}
+
+func (p *lruPolicy) add(entry *cacheEntry) {
+	p.elements[entry] = p.list.PushFront(entry)
+}
+
+func (p *lruPolicy) hit(entry *cacheEntry) {
+	if elem, ok := p.elements[entry]; ok {
+		p.list.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) remove(entry *cacheEntry) {
+	if elem, ok := p.elements[entry]; ok {
+		p.list.Remove(elem)
+		delete(p.elements, entry)
+	}
+}
+
+func (p *lruPolicy) victim() *cacheEntry {
+	if elem := p.list.Back(); elem != nil {
+		return elem.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+//---
+
+// lfuPolicy keeps the entries in a min-heap, ordered by their frequency, then by when they were last used.
+type lfuPolicy struct {
+	items lfuHeap
+	index map[*cacheEntry]*lfuItem
+	tick  uint64
+}
+
+type lfuItem struct {
+	entry *cacheEntry
+	used  uint64
+	index int
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{index: make(map[*cacheEntry]*lfuItem)}
+}
+
+func (p *lfuPolicy) add(entry *cacheEntry) {
+	p.tick++
+	item := &lfuItem{entry: entry, used: p.tick}
+	p.index[entry] = item
+	heap.Push(&p.items, item)
+}
+
+func (p *lfuPolicy) hit(entry *cacheEntry) {
+	if item, ok := p.index[entry]; ok {
+		p.tick++
+		item.used = p.tick
+		heap.Fix(&p.items, item.index)
+	}
+}
+
+func (p *lfuPolicy) remove(entry *cacheEntry) {
+	if item, ok := p.index[entry]; ok {
+		heap.Remove(&p.items, item.index)
+		delete(p.index, entry)
+	}
+}
+
+func (p *lfuPolicy) victim() *cacheEntry {
+	if len(p.items) == 0 {
+		return nil
+	}
+	return p.items[0].entry
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].entry.frequency != h[j].entry.frequency {
+		return h[i].entry.frequency < h[j].entry.frequency
+	}
+	return h[i].used < h[j].used
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+//---
+
+// tinyLFUPolicy is W-TinyLFU. New entries go into an LRU window of 1% of the capacity. Entries overflowing the
+// window join the main cache's probation segment while it has room. Once it's full, when an entry must be evicted,
+// the window's least recently used entry competes with probation's; whichever has been used least often, per the
+// sketch, is evicted, and the other stays in, or is admitted to, the main cache. Entries hit while in probation are
+// promoted to the protected segment, which holds up to 80% of the main cache.
+type tinyLFUPolicy struct {
+	weigh  func(*cacheEntry) int64
+	sketch *countMinSketch
+	stats  *CacheStats
+
+	segments [3]*list.List
+	weights  [3]int64
+
+	windowLimit, mainLimit, protectedLimit int64
+
+	elements map[*cacheEntry]*list.Element
+}
+
+type tinyLFUSegment uint8
+
+const (
+	tinyLFUWindow tinyLFUSegment = iota
+	tinyLFUProbation
+	tinyLFUProtected
+)
+
+type tinyLFUItem struct {
+	entry   *cacheEntry
+	segment tinyLFUSegment
+}
+
+func newTinyLFUPolicy(capacity int64, entries int, weigh func(*cacheEntry) int64, stats *CacheStats) *tinyLFUPolicy {
+	capacity = max(capacity, 1)
+	windowLimit := max(capacity/100, 1)
+	mainLimit := capacity - windowLimit
+
+	p := &tinyLFUPolicy{
+		weigh:          weigh,
+		sketch:         newCountMinSketch(min(entries, 1<<20)),
+		stats:          stats,
+		windowLimit:    windowLimit,
+		mainLimit:      mainLimit,
+		protectedLimit: mainLimit * 8 / 10,
+		elements:       make(map[*cacheEntry]*list.Element),
+	}
+	for i := range p.segments {
+		p.segments[i] = list.New()
+	}
+	return p
+}
+
+func (p *tinyLFUPolicy) add(entry *cacheEntry) {
+	p.sketch.increment(entry.key)
+
+	p.elements[entry] = p.segments[tinyLFUWindow].PushFront(&tinyLFUItem{entry: entry, segment: tinyLFUWindow})
+	p.weights[tinyLFUWindow] += p.weigh(entry)
+
+	// Once the main cache is full, the overflow stays in the window until it's competed for a place.
+	for p.weights[tinyLFUWindow] > p.windowLimit && p.segments[tinyLFUWindow].Len() > 1 {
+		item := p.segments[tinyLFUWindow].Back().Value.(*tinyLFUItem)
+		if p.mainWeight()+p.weigh(item.entry) > p.mainLimit {
+			break
+		}
+		p.move(item, tinyLFUProbation)
+	}
+}
+
+func (p *tinyLFUPolicy) hit(entry *cacheEntry) {
+	p.sketch.increment(entry.key)
+
+	elem, ok := p.elements[entry]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*tinyLFUItem)
+	switch item.segment {
+	case tinyLFUWindow, tinyLFUProtected:
+		p.segments[item.segment].MoveToFront(elem)
+	case tinyLFUProbation:
+		p.move(item, tinyLFUProtected)
+
+		// The protected segment's overflow is demoted back to probation.
+		for p.weights[tinyLFUProtected] > p.protectedLimit && p.segments[tinyLFUProtected].Len() > 1 {
+			p.move(p.segments[tinyLFUProtected].Back().Value.(*tinyLFUItem), tinyLFUProbation)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) remove(entry *cacheEntry) {
+	elem, ok := p.elements[entry]
+	if !ok {
+		return
+	}
+	item := elem.Value.(*tinyLFUItem)
+	p.segments[item.segment].Remove(elem)
+	p.weights[item.segment] -= p.weigh(entry)
+	delete(p.elements, entry)
+}
+
+func (p *tinyLFUPolicy) victim() *cacheEntry {
+	var main *tinyLFUItem
+	for _, segment := range []tinyLFUSegment{tinyLFUProbation, tinyLFUProtected} {
+		if elem := p.segments[segment].Back(); elem != nil {
+			main = elem.Value.(*tinyLFUItem)
+			break
+		}
+	}
+
+	elem := p.segments[tinyLFUWindow].Back()
+	if elem == nil {
+		if main == nil {
+			return nil
+		}
+		return main.entry
+	}
+	candidate := elem.Value.(*tinyLFUItem)
+
+	switch {
+	case main == nil:
+		return candidate.entry
+	case p.weights[tinyLFUWindow] < p.windowLimit:
+		// The window has room, so nothing needs to leave it.
+		return main.entry
+	case p.sketch.estimate(candidate.entry.key) > p.sketch.estimate(main.entry.key):
+		p.move(candidate, tinyLFUProbation)
+		atomic.AddUint64(&p.stats.Admitted, 1)
+		return main.entry
+	default:
+		atomic.AddUint64(&p.stats.Rejected, 1)
+		return candidate.entry
+	}
+}
+
+// mainWeight is the weight of the main cache; its probation and protected segments.
+func (p *tinyLFUPolicy) mainWeight() int64 {
+	return p.weights[tinyLFUProbation] + p.weights[tinyLFUProtected]
+}
+
+// move moves item to the front of segment.
+func (p *tinyLFUPolicy) move(item *tinyLFUItem, segment tinyLFUSegment) {
+	weight := p.weigh(item.entry)
+
+	p.segments[item.segment].Remove(p.elements[item.entry])
+	p.weights[item.segment] -= weight
+
+	item.segment = segment
+	p.elements[item.entry] = p.segments[segment].PushFront(item)
+	p.weights[segment] += weight
+}
+
+//---
+
+func (c *DNSCache) newShard() *cacheShard {
+	return &cacheShard{
+		items:  make(map[string]*cacheEntry),
+		policy: c.newPolicy(),
+		stats:  &c.stats,
+	}
+}
+
+// newPolicy returns the eviction policy for a shard. Entries are weighed by their size when there's a memory
+// budget; otherwise they're simply counted.
+func (c *DNSCache) newPolicy() evictionPolicy {
+	maxShardSize, maxShardBytes := c.shardCapacity()
+	if maxShardBytes > 0 {
+		entries := min(maxShardSize, int(maxShardBytes/cacheEntryOverhead))
+		return newEvictionPolicy(c.eviction, maxShardBytes, entries, func(entry *cacheEntry) int64 {
+			return entry.size
+		}, &c.stats)
+	}
+	return newEvictionPolicy(c.eviction, int64(maxShardSize), maxShardSize, func(*cacheEntry) int64 {
+		return 1
+	}, &c.stats)
+}
+
+// shardCapacity returns the most entries, and bytes, each shard can hold. maxShardBytes is 0 when unlimited.
+func (c *DNSCache) shardCapacity() (maxShardSize int, maxShardBytes int64) {
+	return max(c.maxSize/len(c.shards), 1), c.maxBytes / int64(len(c.shards))
+}
+
+// remove removes entry from the shard, whether it's been evicted, expired, or replaced. shard's lock must be held.
+func (shard *cacheShard) remove(entry *cacheEntry) {
+	shard.forgetScope(entry)
+	delete(shard.items, entry.key)
+	shard.bytes -= entry.size
+	shard.policy.remove(entry)
+	if entry.prefetched {
+		atomic.AddUint64(&shard.stats.PrefetchWasted, 1)
+	}
+}
@@ -0,0 +1,187 @@
+package resolver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// evictionTestCache drives policy as a DNSCache shard holding up to capacity entries would.
+type evictionTestCache struct {
+	policy   evictionPolicy
+	entries  map[string]*cacheEntry
+	capacity int
+}
+
+func newEvictionTestCache(policy EvictionPolicy, capacity int, stats *CacheStats) *evictionTestCache {
+	return &evictionTestCache{
+		policy:   newEvictionPolicy(policy, int64(capacity), capacity, func(*cacheEntry) int64 { return 1 }, stats),
+		entries:  make(map[string]*cacheEntry),
+		capacity: capacity,
+	}
+}
+
+func (c *evictionTestCache) add(key string) {
+	for len(c.entries) >= c.capacity {
+		victim := c.policy.victim()
+		c.policy.remove(victim)
+		delete(c.entries, victim.key)
+	}
+	entry := &cacheEntry{key: key, frequency: 1}
+	c.entries[key] = entry
+	c.policy.add(entry)
+}
+
+func (c *evictionTestCache) hit(key string) bool {
+	entry, ok := c.entries[key]
+	if ok {
+		entry.frequency++
+		c.policy.hit(entry)
+	}
+	return ok
+}
+
+func TestEvictionPolicy_LRU(t *testing.T) {
+	c := newEvictionTestCache(EvictionLRU, 3, &CacheStats{})
+	c.add("a")
+	c.add("b")
+	c.add("c")
+	c.hit("a")
+	c.add("d")
+
+	assert.True(t, c.hit("a"))
+	assert.False(t, c.hit("b"))
+	assert.True(t, c.hit("c"))
+	assert.True(t, c.hit("d"))
+}
+
+func TestEvictionPolicy_LFU(t *testing.T) {
+	c := newEvictionTestCache(EvictionLFU, 3, &CacheStats{})
+	c.add("a")
+	c.add("b")
+	c.add("c")
+	c.hit("a")
+	c.hit("a")
+	c.hit("b")
+	c.hit("c")
+
+	// b and c are tied, so the least recently used of them goes.
+	c.add("d")
+	assert.False(t, c.hit("b"))
+
+	// d has been used least.
+	c.add("e")
+	assert.False(t, c.hit("d"))
+	assert.True(t, c.hit("a"))
+	assert.True(t, c.hit("c"))
+	assert.True(t, c.hit("e"))
+}
+
+func TestEvictionPolicy_TinyLFU(t *testing.T) {
+	// Setup
+	stats := &CacheStats{}
+	c := newEvictionTestCache(EvictionTinyLFU, 10, stats)
+	for i := 0; i < 10; i++ {
+		c.add(fmt.Sprintf("popular-%d", i))
+	}
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 5; i++ {
+			c.hit(fmt.Sprintf("popular-%d", i))
+		}
+	}
+
+	// Execute - a scan of names only seen once.
+	for i := 0; i < 50; i++ {
+		c.add(fmt.Sprintf("scan-%d", i))
+	}
+
+	// Assertions - the popular entries survive the scan, as the new ones aren't admitted in their place.
+	for i := 0; i < 5; i++ {
+		assert.True(t, c.hit(fmt.Sprintf("popular-%d", i)), i)
+	}
+	assert.Len(t, c.entries, 10)
+	assert.Positive(t, stats.Rejected)
+
+	// Something used more often than what it'd replace is admitted.
+	c.add("new")
+	for i := 0; i < 5; i++ {
+		c.policy.hit(c.entries["new"])
+	}
+	c.add("another")
+	assert.True(t, c.hit("new"))
+	assert.Positive(t, stats.Admitted)
+}
+
+func TestEvictionPolicy_Remove(t *testing.T) {
+	for _, policy := range []EvictionPolicy{EvictionLRU, EvictionLFU, EvictionTinyLFU} {
+		c := newEvictionTestCache(policy, 10, &CacheStats{})
+		c.add("a")
+		c.add("b")
+
+		c.policy.remove(c.entries["a"])
+		victim := c.policy.victim()
+		require.NotNil(t, victim, policy.String())
+		assert.Equal(t, "b", victim.key, policy.String())
+
+		c.policy.remove(victim)
+		assert.Nil(t, c.policy.victim(), policy.String())
+	}
+}
+
+func TestDNSCache_MaxBytes(t *testing.T) {
+	// Setup - room for around two small answers in each shard.
+	small := dns.Question{Name: "small.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	smallSize := entrySize(&cacheEntry{key: "small.example.com.-1-1", msg: staleTestAnswer(small, "192.0.2.1")})
+	c := NewServerWithConfig(&Config{CacheMaxBytes: smallSize * 2 * 32}).cache
+
+	// A large answer costs more than a small one.
+	large := dns.Question{Name: "large.example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	m := new(dns.Msg)
+	m.Question = []dns.Question{large}
+	for i := 0; i < 20; i++ {
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: large.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300}, Txt: []string{fmt.Sprintf("record %d of a response much larger than an A record", i)}})
+	}
+	assert.Greater(t, entrySize(&cacheEntry{key: "large.example.com.-16-1", msg: m}), smallSize*2)
+
+	// Execute
+	c.set(large, m)
+	for i := 0; i < 200; i++ {
+		q := dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		c.set(q, staleTestAnswer(q, "192.0.2.1"))
+	}
+
+	// Assertions - answers too large for a shard aren't cached, and the budget is kept to.
+	assert.Nil(t, c.get(large, 1))
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.Bytes, stats.MaxBytes)
+	assert.Positive(t, stats.Evictions)
+	assert.Equal(t, EvictionLRU, stats.Policy)
+	for _, shard := range c.shards {
+		assert.LessOrEqual(t, len(shard.items), 2)
+	}
+}
+
+func TestDNSCache_Stats_HitRate(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{CacheEviction: EvictionTinyLFU}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, staleTestAnswer(q, "192.0.2.1"))
+
+	// Execute
+	c.get(q, 1)
+	c.get(q, 1)
+	c.get(q, 1)
+	c.get(dns.Question{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, 1)
+
+	// Assertions
+	stats := c.Stats()
+	assert.Equal(t, EvictionTinyLFU, stats.Policy)
+	assert.InDelta(t, 0.75, stats.HitRate, 0.001)
+	assert.Equal(t, uint64(entrySize(c.getShard("example.com.-1-1").items["example.com.-1-1"])), stats.Bytes)
+
+	c.Clear()
+	assert.Zero(t, c.Stats().Bytes)
+}
@@ -0,0 +1,130 @@
+package resolver
+
+import (
+	"github.com/miekg/dns"
+	"time"
+)
+
+// ttlPolicy applies the CacheTTLConfig to the answers being cached.
+type ttlPolicy struct {
+	global TTLLimits
+	zones  map[string]TTLLimits
+}
+
+func newTTLPolicy(config CacheTTLConfig) ttlPolicy {
+	p := ttlPolicy{
+		global: TTLLimits{Min: config.Min, Max: config.Max},
+		zones:  make(map[string]TTLLimits, len(config.Zones)),
+	}
+	for zone, limits := range config.Zones {
+		p.zones[canonicalName(dns.Fqdn(zone))] = limits
+	}
+	return p
+}
+
+// limits returns the bounds on the TTLs of the records cached for name.
+func (p ttlPolicy) limits(name string) (minTTL, maxTTL uint32) {
+	minTTL, maxTTL = p.global.Min, p.global.Max
+
+	name = canonicalName(name)
+	labels := -1
+	for zone, limits := range p.zones {
+		if dns.IsSubDomain(zone, name) && dns.CountLabel(zone) > labels {
+			labels = dns.CountLabel(zone)
+			if minTTL = p.global.Min; limits.Min > 0 {
+				minTTL = limits.Min
+			}
+			if maxTTL = p.global.Max; limits.Max > 0 {
+				maxTTL = limits.Max
+			}
+		}
+	}
+
+	if maxTTL == 0 {
+		maxTTL = MaxAllowedTTL
+	}
+	return min(minTTL, maxTTL), maxTTL
+}
+
+// apply bounds the TTL of each record in msg, which is being cached as the answer for name, and returns the lowest.
+// That's how long msg can be cached for. A record's TTL is also kept within the original TTL, and expiration, of
+// any RRSIG covering it. See https://datatracker.ietf.org/doc/html/rfc4035#section-5.3.3
+func (p ttlPolicy) apply(name string, msg *dns.Msg, now time.Time) uint32 {
+	minTTL, maxTTL := p.limits(name)
+
+	found := false
+	lowest := maxTTL
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		signatures := signatureTTLs(section, now)
+
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			ttl := min(max(rr.Header().Ttl, minTTL), maxTTL)
+
+			rtype := rr.Header().Rrtype
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				rtype = sig.TypeCovered
+			}
+			if limit, ok := signatures[rrsetKey{canonicalName(rr.Header().Name), rtype}]; ok {
+				ttl = min(ttl, limit)
+			}
+
+			rr.Header().Ttl = ttl
+			lowest = min(lowest, ttl)
+			found = true
+		}
+	}
+
+	if !found {
+		return 0
+	}
+	return lowest
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+// signatureTTLs returns the most each RRSet in section, signed by an RRSIG also in section, can be cached for; the
+// lower of the RRSIG's original TTL, and the time until it expires.
+func signatureTTLs(section []dns.RR, now time.Time) map[rrsetKey]uint32 {
+	var limits map[rrsetKey]uint32
+	for _, sig := range extractRecords[*dns.RRSIG](section) {
+		if limits == nil {
+			limits = make(map[rrsetKey]uint32)
+		}
+
+		// The expiration is a serial number, so wraps. See https://datatracker.ietf.org/doc/html/rfc4034#section-3.1.5
+		remaining := max(int32(sig.Expiration-uint32(now.Unix())), 0)
+		limit := min(sig.OrigTtl, uint32(remaining))
+
+		key := rrsetKey{canonicalName(sig.Hdr.Name), sig.TypeCovered}
+		if existing, ok := limits[key]; ok {
+			limit = min(existing, limit)
+		}
+		limits[key] = limit
+	}
+	return limits
+}
+
+// decrementTTLs reduces the TTL of each record in msg by elapsed, so a cached answer is returned with its remaining
+// lifetime.
+func decrementTTLs(msg *dns.Msg, elapsed time.Duration) {
+	seconds := uint32(elapsed / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl > seconds {
+				rr.Header().Ttl -= seconds
+			} else {
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLPolicy_Limits(t *testing.T) {
+	p := newTTLPolicy(CacheTTLConfig{
+		Min: 30,
+		Zones: map[string]TTLLimits{
+			"example.com":      {Max: 600},
+			"dyn.example.com.": {Min: 5, Max: 60},
+			"Static.Example.":  {Min: 3600},
+		},
+	})
+
+	tests := []struct {
+		name     string
+		min, max uint32
+	}{
+		{"example.net.", 30, MaxAllowedTTL},
+		{"example.com.", 30, 600},
+		{"www.example.com.", 30, 600},
+		{"host.dyn.example.com.", 5, 60},
+		{"www.static.example.", 3600, MaxAllowedTTL},
+		{"notexample.com.", 30, MaxAllowedTTL},
+	}
+	for _, tt := range tests {
+		minTTL, maxTTL := p.limits(tt.name)
+		assert.Equal(t, tt.min, minTTL, tt.name)
+		assert.Equal(t, tt.max, maxTTL, tt.name)
+	}
+
+	// The minimum can't be above the maximum.
+	minTTL, maxTTL := newTTLPolicy(CacheTTLConfig{Min: 600, Max: 60}).limits("example.com.")
+	assert.Equal(t, uint32(60), minTTL)
+	assert.Equal(t, uint32(60), maxTTL)
+}
+
+func TestTTLPolicy_Apply(t *testing.T) {
+	// Setup
+	now := time.Now()
+	p := newTTLPolicy(CacheTTLConfig{Min: 60, Max: 3600})
+	a := func(ttl uint32) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}, A: net.IPv4(192, 0, 2, 1)}
+	}
+
+	// Execute & Assertions - TTLs are bounded.
+	m := &dns.Msg{Answer: []dns.RR{a(10), a(300)}}
+	assert.Equal(t, uint32(60), p.apply("example.com.", m, now))
+	assert.Equal(t, uint32(60), m.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(300), m.Answer[1].Header().Ttl)
+
+	m = &dns.Msg{Answer: []dns.RR{a(86400)}}
+	assert.Equal(t, uint32(3600), p.apply("example.com.", m, now))
+
+	// The OPT record's TTL holds flags, so isn't touched.
+	m = &dns.Msg{Answer: []dns.RR{a(300)}}
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	assert.Equal(t, uint32(300), p.apply("example.com.", m, now))
+	assert.True(t, m.IsEdns0().Do())
+
+	// Signed records are held to the RRSIG's original TTL...
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3000},
+		TypeCovered: dns.TypeA,
+		OrigTtl:     120,
+		Expiration:  uint32(now.Add(time.Hour).Unix()),
+	}
+	m = &dns.Msg{Answer: []dns.RR{a(3000), sig}}
+	assert.Equal(t, uint32(120), p.apply("example.com.", m, now))
+	assert.Equal(t, uint32(120), m.Answer[0].Header().Ttl)
+	assert.Equal(t, uint32(120), m.Answer[1].Header().Ttl)
+
+	// ...and its expiration, even below the minimum.
+	sig = dns.Copy(sig).(*dns.RRSIG)
+	sig.OrigTtl = 3000
+	sig.Expiration = uint32(now.Add(30 * time.Second).Unix())
+	m = &dns.Msg{Answer: []dns.RR{a(3000), sig}}
+	assert.Equal(t, uint32(30), p.apply("example.com.", m, now))
+
+	sig.Expiration = uint32(now.Add(-time.Second).Unix())
+	m = &dns.Msg{Answer: []dns.RR{a(3000), sig}}
+	assert.Equal(t, uint32(0), p.apply("example.com.", m, now))
+
+	// Nothing to cache.
+	assert.Equal(t, uint32(0), p.apply("example.com.", &dns.Msg{}, now))
+}
+
+func TestDNSCache_DecrementingTTL(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	m := staleTestAnswer(q, "192.0.2.1")
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	c.set(q, m)
+
+	// Execute - as if it were cached 100 seconds ago.
+	entry := c.getShard("example.com.-1-1").items["example.com.-1-1"]
+	require.NotNil(t, entry)
+	entry.cached = entry.cached.Add(-100 * time.Second)
+
+	// Assertions
+	cached := c.get(q, 1)
+	require.NotNil(t, cached)
+	assert.Equal(t, uint32(200), cached.Answer[0].Header().Ttl)
+	assert.True(t, cached.IsEdns0().Do())
+
+	// The stored copy is unchanged.
+	assert.Equal(t, uint32(300), entry.msg.Answer[0].Header().Ttl)
+}
+
+func TestDNSCache_TTLPolicy(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{CacheTTL: CacheTTLConfig{Max: 60, Zones: map[string]TTLLimits{"example.net.": {Max: 10}}}}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	other := dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	zero := dns.Question{Name: "zero.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// Execute
+	c.set(q, staleTestAnswer(q, "192.0.2.1"))
+	c.set(other, staleTestAnswer(other, "192.0.2.1"))
+	m := staleTestAnswer(zero, "192.0.2.1")
+	m.Answer[0].Header().Ttl = 0
+	c.set(zero, m)
+
+	// Assertions
+	cached := c.get(q, 1)
+	require.NotNil(t, cached)
+	assert.Equal(t, uint32(60), cached.Answer[0].Header().Ttl)
+	entry := c.getShard("example.com.-1-1").items["example.com.-1-1"]
+	assert.WithinDuration(t, time.Now().Add(time.Minute), entry.expires, 5*time.Second)
+
+	cached = c.get(other, 1)
+	require.NotNil(t, cached)
+	assert.Equal(t, uint32(10), cached.Answer[0].Header().Ttl)
+
+	// Records with a zero TTL aren't cached.
+	assert.Nil(t, c.get(zero, 1))
+}
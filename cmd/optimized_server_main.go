@@ -43,6 +43,7 @@ func main() {
 	// Create fast resolver
 	var fastResolver *resolver.FastResolver
 	if *cache {
+		resolver.Cache = resolver.NewMemoryCache(0)
 		fastResolver = resolver.NewFastResolver(resolver.Cache)
 		log.Println("✅ Fast resolver with cache enabled")
 	} else {
@@ -46,19 +46,33 @@ func cname(ctx context.Context, qmsg *dns.Msg, r *Response, exchanger exchanger,
 
 			cnameQMsg := new(dns.Msg)
 			cnameQMsg.SetQuestion(target, qmsg.Question[0].Qtype)
+			if isSetDO(qmsg) {
+				cnameQMsg.SetEdns0(4096, true)
+			}
+
+			// The target is cached separately, so its ECS scope is tracked separately too; the overall
+			// answer is then only valid for the narrower of the two.
+			ecs := clientSubnetFromContext(ctx)
 
 			var cnameRMsg *Response
 			// Проверяем кэш для CNAME-записи
-			if cachedMsg := cache.get(cnameQMsg.Question[0], qmsg.Id); cachedMsg != nil {
+			if cachedMsg, scope := cache.getAnswer(cnameQMsg, ecs.client()); cachedMsg != nil {
 				cnameRMsg = &Response{Msg: cachedMsg}
+				if ecs != nil {
+					ecs.merge(scope)
+				}
 			} else {
-				if isSetDO(qmsg) {
-					cnameQMsg.SetEdns0(4096, true)
+				var targetECS *clientSubnet
+				if ecs != nil {
+					targetECS = ecs.fork()
 				}
-				cnameRMsg = exchanger.exchange(ctx, cnameQMsg)
+				cnameRMsg = exchanger.exchange(targetECS.withContext(ctx), cnameQMsg)
 				// Кэшируем ответ, если он не содержит ошибок
 				if !cnameRMsg.HasError() {
-					cache.set(cnameQMsg.Question[0], cnameRMsg.Msg)
+					cache.setAnswer(cnameQMsg, cnameRMsg, targetECS.scopePrefix())
+					if ecs != nil {
+						ecs.merge(targetECS.scopeLength())
+					}
 				}
 			}
 
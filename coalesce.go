@@ -0,0 +1,147 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Coalescing of identical in-flight queries.
+//
+// When several identical queries arrive while the first is still being resolved, they share its result rather
+// than each resolving it again. This happens both for the queries clients send to the Server, and for the queries
+// sent to each zone's nameservers.
+
+// flightGroup runs one call at a time for each key, sharing its result with every caller asking for the same key
+// while it's running. Its zero value is ready to use.
+type flightGroup[T any] struct {
+	lock  sync.Mutex
+	calls map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done   chan struct{}
+	result T
+
+	// waiters is how many callers are still waiting on the result; shared is set once there's been more than one.
+	// cancel stops the call once there are no waiters left.
+	waiters int
+	shared  bool
+	cancel  context.CancelFunc
+}
+
+// do returns the result of fn for key, sharing it with any other callers for the same key while fn is running.
+// shared is true if the result was shared, in which case the callers mustn't change it.
+//
+// fn runs with the values of the first caller's ctx, but not its deadline; each caller stops waiting once its own
+// ctx is done, returning ctx's error. fn's context is only cancelled once every caller has stopped waiting.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(ctx context.Context) T) (result T, shared bool, err error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight[T])
+	}
+
+	f, ok := g.calls[key]
+	if ok {
+		f.shared = true
+	} else {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = f
+
+		go func() {
+			defer cancel()
+			f.result = fn(callCtx)
+
+			g.lock.Lock()
+			g.forget(key, f)
+			g.lock.Unlock()
+
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.lock.Unlock()
+
+	select {
+	case <-f.done:
+		// shared is no longer changed once the call's been forgotten.
+		return f.result, f.shared, nil
+	case <-ctx.Done():
+		g.lock.Lock()
+		if f.waiters--; f.waiters == 0 {
+			// Nobody's left waiting on the result. A new caller starts the call again.
+			g.forget(key, f)
+			f.cancel()
+		}
+		g.lock.Unlock()
+		return result, false, ctx.Err()
+	}
+}
+
+// forget stops new callers for key from joining f. g.lock must be held.
+func (g *flightGroup[T]) forget(key string, f *flight[T]) {
+	if g.calls[key] == f {
+		delete(g.calls, key)
+	}
+}
+
+//---
+
+// sharedResponse returns a copy of the shared resp, with the message ID id, which the caller is free to change.
+func sharedResponse(resp *Response, id uint16) *Response {
+	if resp == nil {
+		return nil
+	}
+	copied := *resp
+	if resp.Msg != nil {
+		copied.Msg = resp.Msg.Copy()
+		copied.Msg.Id = id
+	}
+	return &copied
+}
+
+// serverResolution is the result shared by identical client queries, resolved by the Server.
+type serverResolution struct {
+	resp *Response
+	// scope is the ECS scope prefix length the answer was returned with.
+	scope int
+}
+
+// resolveShared resolves r as resolve does, sharing the resolution with any identical queries already in flight.
+// Queries are identical if they ask the same question, for the same DNSSEC variant of the answer, on behalf of the
+// same client subnet.
+func (s *Server) resolveShared(ctx context.Context, r *dns.Msg, ecs *clientSubnet) *Response {
+	key := fmt.Sprintf("%s-%t", queryVariant(r).baseKey(r.Question[0]), r.RecursionDesired)
+	if client := ecs.client(); client.IsValid() {
+		key += "/" + client.String()
+	}
+
+	result, shared, err := s.flights.do(ctx, key, func(ctx context.Context) serverResolution {
+		resp := s.resolve(ctx, r, ecs)
+		return serverResolution{resp: resp, scope: ecs.scopeLength()}
+	})
+	if err != nil {
+		return newResponseError(err)
+	}
+	if !shared {
+		return result.resp
+	}
+
+	if ecs != nil {
+		ecs.merge(result.scope)
+	}
+	return sharedResponse(result.resp, r.Id)
+}
+
+// zoneFlightKey returns the key identical queries sent to a zone's nameservers share.
+func zoneFlightKey(m *dns.Msg) string {
+	q := m.Question[0]
+	key := fmt.Sprintf("%s-%d-%d-%t-%t-%t", q.Name, q.Qtype, q.Qclass, m.RecursionDesired, m.CheckingDisabled, isSetDO(m))
+	if subnet := clientSubnetOption(m); subnet != nil {
+		key += "/" + subnet.String()
+	}
+	return key
+}
@@ -0,0 +1,212 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// flightTestWaiters returns how many callers are waiting on the call for key.
+func flightTestWaiters[T any](g *flightGroup[T], key string) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if f, ok := g.calls[key]; ok {
+		return f.waiters
+	}
+	return 0
+}
+
+func TestFlightGroup_Do(t *testing.T) {
+	// Setup
+	var g flightGroup[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+
+	fn := func(ctx context.Context) int {
+		calls.Add(1)
+		<-release
+		return 42
+	}
+
+	// Execute
+	var wg sync.WaitGroup
+	results := make([]int, 10)
+	shared := make([]bool, 10)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], shared[i], _ = g.do(context.Background(), "key", fn)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return flightTestWaiters(&g, "key") == 10
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Assertions
+	assert.Equal(t, int32(1), calls.Load())
+	for i := range results {
+		assert.Equal(t, 42, results[i])
+		assert.True(t, shared[i])
+	}
+
+	// Once done, the next call runs again, and isn't shared.
+	result, isShared, err := g.do(context.Background(), "key", fn)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, result)
+	assert.False(t, isShared)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestFlightGroup_Deadline(t *testing.T) {
+	// Setup
+	var g flightGroup[int]
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+
+	fn := func(ctx context.Context) int {
+		select {
+		case <-release:
+			return 42
+		case <-ctx.Done():
+			close(cancelled)
+			return 0
+		}
+	}
+
+	patient, cancelPatient := context.WithCancel(context.Background())
+	done := make(chan int)
+	go func() {
+		result, _, _ := g.do(patient, "key", fn)
+		done <- result
+	}()
+	require.Eventually(t, func() bool {
+		return flightTestWaiters(&g, "key") == 1
+	}, time.Second, time.Millisecond)
+
+	// Execute & Assertions - a caller's own deadline is respected, without stopping the call for the others.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err := g.do(ctx, "key", fn)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 1, flightTestWaiters(&g, "key"))
+
+	select {
+	case <-cancelled:
+		t.Fatal("the call was cancelled while a caller was still waiting")
+	default:
+	}
+
+	// Once every caller has stopped waiting, the call is cancelled.
+	cancelPatient()
+	assert.Zero(t, <-done)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the call wasn't cancelled")
+	}
+	assert.Zero(t, flightTestWaiters(&g, "key"))
+	close(release)
+}
+
+func TestServer_ResolveShared(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(qmsg)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+		return &Response{Msg: m}
+	})
+
+	// Execute - queries with their own IDs, all in flight at once.
+	var wg sync.WaitGroup
+	writers := make([]*mockResponseWriter, 10)
+	for i := range writers {
+		writers[i] = newMockUDPResponseWriter()
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.Id = uint16(1000 + i)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.processQuery(writers[i], r)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return flightTestWaiters(&s.flights, "example.com.-1-1-true") == 10
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Assertions - the name was resolved once, with every client sent the answer under its own ID.
+	assert.Equal(t, int32(1), calls.Load())
+	for i, w := range writers {
+		msg := w.msg()
+		require.NotNil(t, msg, i)
+		assert.Equal(t, uint16(1000+i), msg.Id)
+		assert.Len(t, msg.Answer, 1)
+	}
+}
+
+func TestZoneImpl_Exchange_Shared(t *testing.T) {
+	// Setup
+	release := make(chan struct{})
+	pool := new(MockExpiringExchanger)
+	pool.On("exchange", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		<-release
+	}).Return(func() *Response {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Response = true
+		m.Id = 1
+		return &Response{Msg: m}
+	}()).Once()
+
+	z := &zoneImpl{zoneName: "com.", pool: pool}
+	ctx := context.WithValue(context.Background(), CtxTrace, newTraceWithStart(time.Now()))
+
+	// Execute
+	var wg sync.WaitGroup
+	responses := make([]*Response, 5)
+	for i := range responses {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		m.Id = uint16(i + 1)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = z.exchange(ctx, m)
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return flightTestWaiters(&z.flights, "example.com.-1-1-true-false-false") == 5
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// Assertions - one query was sent upstream; each caller has its own copy of the response, with its ID.
+	pool.AssertNumberOfCalls(t, "exchange", 1)
+	for i, response := range responses {
+		require.False(t, response.IsEmpty(), i)
+		assert.Equal(t, uint16(i+1), response.Msg.Id)
+	}
+	assert.NotSame(t, responses[0].Msg, responses[1].Msg)
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"github.com/miekg/dns"
 	"github.com/nsmithuk/resolver/dnssec"
 	"time"
 )
@@ -19,6 +20,58 @@ const (
 	DefaultRemoveAuthoritySectionForPositiveAnswers  = true
 	DefaultRemoveAdditionalSectionForPositiveAnswers = true
 
+	DefaultQNameMinimisation      = QNameMinimisationOff
+	DefaultQNameMinimisationQType = dns.TypeA
+
+	DefaultAggressiveNSEC                  = true
+	DefaultMaxAggressiveNSECRecordsPerZone = 256
+
+	DefaultRandomiseQNameCase       = false
+	DefaultSendDNSCookies           = true
+	DefaultQNameCaseExemptionPeriod = 24 * time.Hour
+
+	DefaultMaxUDPResponseSize = uint16(4096)
+
+	DefaultResponsePaddingBlockSize = 468
+
+	DefaultListenAddr = ":5355"
+
+	DefaultTLSListenAddr  = ":853"
+	DefaultTLSIdleTimeout = 10 * time.Second
+
+	DefaultDoQListenAddr              = ":853"
+	DefaultDoQMaxStreamsPerConnection = 100
+
+	DefaultTimeoutDoHRead = 5 * time.Second
+
+	DefaultRRLWindow           = 15 * time.Second
+	DefaultRRLSlip             = 2
+	DefaultRRLIPv4PrefixLength = 24
+	DefaultRRLIPv6PrefixLength = 56
+	DefaultRRLMaxTableSize     = 20000
+
+	DefaultECSIPv4PrefixLength = 24
+	DefaultECSIPv6PrefixLength = 56
+
+	DefaultStaleAnswerTTL             = 30
+	DefaultStaleClientResponseTimeout = 1800 * time.Millisecond
+	DefaultStaleFailureRecheck        = 30 * time.Second
+
+	DefaultSnapshotInterval = 5 * time.Minute
+
+	DefaultWorkers      = 50
+	DefaultQueueSize    = 1000
+	DefaultQueryTimeout = 10 * time.Second
+
+	DefaultPrefetchWorkers   = 4
+	DefaultPrefetchQueueSize = 256
+	DefaultPrefetchWindow    = 0.1
+	DefaultPrefetchMinHits   = 2
+	DefaultPrefetchKeys      = 100000
+
+	DefaultMemoryCacheSize       = 10000
+	DefaultFileCacheSaveInterval = time.Minute
+
 	DefaultTimeoutUDP = 150 * time.Millisecond
 	DefaultTimeoutTCP = 600 * time.Millisecond
 )
@@ -52,6 +105,44 @@ var (
 	// that it's record have no material impact on the result. e.g. it only contains nameserver records.
 	RemoveAuthoritySectionForPositiveAnswers  = DefaultRemoveAuthoritySectionForPositiveAnswers
 	RemoveAdditionalSectionForPositiveAnswers = DefaultRemoveAdditionalSectionForPositiveAnswers
+
+	// QNameMinimisation sets if, and how, each zone is only asked about the next label of the QName, rather than the
+	// full name. See https://datatracker.ietf.org/doc/html/rfc9156
+	QNameMinimisation = DefaultQNameMinimisation
+
+	// QNameMinimisationQType is the type asked for in minimised queries. RFC 7816 used NS, but A is now recommended,
+	// as some nameservers handle NS queries poorly. See https://datatracker.ietf.org/doc/html/rfc9156#section-3
+	QNameMinimisationQType = DefaultQNameMinimisationQType
+
+	// AggressiveNSEC enables answering queries from the NSEC and NSEC3 records kept from earlier validated responses,
+	// when they prove the name, or type, doesn't exist. See https://datatracker.ietf.org/doc/html/rfc8198
+	AggressiveNSEC = DefaultAggressiveNSEC
+
+	// MaxAggressiveNSECRecordsPerZone is the most NSEC, or NSEC3, records kept for each zone for AggressiveNSEC.
+	// Every record kept for a zone is checked on each query to it, so this bounds the cost of doing so.
+	MaxAggressiveNSECRecordsPerZone = DefaultMaxAggressiveNSECRecordsPerZone
+
+	// RandomiseQNameCase enables DNS 0x20; the case of each letter in the QName sent to nameservers is randomised,
+	// and responses that don't echo it exactly are rejected. This adds entropy against spoofed responses.
+	// See https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00
+	RandomiseQNameCase = DefaultRandomiseQNameCase
+
+	// SendDNSCookies enables sending DNS Cookies to nameservers, on queries using EDNS. The server cookie returned by
+	// each nameserver is remembered, and responses that don't echo our client cookie are rejected.
+	// See https://datatracker.ietf.org/doc/html/rfc7873
+	SendDNSCookies = DefaultSendDNSCookies
+
+	// QNameCaseExemptionPeriod is how long a nameserver seen not to preserve the case of the QName, over TCP, is
+	// exempt from RandomiseQNameCase, before it's tried again.
+	QNameCaseExemptionPeriod = DefaultQNameCaseExemptionPeriod
+
+	// MaxUDPResponseSize is the EDNS UDP payload size the Server advertises, and the upper bound on the size of
+	// any response it sends over UDP. Larger responses are truncated, with the TC bit set.
+	MaxUDPResponseSize = DefaultMaxUDPResponseSize
+
+	// ResponsePaddingBlockSize is the block length that responses sent over encrypted transports are padded to,
+	// when the client's query included the EDNS(0) Padding option. See https://datatracker.ietf.org/doc/html/rfc8467#section-4.1
+	ResponsePaddingBlockSize = DefaultResponsePaddingBlockSize
 )
 
 //---
@@ -63,9 +154,221 @@ type Config struct {
 	EnableCache bool
 	// CacheSize specifies the maximum number of entries the cache can hold.
 	CacheSize int
+	// CacheMaxBytes is the memory budget of the cache, in bytes, as estimated from the size of each entry.
+	// The cache is only limited by CacheSize when zero.
+	CacheMaxBytes int64
+	// CacheEviction chooses which entries are evicted once the cache is full. Defaults to EvictionLRU.
+	CacheEviction EvictionPolicy
+
+	// Workers configures the pool of workers queries are answered by, and what happens once they're overloaded.
+	Workers WorkerConfig
+
+	// Listeners are the plain DNS listeners the Server binds. Defaults to UDP and TCP on DefaultListenAddr.
+	// Use port 0 to bind an ephemeral port; the bound addresses are returned by Server.Addrs.
+	Listeners []Listener
+
+	// TLSCertFile and TLSKeyFile are the PEM encoded certificate and key used for DNS-over-TLS.
+	// The DoT listener is only started when TLSCertFile is set.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSListenAddr is the address the DoT listener binds to. Defaults to DefaultTLSListenAddr.
+	TLSListenAddr string
+	// TLSIdleTimeout is how long an idle DoT connection is kept open. Defaults to DefaultTLSIdleTimeout.
+	TLSIdleTimeout time.Duration
+
+	// DoHListenAddr is the address the standalone DNS-over-HTTPS listener binds to, serving queries on DoHPath,
+	// and JSON lookups on JSONPath.
+	// It uses TLSCertFile and TLSKeyFile when set; plain HTTP otherwise. The listener is only started when this is set.
+	DoHListenAddr string
+
+	// DoQListenAddr is the address the DNS-over-QUIC listener binds to. It requires TLSCertFile and TLSKeyFile.
+	// The listener is only started when this is set.
+	DoQListenAddr string
+
+	// RateLimit configures response rate limiting of replies sent over plain UDP.
+	RateLimit RateLimitConfig
+
+	// RecursionACL, CacheOnlyACL and AdminACL control which clients may make recursive queries, non-recursive (RD=0)
+	// queries, and CHAOS class queries respectively. They're checked before a query is queued; denied clients are
+	// sent REFUSED. An empty ACL allows every client.
+	RecursionACL ACL
+	CacheOnlyACL ACL
+	AdminACL     ACL
+
+	// ClientSubnet configures EDNS Client Subnet on queries sent to authoritative nameservers.
+	ClientSubnet ClientSubnetConfig
+
+	// CacheTTL configures the bounds on how long answers are cached for.
+	CacheTTL CacheTTLConfig
+
+	// ServeStale configures answering from expired cache entries when resolving fails.
+	ServeStale ServeStaleConfig
+
+	// Prefetch configures refreshing popular answers in the cache before they expire.
+	Prefetch PrefetchConfig
+
+	// Snapshot configures saving the cache, and the learned delegations, to a file, so they survive a restart.
+	Snapshot SnapshotConfig
+
+	// Cookies configures the server cookies returned to clients. Clients that return a valid server cookie
+	// are exempt from RateLimit.
+	Cookies CookieConfig
+}
+
+// WorkerConfig configures the workers queries are answered by. Queries wait in a queue for a free worker; once the
+// queue is full, further queries are shed as Overload says, rather than waiting for room.
+type WorkerConfig struct {
+	// Count is how many queries are answered at once. Defaults to DefaultWorkers.
+	Count int
+
+	// QueueSize is how many more queries can wait for a worker. Defaults to DefaultQueueSize.
+	QueueSize int
+
+	// Overload is what's done with the queries that arrive while the queue is full. Defaults to OverloadDrop.
+	Overload OverloadAction
+
+	// QueryTimeout is how long each query has to be resolved, from when a worker starts answering it. Queries
+	// that take longer are sent SERVFAIL, or a stale answer if there is one. Defaults to DefaultQueryTimeout.
+	QueryTimeout time.Duration
+}
+
+// CookieConfig configures the server side of DNS Cookies (RFC 7873). Server cookies are enabled by default.
+type CookieConfig struct {
+	// Disabled stops server cookies from being issued, or verified.
+	Disabled bool
+
+	// Secret is the key server cookies are generated with. Servers behind the same address should share it,
+	// so the cookie issued by one is accepted by the others. A random secret is generated when empty.
+	Secret []byte
+}
+
+// ClientSubnetConfig configures EDNS Client Subnet (RFC 7871). When enabled, a truncated form of the client's address
+// is sent to the nameservers of the listed zones, and answers are cached per the scope those nameservers return.
+type ClientSubnetConfig struct {
+	// Zones whose nameservers are sent the client's subnet. Each zone includes its subdomains.
+	// ECS is disabled when empty.
+	Zones []string
+
+	// IPv4PrefixLength and IPv6PrefixLength are the number of bits of the client's address that are sent.
+	// They default to DefaultECSIPv4PrefixLength and DefaultECSIPv6PrefixLength.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+}
+
+// RateLimitConfig configures BIND style Response Rate Limiting (RRL). Responses are counted in token buckets keyed
+// by the client's network prefix, the type of response, and the query name; or the zone, for NXDOMAIN and error
+// responses. Once a bucket is empty, responses are dropped, with every Slip'th one replaced by an empty truncated
+// reply, so genuine clients can retry over TCP.
+// See https://kb.isc.org/docs/aa-00994
+type RateLimitConfig struct {
+	// ResponsesPerSecond is the number of answers, and NODATA responses, allowed per second for each bucket.
+	// Rate limiting is disabled when zero.
+	ResponsesPerSecond int
+	// NXDomainsPerSecond and ErrorsPerSecond are the limits for NXDOMAIN and error responses.
+	// Both default to ResponsesPerSecond.
+	NXDomainsPerSecond int
+	ErrorsPerSecond    int
+
+	// Window is how long a client stays limited after it exceeds its rate. Defaults to DefaultRRLWindow.
+	Window time.Duration
+
+	// Slip sets how many dropped responses there are for each truncated reply sent. 1 replaces every dropped response
+	// with a truncated reply; a negative value never sends one. Defaults to DefaultRRLSlip.
+	Slip int
+
+	// IPv4PrefixLength and IPv6PrefixLength group clients into network prefixes.
+	// They default to DefaultRRLIPv4PrefixLength and DefaultRRLIPv6PrefixLength.
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+
+	// MaxTableSize is the most buckets kept at once. Once reached, the buckets updated longest ago are dropped
+	// to make room. Defaults to DefaultRRLMaxTableSize.
+	MaxTableSize int
+
+	// LogOnly logs the responses that would be limited, but still sends them.
+	LogOnly bool
+}
+
+// Listener is a plain DNS listener. Net is one of udp, udp4, udp6, tcp, tcp4 or tcp6.
+type Listener struct {
+	Net  string
+	Addr string
+}
+
+// CacheTTLConfig bounds how long answers are cached for, and so the TTLs returned to clients. Each record's TTL, in
+// seconds, is raised to Min or lowered to Max when it's cached. Max defaults to MaxAllowedTTL.
+type CacheTTLConfig struct {
+	Min uint32
+	Max uint32
+
+	// Zones overrides Min and Max for the names at, or below, each zone; the most specific zone applies.
+	// A zero Min or Max falls back to the global value.
+	Zones map[string]TTLLimits
+}
+
+// TTLLimits are the bounds on the TTLs of the records cached for a zone, in seconds.
+type TTLLimits struct {
+	Min uint32
+	Max uint32
+}
+
+// ServeStaleConfig configures serving stale answers (RFC 8767). Answers are kept in the cache for Window after
+// they expire. If resolving a fresh answer fails, or takes longer than ClientResponseTimeout, the stale answer is
+// returned with a TTL of DefaultStaleAnswerTTL, and an Extended DNS Error saying it's stale.
+// See https://datatracker.ietf.org/doc/html/rfc8767
+type ServeStaleConfig struct {
+	// Window is how long answers are kept after they expire. Serving stale answers is disabled when 0.
+	Window time.Duration
+
+	// ClientResponseTimeout is how long we wait for a fresh answer before returning a stale one.
+	// The resolution carries on in the background, refreshing the cache. Defaults to DefaultStaleClientResponseTimeout.
+	ClientResponseTimeout time.Duration
+
+	// FailureRecheck is how long after failing to resolve a fresh answer stale answers are returned without trying
+	// again. Defaults to DefaultStaleFailureRecheck.
+	FailureRecheck time.Duration
+}
+
+// PrefetchConfig configures Unbound style prefetching. When a popular answer is returned from the cache within the
+// last Window of its TTL, it's refreshed in the background, so it's never missing from the cache while it's in use.
+// How often each answer is used is estimated in a fixed amount of memory, so only those returned at least MinHits
+// times recently are refreshed. Prefetching is enabled by default.
+// See https://unbound.docs.nlnetlabs.nl/en/latest/manpages/unbound.conf.html#unbound-conf-prefetch
+type PrefetchConfig struct {
+	// Disabled stops answers from being prefetched.
+	Disabled bool
+
+	// Workers is how many answers are refreshed at once, and QueueSize how many more can wait to be. Answers due
+	// to be refreshed while the queue is full are skipped. They default to DefaultPrefetchWorkers and
+	// DefaultPrefetchQueueSize.
+	Workers   int
+	QueueSize int
+
+	// Window is the fraction of an answer's TTL, at the end of it, in which it's refreshed. Defaults to
+	// DefaultPrefetchWindow; 10%.
+	Window float64
+
+	// MinHits is how many times an answer must have been returned from the cache for it to be refreshed.
+	// Defaults to DefaultPrefetchMinHits. The most it can be is 15.
+	MinHits int
+
+	// Keys is around how many distinct answers' popularity is tracked. Defaults to DefaultPrefetchKeys.
+	Keys int
+}
+
+// SnapshotConfig configures persisting the cache for warm restarts. The cache, and the zones learned while resolving,
+// along with their nameservers and DNSKEYs, are saved to Path every Interval, and on Shutdown. They're loaded back
+// when the Server is created, with their remaining TTLs; anything that's since expired is dropped.
+type SnapshotConfig struct {
+	// Path is the file the snapshot is saved to. Snapshots are disabled when empty.
+	Path string
+
+	// Interval is how often the snapshot is saved. Defaults to DefaultSnapshotInterval.
+	Interval time.Duration
 }
 
-// Cache Default (disabled) cache function.
+// Cache Default (disabled) cache function. When set, the responses from each zone's nameservers to queries with DO
+// set are cached, so they're shared by every lookup passing through the zone. See NewMemoryCache and NewFileCache.
 var Cache CacheInterface = nil
 
 //---
@@ -0,0 +1,272 @@
+package resolver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/dns"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DNS Cookies. See https://datatracker.ietf.org/doc/html/rfc7873
+//
+// As a client, we send a cookie to each nameserver, and remember the server cookie it returns.
+// As a server, we return a server cookie to each client that sends a client cookie; clients that return a valid
+// server cookie have proven their address isn't spoofed.
+
+const (
+	clientCookieLength = 8
+
+	// Server cookies are between 8 and 32 bytes.
+	minServerCookieLength = 8
+	maxServerCookieLength = 32
+
+	// Our server cookies follow https://datatracker.ietf.org/doc/html/rfc9018#section-4
+	// Version (1) | Reserved (3) | Timestamp (4) | Hash (8)
+	serverCookieVersion = 1
+	serverCookieLength  = 16
+
+	// How far either side of now a server cookie's timestamp can be (RFC 9018 4.3).
+	serverCookieMaxAge       = time.Hour
+	serverCookieMaxClockSkew = 5 * time.Minute
+)
+
+// cookieJar holds the server cookies returned by nameservers, by address.
+// Client cookies aren't stored; each is derived from the nameserver's address and our secret.
+type cookieJar struct {
+	secret []byte
+
+	lock    sync.Mutex
+	servers map[string][]byte
+}
+
+func newCookieJar() *cookieJar {
+	return &cookieJar{secret: randomSecret(), servers: make(map[string][]byte)}
+}
+
+// cookie returns the option to send to the nameserver at addr.
+func (j *cookieJar) cookie(addr string) *dns.EDNS0_COOKIE {
+	cookie := j.clientCookie(addr)
+
+	j.lock.Lock()
+	cookie = append(cookie, j.servers[addr]...)
+	j.lock.Unlock()
+
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)}
+}
+
+// clientCookie is unique to each nameserver, so nameservers can't use it to track us between them.
+func (j *cookieJar) clientCookie(addr string) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write([]byte(addr))
+	return mac.Sum(nil)[:clientCookieLength]
+}
+
+// record takes the server cookie from the nameserver at addr's response r, then removes the option so it's not
+// passed on. A response whose client cookie doesn't match the one we sent is rejected as spoofed, as is one without
+// a cookie once the nameserver has returned a server cookie (RFC 7873 5.3). A BADCOOKIE response is also returned as
+// an error, so the query is retried with the fresh server cookie.
+func (j *cookieJar) record(addr string, r *dns.Msg) error {
+	opt := cookieOption(r)
+	if opt == nil {
+		j.lock.Lock()
+		_, known := j.servers[addr]
+		j.lock.Unlock()
+
+		if known {
+			return fmt.Errorf("%w from %s", ErrCookieMissing, addr)
+		}
+		return nil
+	}
+	removeCookieOption(r)
+
+	client, server, err := parseCookie(opt)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(client, j.clientCookie(addr)) {
+		return fmt.Errorf("%w from %s", ErrCookieMismatch, addr)
+	}
+
+	if len(server) > 0 {
+		j.lock.Lock()
+		j.servers[addr] = server
+		j.lock.Unlock()
+	}
+
+	if r.Rcode == dns.RcodeBadCookie {
+		return fmt.Errorf("%w from %s", ErrBadCookie, addr)
+	}
+	return nil
+}
+
+// forget removes the server cookie from the nameserver at addr, once it's genuinely stopped returning one.
+func (j *cookieJar) forget(addr string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.servers, addr)
+}
+
+//---
+
+// serverCookies issues, and verifies, the server cookies we return to our clients.
+// The hash is a truncated HMAC-SHA256, rather than RFC 9018's SipHash, so cookies are only interoperable
+// between instances of this Server sharing the same secret.
+type serverCookies struct {
+	secret []byte
+	now    func() time.Time
+}
+
+// newServerCookies returns nil if server cookies are disabled.
+func newServerCookies(config CookieConfig) *serverCookies {
+	if config.Disabled {
+		return nil
+	}
+
+	secret := config.Secret
+	if len(secret) == 0 {
+		secret = randomSecret()
+	}
+	return &serverCookies{secret: secret, now: time.Now}
+}
+
+// issue returns a fresh server cookie for the client at addr that sent client.
+func (c *serverCookies) issue(client []byte, addr netip.Addr) []byte {
+	cookie := make([]byte, 8, serverCookieLength)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], uint32(c.now().Unix()))
+	return append(cookie, c.hash(client, cookie, addr)...)
+}
+
+// verify returns true if server is a valid cookie we issued to the client at addr, with client.
+func (c *serverCookies) verify(client, server []byte, addr netip.Addr) bool {
+	if len(server) != serverCookieLength || server[0] != serverCookieVersion {
+		return false
+	}
+
+	issued := time.Unix(int64(binary.BigEndian.Uint32(server[4:8])), 0)
+	now := c.now()
+	if issued.Before(now.Add(-serverCookieMaxAge)) || issued.After(now.Add(serverCookieMaxClockSkew)) {
+		return false
+	}
+
+	return hmac.Equal(server[8:], c.hash(client, server[:8], addr))
+}
+
+func (c *serverCookies) hash(client, header []byte, addr netip.Addr) []byte {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(client)
+	mac.Write(header)
+	mac.Write(addr.Unmap().AsSlice())
+	return mac.Sum(nil)[:8]
+}
+
+// replyCookie returns the cookie option to include in the reply to r, carrying a fresh server cookie; and true if
+// r included a valid server cookie. nil is returned when r has no valid client cookie, or server cookies are disabled.
+func (s *Server) replyCookie(w dns.ResponseWriter, r *dns.Msg) (*dns.EDNS0_COOKIE, bool) {
+	if s.cookies == nil {
+		return nil, false
+	}
+
+	opt := cookieOption(r)
+	if opt == nil {
+		return nil, false
+	}
+
+	client, server, err := parseCookie(opt)
+	if err != nil {
+		return nil, false
+	}
+
+	addr := clientAddr(w.RemoteAddr())
+	verified := len(server) > 0 && s.cookies.verify(client, server, addr)
+
+	cookie := append(append([]byte{}, client...), s.cookies.issue(client, addr)...)
+	return &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)}, verified
+}
+
+// malformedCookie returns true if r includes a cookie option that isn't valid.
+func malformedCookie(r *dns.Msg) bool {
+	opt := cookieOption(r)
+	if opt == nil {
+		return false
+	}
+	_, _, err := parseCookie(opt)
+	return err != nil
+}
+
+//---
+
+// cookieOption returns the cookie option in m, if there is one.
+func cookieOption(m *dns.Msg) *dns.EDNS0_COOKIE {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if cookie, ok := o.(*dns.EDNS0_COOKIE); ok {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func removeCookieOption(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_COOKIE); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// withCookie returns m with cookie as its only cookie option; or with no cookie option when cookie is nil.
+// Cookies are only sent on queries already using EDNS. m itself is never modified, as it may be shared between exchanges.
+func withCookie(m *dns.Msg, cookie *dns.EDNS0_COOKIE) *dns.Msg {
+	if m.IsEdns0() == nil || (cookie == nil && cookieOption(m) == nil) {
+		return m
+	}
+
+	m = m.Copy()
+	removeCookieOption(m)
+	if cookie != nil {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, cookie)
+	}
+	return m
+}
+
+// parseCookie splits opt into its client and server cookies. The server cookie is empty if only a client cookie
+// was sent. An error is returned if either is malformed (RFC 7873 5.2.2).
+func parseCookie(opt *dns.EDNS0_COOKIE) (client, server []byte, err error) {
+	cookie, err := hex.DecodeString(opt.Cookie)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrMalformedCookie, err)
+	}
+
+	length := len(cookie)
+	if length != clientCookieLength && (length < clientCookieLength+minServerCookieLength || length > clientCookieLength+maxServerCookieLength) {
+		return nil, nil, fmt.Errorf("%w: invalid length %d", ErrMalformedCookie, length)
+	}
+
+	return cookie[:clientCookieLength], cookie[clientCookieLength:], nil
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		// crypto/rand never returns an error on supported platforms.
+		panic(err)
+	}
+	return secret
+}
@@ -0,0 +1,273 @@
+package resolver
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cookieTestQuery(cookie string) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	if cookie != "" {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return q
+}
+
+func TestParseCookie(t *testing.T) {
+	client, server, err := parseCookie(&dns.EDNS0_COOKIE{Cookie: "0102030405060708"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, client)
+	assert.Empty(t, server)
+
+	client, server, err = parseCookie(&dns.EDNS0_COOKIE{Cookie: "0102030405060708" + strings.Repeat("ab", 16)})
+	require.NoError(t, err)
+	assert.Len(t, client, 8)
+	assert.Len(t, server, 16)
+
+	// Client cookies must be 8 bytes, and server cookies between 8 and 32.
+	for _, cookie := range []string{"", "01020304", "0102030405060708ab", "0102030405060708" + strings.Repeat("ab", 33), "not hex!"} {
+		_, _, err := parseCookie(&dns.EDNS0_COOKIE{Cookie: cookie})
+		assert.ErrorIs(t, err, ErrMalformedCookie, cookie)
+	}
+}
+
+func TestServerCookies_Verify(t *testing.T) {
+	// Setup
+	now := time.Unix(1700000000, 0)
+	c := newServerCookies(CookieConfig{Secret: []byte("secret")})
+	c.now = func() time.Time { return now }
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	addr := netip.MustParseAddr("192.0.2.1")
+
+	// Execute
+	server := c.issue(client, addr)
+
+	// Assertions
+	require.Len(t, server, serverCookieLength)
+	assert.Equal(t, byte(serverCookieVersion), server[0])
+	assert.True(t, c.verify(client, server, addr))
+	assert.True(t, c.verify(client, server, netip.MustParseAddr("::ffff:192.0.2.1")))
+
+	// Bound to the client's address, client cookie, and our secret.
+	assert.False(t, c.verify(client, server, netip.MustParseAddr("192.0.2.2")))
+	assert.False(t, c.verify([]byte{8, 7, 6, 5, 4, 3, 2, 1}, server, addr))
+	other := newServerCookies(CookieConfig{Secret: []byte("other")})
+	other.now = c.now
+	assert.False(t, other.verify(client, server, addr))
+
+	// Cookies from too long ago, or the future, are rejected.
+	now = now.Add(serverCookieMaxAge + time.Second)
+	assert.False(t, c.verify(client, server, addr))
+	now = now.Add(-serverCookieMaxAge - serverCookieMaxClockSkew - 2*time.Second)
+	assert.False(t, c.verify(client, server, addr))
+
+	// Server cookies are on by default.
+	assert.Nil(t, newServerCookies(CookieConfig{Disabled: true}))
+	assert.NotNil(t, newServerCookies(CookieConfig{}))
+}
+
+func TestCookieJar_Record(t *testing.T) {
+	// Setup
+	j := newCookieJar()
+	addr := "192.0.2.53"
+	reply := func(cookie string, rcode int) *dns.Msg {
+		m := cookieTestQuery(cookie)
+		m.Response = true
+		m.Rcode = rcode
+		return m
+	}
+	client := hex.EncodeToString(j.clientCookie(addr))
+	server := strings.Repeat("ab", 16)
+
+	// Only our client cookie is sent at first.
+	assert.Equal(t, client, j.cookie(addr).Cookie)
+
+	// Execute & Assertions - the server cookie is remembered, and the option removed.
+	m := reply(client+server, dns.RcodeSuccess)
+	require.NoError(t, j.record(addr, m))
+	assert.Nil(t, cookieOption(m))
+	assert.Equal(t, client+server, j.cookie(addr).Cookie)
+
+	// Each nameserver gets a different client cookie.
+	assert.NotEqual(t, client, hex.EncodeToString(j.clientCookie("192.0.2.54")))
+
+	// A response echoing a different client cookie is rejected.
+	err := j.record(addr, reply("0102030405060708"+server, dns.RcodeSuccess))
+	assert.ErrorIs(t, err, ErrCookieMismatch)
+
+	// BADCOOKIE is an error, but the new server cookie is kept for the retry.
+	fresh := strings.Repeat("cd", 8)
+	err = j.record(addr, reply(client+fresh, dns.RcodeBadCookie))
+	assert.ErrorIs(t, err, ErrBadCookie)
+	assert.Equal(t, client+fresh, j.cookie(addr).Cookie)
+
+	// No cookie in the response is fine from a nameserver that's never returned one...
+	assert.NoError(t, j.record("192.0.2.54", reply("", dns.RcodeSuccess)))
+
+	// ...but not from one that has, until it's forgotten.
+	assert.ErrorIs(t, j.record(addr, reply("", dns.RcodeSuccess)), ErrCookieMissing)
+	j.forget(addr)
+	assert.NoError(t, j.record(addr, reply("", dns.RcodeSuccess)))
+	assert.Equal(t, client, j.cookie(addr).Cookie)
+}
+
+func TestWithCookie(t *testing.T) {
+	ours := &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}
+
+	// Without EDNS, no cookie is added.
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	assert.Same(t, plain, withCookie(plain, ours))
+
+	// A client's cookie is replaced, or removed, without modifying the original.
+	q := cookieTestQuery("1111111111111111")
+	replaced := withCookie(q, ours)
+	assert.Equal(t, ours, cookieOption(replaced))
+	assert.Len(t, replaced.IsEdns0().Option, 1)
+	assert.Nil(t, cookieOption(withCookie(q, nil)))
+	assert.Equal(t, "1111111111111111", cookieOption(q).Cookie)
+}
+
+// cookieTestClient acts as a nameserver supporting cookies, always returning server. If omit is set, the cookie is
+// left out of its responses.
+type cookieTestClient struct {
+	server string
+	rcode  int
+	omit   bool
+	sent   []*dns.Msg
+}
+
+func (c *cookieTestClient) ExchangeContext(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	c.sent = append(c.sent, m)
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Rcode = c.rcode
+	c.rcode = dns.RcodeSuccess
+	if opt := cookieOption(m); opt != nil && !c.omit {
+		reply.SetEdns0(dns.DefaultMsgSize, false)
+		reply.IsEdns0().Option = append(reply.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: opt.Cookie[:16] + c.server})
+	}
+	return reply, time.Millisecond, nil
+}
+
+func TestExchange_Cookies(t *testing.T) {
+	// Setup - the nameserver first responds with BADCOOKIE.
+	client := &cookieTestClient{server: strings.Repeat("ab", 16), rcode: dns.RcodeBadCookie}
+	ns := &nameserver{addr: "192.0.2.58", dnsClientFactory: func(protocol string) dnsClient { return client }}
+	state := newNameserverState()
+	ctx := withNameserverState(context.TODO(), state)
+	expected := hex.EncodeToString(state.cookies.clientCookie(ns.addr))
+
+	// Execute
+	response := ns.exchange(ctx, cookieTestQuery("1111111111111111"))
+
+	// Assertions - the query is retried with the server cookie, and it's not passed on.
+	require.NoError(t, response.Err)
+	require.Len(t, client.sent, 2)
+	assert.Equal(t, expected, cookieOption(client.sent[0]).Cookie)
+	assert.Equal(t, expected+client.server, cookieOption(client.sent[1]).Cookie)
+	assert.Nil(t, cookieOption(response.Msg))
+
+	// Queries without EDNS are sent as-is.
+	plain := new(dns.Msg)
+	plain.SetQuestion("example.com.", dns.TypeA)
+	ns.exchange(ctx, plain)
+	assert.Same(t, plain, client.sent[2])
+}
+
+func TestExchange_CookieMissing(t *testing.T) {
+	// Setup - a nameserver whose server cookie we've already learnt.
+	udpClient := &cookieTestClient{server: strings.Repeat("ab", 16)}
+	tcpClient := &cookieTestClient{server: udpClient.server}
+	ns := &nameserver{addr: "192.0.2.59", dnsClientFactory: func(protocol string) dnsClient {
+		if protocol == "udp" {
+			return udpClient
+		}
+		return tcpClient
+	}}
+	state := newNameserverState()
+	ctx := withNameserverState(context.TODO(), state)
+	require.NoError(t, ns.exchange(ctx, cookieTestQuery("1111111111111111")).Err)
+
+	// Execute - a response without a cookie over UDP may be spoofed.
+	udpClient.omit = true
+	response := ns.exchange(ctx, cookieTestQuery("1111111111111111"))
+
+	// Assertions - so it's dropped, and the query retried over TCP.
+	require.NoError(t, response.Err)
+	assert.Len(t, udpClient.sent, 2)
+	require.Len(t, tcpClient.sent, 1)
+	expected := hex.EncodeToString(state.cookies.clientCookie(ns.addr)) + udpClient.server
+	assert.Equal(t, expected, state.cookies.cookie(ns.addr).Cookie)
+
+	// Over TCP, a response without a cookie is genuine; the nameserver has stopped returning them.
+	tcpClient.omit = true
+	response = ns.exchange(ctx, cookieTestQuery("1111111111111111"))
+	require.NoError(t, response.Err)
+	assert.Len(t, tcpClient.sent, 2)
+	assert.Equal(t, hex.EncodeToString(state.cookies.clientCookie(ns.addr)), state.cookies.cookie(ns.addr).Cookie)
+}
+
+func TestServer_WriteMsg_Cookies(t *testing.T) {
+	// Setup
+	s := &Server{
+		rrl:     newRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: -1}),
+		cookies: newServerCookies(CookieConfig{}),
+	}
+	answer := func(q *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+		return m
+	}
+	w := newMockUDPResponseWriter()
+	clientCookie := "0102030405060708"
+
+	// Execute - the first query, with just a client cookie, is given a server cookie.
+	q := cookieTestQuery(clientCookie)
+	require.NoError(t, s.writeMsg(w, q, answer(q)))
+	require.Len(t, w.msgs, 1)
+	cookie := cookieOption(w.msg())
+	require.NotNil(t, cookie)
+	assert.True(t, strings.HasPrefix(cookie.Cookie, clientCookie))
+
+	// Assertions - returning it proves the client's address, so it's exempt from rate limiting.
+	q = cookieTestQuery(cookie.Cookie)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, s.writeMsg(w, q, answer(q)))
+	}
+	assert.Len(t, w.msgs, 6)
+
+	// Without the server cookie, it's limited again.
+	q = cookieTestQuery(clientCookie)
+	require.NoError(t, s.writeMsg(w, q, answer(q)))
+	assert.Len(t, w.msgs, 6)
+}
+
+func TestServer_HandleDNS_MalformedCookie(t *testing.T) {
+	// Setup
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	w := newMockUDPResponseWriter()
+
+	// Execute
+	s.handleDNS(w, cookieTestQuery("01020304"))
+
+	// Assertions
+	require.NotNil(t, w.msg())
+	assert.Equal(t, dns.RcodeFormatError, w.msg().Rcode)
+	assert.Nil(t, cookieOption(w.msg()))
+}
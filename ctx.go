@@ -9,4 +9,6 @@ const (
 	ctxIteration
 	ctxZoneName
 	ctxStartTime
+	ctxClientSubnet
+	ctxNameserverState
 )
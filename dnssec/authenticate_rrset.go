@@ -34,7 +34,7 @@ func authenticate(zone string, rrsets []dns.RR, dnskeys []*dns.DNSKEY, section s
 		}
 
 		if !rrsig.ValidityPeriod(time.Now()) {
-			sig.err = fmt.Errorf("%w: msg valid %s to %s", ErrInvalidTime, dns.TimeToString(rrsig.Inception), dns.TimeToString(rrsig.Expiration))
+			sig.err = fmt.Errorf("%w: %w: msg valid %s to %s", ErrInvalidTime, invalidTimeReason(rrsig), dns.TimeToString(rrsig.Inception), dns.TimeToString(rrsig.Expiration))
 			continue
 		}
 
@@ -134,3 +134,15 @@ func authenticate(zone string, rrsets []dns.RR, dnskeys []*dns.DNSKEY, section s
 
 	return signatures, err
 }
+
+// invalidTimeReason returns if the rrsig, which is outside its validity period, has expired or is not yet valid.
+func invalidTimeReason(rrsig *dns.RRSIG) error {
+	// Inception is compared using RFC1982 serial arithmetic, as in dns.ValidityPeriod.
+	utc := time.Now().UTC().Unix()
+	mode := (int64(rrsig.Inception) - utc) / year68
+	ti := int64(rrsig.Inception) + mode*year68
+	if ti > utc {
+		return ErrSignatureNotYetValid
+	}
+	return ErrSignatureExpired
+}
@@ -215,6 +215,10 @@ func TestAuthenticate_InvalidTimePeriod(t *testing.T) {
 		t.Errorf("expected error to be ErrInvalidTime. got: %s", err.Error())
 	}
 
+	if !errors.Is(err, ErrSignatureNotYetValid) {
+		t.Errorf("expected error to be ErrSignatureNotYetValid. got: %s", err.Error())
+	}
+
 	if set[0].wildcard == true {
 		t.Error("expected wildcard to be false")
 	}
@@ -248,6 +252,10 @@ func TestAuthenticate_InvalidTimePeriod(t *testing.T) {
 		t.Errorf("expected error to be ErrInvalidTime. got: %s", err.Error())
 	}
 
+	if !errors.Is(err, ErrSignatureExpired) {
+		t.Errorf("expected error to be ErrSignatureExpired. got: %s", err.Error())
+	}
+
 	if set[0].wildcard == true {
 		t.Error("expected wildcard to be false")
 	}
@@ -16,6 +16,8 @@ var (
 	ErrVerifyFailed                   = errors.New("signature verification failed")
 	ErrNoKeyFoundForSignature         = errors.New("no key found for signature")
 	ErrInvalidTime                    = errors.New("current time is outside of the msg validity period")
+	ErrSignatureExpired               = errors.New("signature has expired")
+	ErrSignatureNotYetValid           = errors.New("signature is not yet valid")
 	ErrInvalidSignature               = errors.New("msg signature is invalid")
 	ErrInvalidLabelCount              = errors.New("number of labels in the rrset owner name is less the value in the rrsig rr's labels field")
 	ErrMultipleVaryingSignerNames     = errors.New("rrsigs in the response contain multiple varying signer names")
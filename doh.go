@@ -0,0 +1,215 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DoHPath is the path the standalone DNS-over-HTTPS listener serves queries on.
+	DoHPath = "/dns-query"
+
+	dohContentType = "application/dns-message"
+)
+
+// DoHHandler returns an http.Handler that serves DNS-over-HTTPS (RFC 8484) queries, using both the GET (?dns=)
+// and POST forms. Queries are queued for the same workers, and answered through the same cache and resolver, as
+// those arriving over UDP and TCP.
+// The handler can be mounted on any path within an existing HTTP server.
+func (s *Server) DoHHandler() http.Handler {
+	return http.HandlerFunc(s.serveDoH)
+}
+
+func (s *Server) serveDoH(rw http.ResponseWriter, req *http.Request) {
+	var wire []byte
+	var err error
+
+	switch req.Method {
+	case http.MethodGet:
+		wire, err = decodeDoHQueryParam(req.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if mediaType(req.Header.Get("Content-Type")) != dohContentType {
+			http.Error(rw, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize+1))
+		if err == nil && len(wire) > dns.MaxMsgSize {
+			err = fmt.Errorf("message larger than %d bytes", dns.MaxMsgSize)
+		}
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(wire); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid dns message: %s", err), http.StatusBadRequest)
+		return
+	}
+	if r.Response || len(r.Question) != 1 {
+		http.Error(rw, "the dns message must be a query with a single question", http.StatusBadRequest)
+		return
+	}
+
+	// Queries are queued for the workers, as those arriving over UDP and TCP are.
+	w := newHTTPResponseWriter(req)
+	s.handleDNS(w, r)
+
+	if w.msg == nil {
+		// The query was shed as the server is overloaded, or shutting down.
+		http.Error(rw, "no response", http.StatusServiceUnavailable)
+		return
+	}
+
+	b, err := w.msg.Pack()
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", dohContentType)
+	if ttl, ok := responseMaxAge(w.msg); ok {
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	} else {
+		rw.Header().Set("Cache-Control", "no-store")
+	}
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(b)
+}
+
+// decodeDoHQueryParam decodes the base64url ?dns= parameter. RFC 8484 says padding is omitted, but we're lenient.
+func decodeDoHQueryParam(param string) ([]byte, error) {
+	if param == "" {
+		return nil, fmt.Errorf("missing dns query parameter")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+}
+
+// mediaType strips any parameters from a Content-Type header.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// responseMaxAge returns the HTTP freshness lifetime of a response, as described in RFC 8484 section 5.1.
+// That's the smallest TTL found in the Answer and Authority sections. For a negative response it's the lesser of
+// the SOA's TTL and its MINIMUM field (RFC 2308). Responses that can't be cached return false.
+func responseMaxAge(m *dns.Msg) (uint32, bool) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	found := false
+	ttl := MaxAllowedTTL
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			ttl = min(ttl, rr.Header().Ttl)
+			if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 {
+				ttl = min(ttl, soa.Minttl)
+			}
+			found = true
+		}
+	}
+
+	return ttl, found
+}
+
+// newDoHServer builds the standalone DNS-over-HTTPS listener, serving wire format queries on DoHPath and JSON
+// lookups on JSONPath. It serves TLS when the Server has a certificate configured, otherwise plain HTTP, which
+// is useful when running behind a TLS terminating proxy.
+func (s *Server) newDoHServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(DoHPath, s.DoHHandler())
+	mux.Handle(JSONPath, s.JSONHandler())
+	return &http.Server{
+		Addr:              s.config.DoHListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: DefaultTimeoutDoHRead,
+		ReadTimeout:       DefaultTimeoutDoHRead,
+	}
+}
+
+// runDoHServer serves server on listener, using TLS if a certificate is configured.
+func (s *Server) runDoHServer(server *http.Server, listener net.Listener) error {
+	if s.config.TLSCertFile != "" {
+		return server.ServeTLS(listener, s.config.TLSCertFile, s.config.TLSKeyFile)
+	}
+	return server.Serve(listener)
+}
+
+//---
+
+// httpResponseWriter captures the reply to a query so it can be written back in the HTTP response body.
+type httpResponseWriter struct {
+	req *http.Request
+	msg *dns.Msg
+
+	// response is the Response the reply was built from; either resolved, or found in the cache. It's nil if the
+	// query was refused or shed before it was answered.
+	response *Response
+}
+
+func newHTTPResponseWriter(req *http.Request) *httpResponseWriter {
+	return &httpResponseWriter{req: req}
+}
+
+// recordResponse gives the Response the reply to a query was built from to w, if it's an httpResponseWriter, so
+// the JSON API can report its DNSSEC state and resolution time.
+func recordResponse(w dns.ResponseWriter, resp *Response) {
+	if w, ok := w.(*httpResponseWriter); ok {
+		w.response = resp
+	}
+}
+
+func (w *httpResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *httpResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+// RemoteAddr returns the HTTP client's address. DoH runs over a stream, so it's always a TCP address.
+func (w *httpResponseWriter) RemoteAddr() net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", w.req.RemoteAddr); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func (w *httpResponseWriter) LocalAddr() net.Addr {
+	if addr, ok := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// ConnectionState returns the TLS state of the HTTP connection, or nil if it's plain HTTP.
+func (w *httpResponseWriter) ConnectionState() *tls.ConnectionState {
+	return w.req.TLS
+}
+
+func (w *httpResponseWriter) Close() error        { return nil }
+func (w *httpResponseWriter) TsigStatus() error   { return nil }
+func (w *httpResponseWriter) TsigTimersOnly(bool) {}
+func (w *httpResponseWriter) Hijack()             {}
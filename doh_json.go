@@ -0,0 +1,199 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// JSONPath is the path the standalone DNS-over-HTTPS listener serves JSON lookups on.
+	JSONPath = "/resolve"
+
+	jsonContentType = "application/json"
+)
+
+// JSONResponse is the body returned by the JSON lookup API. Its layout follows the Google and Cloudflare
+// DNS-over-HTTPS JSON APIs, extended with the resolver's DNSSEC validation outcome.
+type JSONResponse struct {
+	Status int  `json:"Status"`
+	TC     bool `json:"TC"`
+	RD     bool `json:"RD"`
+	RA     bool `json:"RA"`
+	AD     bool `json:"AD"`
+	CD     bool `json:"CD"`
+
+	Question   []JSONQuestion `json:"Question"`
+	Answer     []JSONRecord   `json:"Answer,omitempty"`
+	Authority  []JSONRecord   `json:"Authority,omitempty"`
+	Additional []JSONRecord   `json:"Additional,omitempty"`
+
+	// Auth and Doe are the dnssec.AuthenticationResult and dnssec.DenialOfExistenceState of the response. They're
+	// reported whether or not DO was set, including for answers from the cache.
+	Auth string `json:"Auth"`
+	Doe  string `json:"Doe"`
+
+	// DurationMs is the time, in milliseconds, taken to resolve the answer. It's zero for answers from the cache.
+	DurationMs float64 `json:"DurationMs"`
+
+	// Comment holds the resolution error, if there was one.
+	Comment string `json:"Comment,omitempty"`
+}
+
+type JSONQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type JSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// JSONHandler returns an http.Handler serving lookups of the form /resolve?name=&type=&do=&cd=, with the answer,
+// authority and additional sections returned as JSON. `type` may be a mnemonic or a number, and defaults to A.
+// `do` and `cd` accept 1/0 or true/false. Lookups are answered as wire format queries are; through the cache, and
+// queued for the workers.
+func (s *Server) JSONHandler() http.Handler {
+	return http.HandlerFunc(s.serveJSON)
+}
+
+func (s *Server) serveJSON(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+
+	name := query.Get("name")
+	if name == "" || len(name) > 253 {
+		http.Error(rw, "invalid name parameter", http.StatusBadRequest)
+		return
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(rw, "invalid name parameter", http.StatusBadRequest)
+		return
+	}
+
+	qtype, err := parseJSONType(query.Get("type"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	do, err := parseJSONFlag(query.Get("do"))
+	if err != nil {
+		http.Error(rw, "invalid do parameter", http.StatusBadRequest)
+		return
+	}
+
+	cd, err := parseJSONFlag(query.Get("cd"))
+	if err != nil {
+		http.Error(rw, "invalid cd parameter", http.StatusBadRequest)
+		return
+	}
+
+	// EDNS is always used, so the reply carries any Extended DNS Error explaining a failure.
+	qmsg := new(dns.Msg)
+	qmsg.SetQuestion(dns.Fqdn(name), qtype)
+	qmsg.CheckingDisabled = cd
+	qmsg.SetEdns0(MaxUDPResponseSize, do)
+
+	// Clients the ACLs don't permit are answered with a REFUSED Status, as they would be over DNS.
+	w := newHTTPResponseWriter(req)
+	s.handleDNS(w, qmsg)
+
+	if w.msg == nil {
+		// The lookup was shed as the server is overloaded, or shutting down.
+		http.Error(rw, "no response", http.StatusServiceUnavailable)
+		return
+	}
+
+	rw.Header().Set("Content-Type", jsonContentType)
+	if ttl, ok := responseMaxAge(w.msg); ok {
+		rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+
+	json.NewEncoder(rw).Encode(newJSONResponse(qmsg, w.msg, w.response))
+}
+
+// newJSONResponse returns the JSON body for the reply m to qmsg. response is the Response m was built from, or nil
+// if the lookup was refused or shed before it was answered.
+func newJSONResponse(qmsg, m *dns.Msg, response *Response) *JSONResponse {
+	result := &JSONResponse{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         true,
+		RA:         true,
+		AD:         m.AuthenticatedData,
+		CD:         qmsg.CheckingDisabled,
+		Question:   []JSONQuestion{{Name: qmsg.Question[0].Name, Type: qmsg.Question[0].Qtype}},
+		Answer:     newJSONRecords(m.Answer),
+		Authority:  newJSONRecords(m.Ns),
+		Additional: newJSONRecords(removeRecordsOfType(m.Extra, dns.TypeOPT)),
+		Auth:       dnssec.Unknown.String(),
+		Doe:        dnssec.NotFound.String(),
+	}
+
+	if response == nil {
+		if ede := extendedErrorOption(m); ede != nil {
+			result.Comment = ede.ExtraText
+		}
+		return result
+	}
+
+	result.Auth = response.Auth.String()
+	result.Doe = response.Doe.String()
+	result.DurationMs = float64(response.Duration.Microseconds()) / 1000
+
+	if response.HasError() {
+		result.Comment = response.Err.Error()
+	}
+
+	return result
+}
+
+func newJSONRecords(records []dns.RR) []JSONRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	result := make([]JSONRecord, 0, len(records))
+	for _, rr := range records {
+		h := rr.Header()
+		result = append(result, JSONRecord{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return result
+}
+
+func parseJSONType(t string) (uint16, error) {
+	if t == "" {
+		return dns.TypeA, nil
+	}
+	if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+		return uint16(n), nil
+	}
+	if qtype, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+		return qtype, nil
+	}
+	return 0, fmt.Errorf("invalid type parameter [%s]", t)
+}
+
+func parseJSONFlag(v string) (bool, error) {
+	if v == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(v)
+}
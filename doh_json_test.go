@@ -0,0 +1,267 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestResolver returns a Resolver that answers every question with response, without any network access.
+func newTestResolver(response func(qmsg *dns.Msg) *Response) *Resolver {
+	root := &mockZone{mockName: func() string { return "." }}
+
+	r := &Resolver{
+		zones: mockZoneStore{
+			mockZoneList: func(name string) []zone { return []zone{root} },
+			mockGet:      func(name string) zone { return nil },
+		},
+	}
+	r.funcs.resolveLabel = func(ctx context.Context, d *domain, z zone, qmsg *dns.Msg, auth *authenticator) (zone, *Response) {
+		return nil, response(qmsg)
+	}
+	return r
+}
+
+// newJSONTestServer returns a Server whose resolver answers every question with response, without any network access.
+func newJSONTestServer(response func(qmsg *dns.Msg) *Response) *Server {
+	s := NewServerWithConfig(&Config{})
+	s.resolver = newTestResolver(response)
+	return s
+}
+
+func TestJSON_Resolve(t *testing.T) {
+	// Setup
+	var seen *dns.Msg
+	s := newJSONTestServer(func(qmsg *dns.Msg) *Response {
+		seen = qmsg
+		m := new(dns.Msg)
+		m.SetReply(qmsg)
+		m.AuthenticatedData = true
+		m.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+		}
+		return &Response{Msg: m, Auth: dnssec.Secure, Doe: dnssec.NotFound, Duration: 1500 * time.Microsecond}
+	})
+	defer s.Shutdown(context.Background())
+
+	req := httptest.NewRequest(http.MethodGet, JSONPath+"?name=example.com&type=A&do=1&cd=false", nil)
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.JSONHandler().ServeHTTP(rec, req)
+
+	// Assertions
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, jsonContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=300", rec.Header().Get("Cache-Control"))
+
+	assert.True(t, isSetDO(seen))
+	assert.False(t, seen.CheckingDisabled)
+
+	var body JSONResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	assert.Equal(t, dns.RcodeSuccess, body.Status)
+	assert.True(t, body.AD)
+	assert.True(t, body.RA)
+	assert.Equal(t, []JSONQuestion{{Name: "example.com.", Type: dns.TypeA}}, body.Question)
+	assert.Equal(t, []JSONRecord{{Name: "example.com.", Type: dns.TypeA, TTL: 300, Data: "192.0.2.1"}}, body.Answer)
+	assert.Equal(t, "Secure", body.Auth)
+	assert.Equal(t, "NotFound", body.Doe)
+	assert.Greater(t, body.DurationMs, float64(0))
+	assert.Empty(t, body.Comment)
+}
+
+func TestJSON_ResolveError(t *testing.T) {
+	// Setup
+	s := newJSONTestServer(func(qmsg *dns.Msg) *Response {
+		return newResponseError(errors.New("mock failure"))
+	})
+	defer s.Shutdown(context.Background())
+
+	req := httptest.NewRequest(http.MethodGet, JSONPath+"?name=example.com&type=aaaa", nil)
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.JSONHandler().ServeHTTP(rec, req)
+
+	// Assertions
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Cache-Control"))
+
+	var body JSONResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+	assert.Equal(t, dns.RcodeServerFailure, body.Status)
+	assert.Equal(t, dns.TypeAAAA, body.Question[0].Type)
+	assert.Equal(t, "Unknown", body.Auth)
+	assert.Contains(t, body.Comment, "mock failure")
+}
+
+func TestJSON_Cached(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := newJSONTestServer(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(qmsg)
+		m.Rcode = dns.RcodeNameError
+		m.AuthenticatedData = true
+		m.Ns = []dns.RR{
+			&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Minttl: 60},
+			&dns.NSEC3{Hdr: dns.RR_Header{Name: "abc.example.com.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300}},
+		}
+		return &Response{Msg: m, Auth: dnssec.Secure, Doe: dnssec.Nsec3NxDomain}
+	})
+	defer s.Shutdown(context.Background())
+
+	// Execute
+	var bodies []JSONResponse
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		s.JSONHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JSONPath+"?name=missing.example.com&do=1", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body JSONResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		bodies = append(bodies, body)
+	}
+
+	// Assertions - the second lookup is answered from the cache, with the same DNSSEC state.
+	assert.Equal(t, int32(1), calls.Load())
+	for _, body := range bodies {
+		assert.Equal(t, dns.RcodeNameError, body.Status)
+		assert.Equal(t, "Secure", body.Auth)
+		assert.Equal(t, "Nsec3NxDomain", body.Doe)
+	}
+	assert.Equal(t, uint64(2), s.Stats().Processed)
+}
+
+func TestJSON_Overload(t *testing.T) {
+	// Setup - one worker, busy with the first lookup, and room for one more in the queue.
+	var calls atomic.Int32
+	release := make(chan struct{})
+	s := overloadTestServer(&Config{Workers: WorkerConfig{Count: 1, QueueSize: 1}}, &calls, release)
+	defer s.Shutdown(context.Background())
+
+	var wg sync.WaitGroup
+	for i, name := range []string{"one.example.com", "two.example.com"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.JSONHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, JSONPath+"?name="+name, nil))
+		}()
+		require.Eventually(t, func() bool {
+			return calls.Load() == 1 && s.Stats().Queued == i
+		}, time.Second, time.Millisecond)
+	}
+
+	// Execute
+	rec := httptest.NewRecorder()
+	s.JSONHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JSONPath+"?name=three.example.com", nil))
+
+	// Assertions - lookups are shed along with wire format queries.
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, uint64(1), s.Stats().Overloaded)
+
+	close(release)
+	wg.Wait()
+}
+
+func TestJSON_BadRequests(t *testing.T) {
+	s := newJSONTestServer(func(qmsg *dns.Msg) *Response {
+		t.Fatal("the resolver should not be called")
+		return nil
+	})
+	defer s.Shutdown(context.Background())
+
+	for _, target := range []string{
+		JSONPath,
+		JSONPath + "?name=",
+		JSONPath + "?name=example.com&type=NOTATYPE",
+		JSONPath + "?name=example.com&do=maybe",
+		JSONPath + "?name=example.com&cd=maybe",
+	} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		rec := httptest.NewRecorder()
+
+		s.JSONHandler().ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, JSONPath+"?name=example.com", nil)
+	rec := httptest.NewRecorder()
+	s.JSONHandler().ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestParseJSONType(t *testing.T) {
+	for input, expected := range map[string]uint16{
+		"":       dns.TypeA,
+		"A":      dns.TypeA,
+		"aaaa":   dns.TypeAAAA,
+		"MX":     dns.TypeMX,
+		"65":     dns.TypeHTTPS,
+		"dnskey": dns.TypeDNSKEY,
+	} {
+		qtype, err := parseJSONType(input)
+		assert.NoError(t, err, input)
+		assert.Equal(t, expected, qtype, input)
+	}
+
+	_, err := parseJSONType("70000")
+	assert.Error(t, err)
+}
+
+func TestJSON_DNSSECState(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := newJSONTestServer(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(qmsg)
+		m.Ns = []dns.RR{
+			&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Minttl: 60},
+			&dns.NSEC3{Hdr: dns.RR_Header{Name: "abc.example.com.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300}, Flags: 1},
+		}
+		return &Response{Msg: m, Auth: dnssec.Insecure, Doe: dnssec.Nsec3OptOut, Duration: 2 * time.Millisecond}
+	})
+	defer s.Shutdown(context.Background())
+
+	// Execute - the lookup is resolved once, then answered from the cache; including to a lookup without DO.
+	var bodies []JSONResponse
+	for _, do := range []string{"1", "1", "0"} {
+		rec := httptest.NewRecorder()
+		s.JSONHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, JSONPath+"?name=sub.example.com&type=DS&do="+do, nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body JSONResponse
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		bodies = append(bodies, body)
+	}
+
+	// Assertions - the resolver's DNSSEC state is returned as it was, whether or not DO was set.
+	assert.Equal(t, int32(1), calls.Load())
+	for _, body := range bodies {
+		assert.Equal(t, dns.RcodeSuccess, body.Status)
+		assert.False(t, body.AD)
+		assert.Equal(t, "Insecure", body.Auth)
+		assert.Equal(t, "Nsec3OptOut", body.Doe)
+	}
+	assert.Equal(t, float64(2), bodies[0].DurationMs)
+	assert.Zero(t, bodies[1].DurationMs)
+	assert.Len(t, bodies[2].Authority, 1, "NSEC3 records are only returned to lookups that set DO")
+}
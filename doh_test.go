@@ -0,0 +1,171 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDoHTestServer returns a Server with an answer for example.com. A already in its cache,
+// so no queries leave the process.
+func newDoHTestServer() (*Server, *dns.Msg) {
+	s := NewServer()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	answer := new(dns.Msg)
+	answer.SetReply(q)
+	answer.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}, A: net.IPv4(192, 0, 2, 2)},
+	}
+	s.cache.set(q.Question[0], answer)
+
+	q.Id = 0
+	return s, q
+}
+
+func TestDoH_Get(t *testing.T) {
+	// Setup
+	s, q := newDoHTestServer()
+	wire, err := q.Pack()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, DoHPath+"?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.DoHHandler().ServeHTTP(rec, req)
+
+	// Assertions
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, dohContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "max-age=120", rec.Header().Get("Cache-Control"))
+
+	response := new(dns.Msg)
+	require.NoError(t, response.Unpack(rec.Body.Bytes()))
+	assert.Equal(t, uint16(0), response.Id)
+	assert.Len(t, response.Answer, 2)
+}
+
+func TestDoH_Post(t *testing.T) {
+	// Setup
+	s, q := newDoHTestServer()
+	wire, err := q.Pack()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, DoHPath, bytes.NewReader(wire))
+	req.Header.Set("Content-Type", "application/dns-message")
+	rec := httptest.NewRecorder()
+
+	// Execute
+	s.DoHHandler().ServeHTTP(rec, req)
+
+	// Assertions
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	response := new(dns.Msg)
+	require.NoError(t, response.Unpack(rec.Body.Bytes()))
+	assert.Len(t, response.Answer, 2)
+}
+
+func TestDoH_QueuedForWorkers(t *testing.T) {
+	// Setup
+	s, q := newDoHTestServer()
+	wire, err := q.Pack()
+	require.NoError(t, err)
+	target := DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(wire)
+
+	// Execute & Assertions - queries are answered by the workers...
+	rec := httptest.NewRecorder()
+	s.DoHHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, uint64(1), s.Stats().Processed)
+
+	// ...so once they've stopped, queries go unanswered.
+	require.NoError(t, s.Shutdown(context.Background()))
+	rec = httptest.NewRecorder()
+	s.DoHHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestDoH_BadRequests(t *testing.T) {
+	s, q := newDoHTestServer()
+	wire, err := q.Pack()
+	require.NoError(t, err)
+
+	noQuestion, err := new(dns.Msg).Pack()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        []byte
+		expected    int
+	}{
+		{"missing dns param", http.MethodGet, DoHPath, "", nil, http.StatusBadRequest},
+		{"invalid base64", http.MethodGet, DoHPath + "?dns=!!!", "", nil, http.StatusBadRequest},
+		{"not a dns message", http.MethodGet, DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString([]byte{1, 2, 3}), "", nil, http.StatusBadRequest},
+		{"no question", http.MethodGet, DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(noQuestion), "", nil, http.StatusBadRequest},
+		{"wrong content type", http.MethodPost, DoHPath, "text/plain", wire, http.StatusUnsupportedMediaType},
+		{"unsupported method", http.MethodPut, DoHPath, dohContentType, wire, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != nil {
+				body = bytes.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.target, body)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+
+			s.DoHHandler().ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expected, rec.Code)
+		})
+	}
+}
+
+func TestResponseMaxAge(t *testing.T) {
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Minttl: 60}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}
+
+	// Positive answer
+	m := &dns.Msg{Answer: []dns.RR{a}}
+	ttl, ok := responseMaxAge(m)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+
+	// Negative answer uses the SOA minimum.
+	m = &dns.Msg{Ns: []dns.RR{soa}}
+	m.Rcode = dns.RcodeNameError
+	ttl, ok = responseMaxAge(m)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+
+	// Failures are not cached.
+	m = &dns.Msg{Answer: []dns.RR{a}}
+	m.Rcode = dns.RcodeServerFailure
+	_, ok = responseMaxAge(m)
+	assert.False(t, ok)
+
+	// Nor are empty responses.
+	_, ok = responseMaxAge(&dns.Msg{})
+	assert.False(t, ok)
+}
@@ -0,0 +1,310 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DNS-over-QUIC error codes. See https://datatracker.ietf.org/doc/html/rfc9250#section-8.4
+const (
+	doqNoError          = 0x0
+	doqInternalError    = 0x1
+	doqProtocolError    = 0x2
+	doqRequestCancelled = 0x3
+)
+
+// doqServer is the DNS-over-QUIC (RFC 9250) listener. Each QUIC stream carries a single query, which is passed
+// into the same worker pipeline as queries arriving over UDP and TCP.
+type doqServer struct {
+	server      *Server
+	addr        string
+	tlsConfig   *tls.Config
+	idleTimeout time.Duration
+
+	lock     sync.Mutex
+	listener *quic.Listener
+	conns    map[quic.Connection]struct{}
+	closed   bool
+
+	// inflight tracks streams whose query has yet to be answered.
+	inflight sync.WaitGroup
+}
+
+// newDoQServer builds the DoQ listener, using the same certificate and key as the DoT listener.
+func (s *Server) newDoQServer() (*doqServer, error) {
+	tlsConfig, err := s.loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+
+	addr := s.config.DoQListenAddr
+	if addr == "" {
+		addr = DefaultDoQListenAddr
+	}
+
+	idleTimeout := s.config.TLSIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultTLSIdleTimeout
+	}
+
+	return &doqServer{
+		server:      s,
+		addr:        addr,
+		tlsConfig:   tlsConfig,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+// Listen binds the listener's UDP socket.
+func (d *doqServer) Listen() error {
+	listener, err := quic.ListenAddr(d.addr, d.tlsConfig, &quic.Config{
+		MaxIdleTimeout:     d.idleTimeout,
+		MaxIncomingStreams: DefaultDoQMaxStreamsPerConnection,
+	})
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		listener.Close()
+		return quic.ErrServerClosed
+	}
+
+	d.listener = listener
+	d.conns = make(map[quic.Connection]struct{})
+	return nil
+}
+
+// Serve accepts connections until the listener is shutdown.
+func (d *doqServer) Serve() error {
+	d.lock.Lock()
+	listener := d.listener
+	d.lock.Unlock()
+
+	if listener == nil {
+		return quic.ErrServerClosed
+	}
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+
+		d.lock.Lock()
+		if d.closed {
+			d.lock.Unlock()
+			conn.CloseWithError(doqNoError, "")
+			continue
+		}
+		d.conns[conn] = struct{}{}
+		d.lock.Unlock()
+
+		go d.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting new connections and streams, waits for queries already received to be answered,
+// then closes every connection.
+func (d *doqServer) Shutdown(ctx context.Context) error {
+	d.lock.Lock()
+	d.closed = true
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	d.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	d.lock.Lock()
+	for conn := range d.conns {
+		conn.CloseWithError(doqNoError, "")
+	}
+	clear(d.conns)
+	d.lock.Unlock()
+
+	return err
+}
+
+// Addr returns the address the listener is bound to, or nil if it's not yet listening.
+func (d *doqServer) Addr() net.Addr {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.listener == nil {
+		return nil
+	}
+	return d.listener.Addr()
+}
+
+func (d *doqServer) serveConn(conn quic.Connection) {
+	defer func() {
+		d.lock.Lock()
+		delete(d.conns, conn)
+		d.lock.Unlock()
+	}()
+
+	state := conn.ConnectionState().TLS
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			// The connection has been closed, or has timed out.
+			return
+		}
+
+		d.lock.Lock()
+		if d.closed {
+			d.lock.Unlock()
+			stream.CancelRead(doqNoError)
+			stream.CancelWrite(doqNoError)
+			return
+		}
+		d.inflight.Add(1)
+		d.lock.Unlock()
+
+		go d.serveStream(conn, stream, &state)
+	}
+}
+
+func (d *doqServer) serveStream(conn quic.Connection, stream quic.Stream, state *tls.ConnectionState) {
+	defer d.inflight.Done()
+
+	stream.SetReadDeadline(time.Now().Add(d.idleTimeout))
+
+	r, err := readDoQMessage(stream)
+	if err != nil {
+		Debug(fmt.Sprintf("unable to read DoQ query from %s: %s", conn.RemoteAddr(), err))
+		stream.CancelRead(doqProtocolError)
+		stream.CancelWrite(doqProtocolError)
+		return
+	}
+
+	// The stream identifies the query, so the Message ID must always be zero.
+	// https://datatracker.ietf.org/doc/html/rfc9250#section-4.2.1
+	if r.Id != 0 {
+		conn.CloseWithError(doqProtocolError, "non-zero message id")
+		return
+	}
+
+	w := &doqResponseWriter{
+		stream:     stream,
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+		tlsState:   state,
+	}
+
+	d.server.handleDNS(w, r)
+
+	// Queries can go unanswered; dropped by the ACLs, rate limiting or overload, or as the server shuts down. Their
+	// stream is cancelled, rather than left open until the connection times out, counting against the peer's limit.
+	if !w.written {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+	}
+}
+
+// readDoQMessage reads a single, two byte length prefixed, DNS message from a stream.
+func readDoQMessage(stream io.Reader) (*dns.Msg, error) {
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//---
+
+// doqResponseWriter writes the reply to a query back on the query's own stream, then closes the stream.
+type doqResponseWriter struct {
+	stream     quic.Stream
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tlsState   *tls.ConnectionState
+
+	// written is set once a reply has been written, or attempted.
+	written bool
+}
+
+// WriteMsg zeros the Message ID, and pads the response if the query used EDNS; RFC 9250 section 5.4 requires
+// protection against traffic analysis regardless of whether the client asked for padding. Replies to queries without
+// EDNS have no OPT record, and so can't be padded.
+func (w *doqResponseWriter) WriteMsg(m *dns.Msg) error {
+	m.Id = 0
+	if m.IsEdns0() != nil {
+		padResponse(m, ResponsePaddingBlockSize)
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		w.written = true
+		w.stream.CancelWrite(doqInternalError)
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *doqResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	if len(b) > dns.MaxMsgSize {
+		w.stream.CancelWrite(doqInternalError)
+		return 0, fmt.Errorf("message of %d bytes is too large", len(b))
+	}
+
+	msg := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(msg, uint16(len(b)))
+	copy(msg[2:], b)
+
+	n, err := w.stream.Write(msg)
+	if err != nil {
+		return n, err
+	}
+
+	// Signals, via STREAM FIN, that no further data will be sent.
+	return len(b), w.stream.Close()
+}
+
+func (w *doqResponseWriter) Close() error {
+	w.stream.CancelRead(doqNoError)
+	return w.stream.Close()
+}
+
+func (w *doqResponseWriter) LocalAddr() net.Addr                   { return w.localAddr }
+func (w *doqResponseWriter) RemoteAddr() net.Addr                  { return w.remoteAddr }
+func (w *doqResponseWriter) ConnectionState() *tls.ConnectionState { return w.tlsState }
+func (w *doqResponseWriter) TsigStatus() error                     { return nil }
+func (w *doqResponseWriter) TsigTimersOnly(bool)                   {}
+func (w *doqResponseWriter) Hijack()                               {}
@@ -0,0 +1,165 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestDoQServer starts a DoQ listener, on an ephemeral port, in front of a Server that already has an answer
+// for example.com. A cached.
+func startTestDoQServer(t *testing.T) (*doqServer, *dns.Msg) {
+	s, q := newDoHTestServer()
+
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir())
+	s.config = Config{TLSCertFile: certFile, TLSKeyFile: keyFile, DoQListenAddr: "127.0.0.1:0"}
+
+	d, err := s.newDoQServer()
+	require.NoError(t, err)
+
+	require.NoError(t, d.Listen())
+	go d.Serve()
+	t.Cleanup(func() { d.listener.Close() })
+
+	return d, q
+}
+
+func dialTestDoQServer(t *testing.T, d *doqServer) quic.Connection {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := quic.DialAddr(ctx, d.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"doq"}}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.CloseWithError(doqNoError, "") })
+	return conn
+}
+
+func sendDoQQuery(t *testing.T, conn quic.Connection, q *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	stream, err := conn.OpenStreamSync(ctx)
+	require.NoError(t, err)
+
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	require.NoError(t, binary.Write(stream, binary.BigEndian, uint16(len(b))))
+	_, err = stream.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+
+	stream.SetReadDeadline(time.Now().Add(time.Second))
+	return readDoQMessage(stream)
+}
+
+func TestDoQ_QueryPerStream(t *testing.T) {
+	// Setup
+	d, q := startTestDoQServer(t)
+	conn := dialTestDoQServer(t, d)
+
+	q.SetEdns0(4096, false)
+
+	// Execute & Assertions - several queries, each on its own stream, over a single connection.
+	for i := 0; i < 3; i++ {
+		response, err := sendDoQQuery(t, conn, q)
+		require.NoError(t, err)
+
+		assert.Equal(t, uint16(0), response.Id)
+		assert.Len(t, response.Answer, 2)
+
+		// Responses are padded even though the query wasn't.
+		assert.True(t, paddingRequested(response))
+		b, err := response.Pack()
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(b)%ResponsePaddingBlockSize)
+	}
+}
+
+func TestDoQ_QueryWithoutEDNS(t *testing.T) {
+	// Setup
+	d, q := startTestDoQServer(t)
+	conn := dialTestDoQServer(t, d)
+
+	// Execute
+	response, err := sendDoQQuery(t, conn, q)
+
+	// Assertions - the reply has no OPT record, as the query didn't, so it isn't padded.
+	require.NoError(t, err)
+	assert.Len(t, response.Answer, 2)
+	assert.Nil(t, response.IsEdns0())
+}
+
+func TestDoQ_NonZeroMessageIDIsAProtocolError(t *testing.T) {
+	// Setup
+	d, q := startTestDoQServer(t)
+	conn := dialTestDoQServer(t, d)
+
+	q.Id = 1234
+
+	// Execute
+	_, err := sendDoQQuery(t, conn, q)
+
+	// Assertions
+	var appErr *quic.ApplicationError
+	require.True(t, errors.As(err, &appErr), "unexpected error: %v", err)
+	assert.Equal(t, quic.ApplicationErrorCode(doqProtocolError), appErr.ErrorCode)
+}
+
+func TestServer_NewDoQServer_RequiresKeyPair(t *testing.T) {
+	s := &Server{config: Config{DoQListenAddr: ":853"}}
+
+	d, err := s.newDoQServer()
+
+	assert.Nil(t, d)
+	assert.ErrorIs(t, err, ErrLoadingTLSKeyPair)
+}
+
+func TestReadDoQMessage(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeAAAA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b)
+
+	m, err := readDoQMessage(buf)
+	require.NoError(t, err)
+	assert.Equal(t, q.Question, m.Question)
+
+	// A truncated stream is an error.
+	buf.Reset()
+	binary.Write(buf, binary.BigEndian, uint16(len(b)))
+	buf.Write(b[:len(b)-1])
+	_, err = readDoQMessage(buf)
+	assert.Error(t, err)
+}
+
+func TestDoQ_UnansweredQueryCancelsStream(t *testing.T) {
+	// Setup - a server that's shutting down, so drops every query without a reply.
+	d, q := startTestDoQServer(t)
+	conn := dialTestDoQServer(t, d)
+
+	d.server.queriesLock.Lock()
+	d.server.queriesClosed = true
+	d.server.queriesLock.Unlock()
+
+	// Execute
+	_, err := sendDoQQuery(t, conn, q)
+
+	// Assertions - the stream is cancelled straight away, rather than left open until it times out.
+	var streamErr *quic.StreamError
+	require.True(t, errors.As(err, &streamErr), "unexpected error: %v", err)
+	assert.Equal(t, quic.StreamErrorCode(doqRequestCancelled), streamErr.ErrorCode)
+}
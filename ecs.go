@@ -0,0 +1,239 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// clientSubnet carries the EDNS Client Subnet (RFC 7871) details of a client's query through its resolution.
+// It's passed via the context, so it reaches every zone the query is sent to.
+type clientSubnet struct {
+	// source is the client's address, truncated to the prefix length we're willing to share.
+	source netip.Prefix
+	// zones are those whose nameservers are sent the option. Each includes its subdomains.
+	zones []string
+	// scope is the longest scope prefix length returned by any nameserver we've sent the option to.
+	scope atomic.Int32
+}
+
+// newClientSubnet returns the ECS details to send on behalf of the client at addr, or nil if none should be sent.
+// If the client's query r includes its own ECS option, that's used in place of addr; a source prefix length of 0
+// in it means the client has opted out.
+func newClientSubnet(config ClientSubnetConfig, addr net.Addr, r *dns.Msg) *clientSubnet {
+	if len(config.Zones) == 0 {
+		return nil
+	}
+
+	client := clientAddr(addr)
+	maxLength := -1
+	if opt := clientSubnetOption(r); opt != nil {
+		if opt.SourceNetmask == 0 {
+			return nil
+		}
+		client, _ = netip.AddrFromSlice(opt.Address)
+		client = client.Unmap()
+		maxLength = int(opt.SourceNetmask)
+	} else if !client.IsGlobalUnicast() || client.IsPrivate() {
+		// Private addresses are meaningless to the nameservers, so they're not sent.
+		return nil
+	}
+
+	if !client.IsValid() {
+		return nil
+	}
+
+	length := config.IPv6PrefixLength
+	if length <= 0 || length > 128 {
+		length = DefaultECSIPv6PrefixLength
+	}
+	if client.Is4() {
+		length = config.IPv4PrefixLength
+		if length <= 0 || length > 32 {
+			length = DefaultECSIPv4PrefixLength
+		}
+	}
+	if maxLength >= 0 {
+		length = min(length, maxLength)
+	}
+
+	source, err := client.Prefix(length)
+	if err != nil {
+		return nil
+	}
+
+	zones := make([]string, len(config.Zones))
+	for i, z := range config.Zones {
+		zones[i] = canonicalName(dns.Fqdn(z))
+	}
+
+	return &clientSubnet{source: source, zones: zones}
+}
+
+func clientSubnetFromContext(ctx context.Context) *clientSubnet {
+	ecs, _ := ctx.Value(ctxClientSubnet).(*clientSubnet)
+	return ecs
+}
+
+// client returns the truncated address of the client, which cached answers are looked up by.
+// If c is nil, the zero Addr is returned, matching only answers cached for all clients.
+func (c *clientSubnet) client() netip.Addr {
+	if c == nil {
+		return netip.Addr{}
+	}
+	return c.source.Addr()
+}
+
+// withContext returns ctx carrying c.
+func (c *clientSubnet) withContext(ctx context.Context) context.Context {
+	if c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxClientSubnet, c)
+}
+
+// fork returns a copy of c, with its own scope, for a sub-query whose answer is cached separately.
+func (c *clientSubnet) fork() *clientSubnet {
+	return &clientSubnet{source: c.source, zones: c.zones}
+}
+
+// sentTo returns true if nameservers for zone should be sent the option.
+func (c *clientSubnet) sentTo(zone string) bool {
+	for _, z := range c.zones {
+		if dns.IsSubDomain(z, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// merge records a scope prefix length returned by a nameserver. We keep the longest seen, as the answer is only
+// valid for clients within all of them.
+func (c *clientSubnet) merge(scope int) {
+	for {
+		current := c.scope.Load()
+		if int32(scope) <= current || c.scope.CompareAndSwap(current, int32(scope)) {
+			return
+		}
+	}
+}
+
+// scopeLength returns the longest scope prefix length returned so far; 0 if c is nil.
+func (c *clientSubnet) scopeLength() int {
+	if c == nil {
+		return 0
+	}
+	return int(c.scope.Load())
+}
+
+// scopePrefix returns the network of clients the resolved answer is valid for. If no nameserver returned a
+// scope, the answer is valid for all clients, and the zero Prefix is returned.
+func (c *clientSubnet) scopePrefix() netip.Prefix {
+	scope := c.scopeLength()
+	if scope == 0 {
+		return netip.Prefix{}
+	}
+	prefix, _ := c.source.Addr().Prefix(scope)
+	return prefix
+}
+
+func (c *clientSubnet) option() *dns.EDNS0_SUBNET {
+	family := uint16(2)
+	if c.source.Addr().Is4() {
+		family = 1
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(c.source.Bits()),
+		Address:       net.IP(c.source.Addr().AsSlice()),
+	}
+}
+
+// record takes the scope from a nameserver's response to a query we sent the option on, then removes the option
+// so it's not passed on. A response whose option doesn't match the one we sent must be discarded (RFC 7871 7.3).
+func (c *clientSubnet) record(m *dns.Msg) (int, error) {
+	opt := clientSubnetOption(m)
+	if opt == nil {
+		return 0, nil
+	}
+	removeClientSubnetOption(m)
+
+	address, _ := netip.AddrFromSlice(opt.Address)
+	sent := c.option()
+	if opt.Family != sent.Family || opt.SourceNetmask != sent.SourceNetmask || netip.PrefixFrom(address.Unmap(), c.source.Bits()).Masked() != c.source {
+		return 0, fmt.Errorf("%w: sent %s, got %s/%d", ErrClientSubnetMismatch, c.source, address, opt.SourceNetmask)
+	}
+
+	// A scope longer than the source can't be acted on; we only know the client to the source length.
+	scope := min(int(opt.SourceScope), c.source.Bits())
+	c.merge(scope)
+	return scope, nil
+}
+
+//---
+
+// replyClientSubnet returns reply m with r's ECS option echoed back, carrying the scope the answer is valid for.
+// A client that sends the option must receive it in the reply (RFC 7871 7.2.2). m is returned as-is if r had none.
+func replyClientSubnet(m *dns.Msg, r *dns.Msg, scope int) *dns.Msg {
+	opt := clientSubnetOption(r)
+	if opt == nil {
+		return m
+	}
+	echo := *opt
+	echo.SourceScope = uint8(min(scope, int(opt.SourceNetmask)))
+	return withClientSubnet(m, &echo)
+}
+
+// clientSubnetOption returns the ECS option in m, if there is one.
+func clientSubnetOption(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func removeClientSubnetOption(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// withClientSubnet returns m with subnet as its only ECS option; or with no ECS option when subnet is nil.
+// m itself is never modified, as it may be shared between exchanges.
+func withClientSubnet(m *dns.Msg, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	if subnet == nil && clientSubnetOption(m) == nil {
+		return m
+	}
+
+	m = m.Copy()
+	removeClientSubnetOption(m)
+	if subnet == nil {
+		return m
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+	return m
+}
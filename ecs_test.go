@@ -0,0 +1,283 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ecsTestQuery(option *dns.EDNS0_SUBNET) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("www.example.com.", dns.TypeA)
+	if option != nil {
+		q.SetEdns0(dns.DefaultMsgSize, false)
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, option)
+	}
+	return q
+}
+
+func TestNewClientSubnet(t *testing.T) {
+	config := ClientSubnetConfig{Zones: []string{"example.com"}}
+	udp := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 53000}
+	}
+
+	// Disabled without any zones.
+	assert.Nil(t, newClientSubnet(ClientSubnetConfig{}, udp("192.0.2.1"), ecsTestQuery(nil)))
+
+	// Addresses are truncated to the configured, or default, prefix lengths.
+	ecs := newClientSubnet(config, udp("192.0.2.77"), ecsTestQuery(nil))
+	require.NotNil(t, ecs)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.0/24"), ecs.source)
+	assert.Equal(t, []string{"example.com."}, ecs.zones)
+
+	ecs = newClientSubnet(config, udp("2001:db8:1:2ff::1"), ecsTestQuery(nil))
+	require.NotNil(t, ecs)
+	assert.Equal(t, netip.MustParsePrefix("2001:db8:1:200::/56"), ecs.source)
+
+	ecs = newClientSubnet(ClientSubnetConfig{Zones: []string{"."}, IPv4PrefixLength: 16}, udp("192.0.2.77"), ecsTestQuery(nil))
+	require.NotNil(t, ecs)
+	assert.Equal(t, netip.MustParsePrefix("192.0.0.0/16"), ecs.source)
+
+	// Private and loopback addresses aren't sent.
+	assert.Nil(t, newClientSubnet(config, udp("10.1.2.3"), ecsTestQuery(nil)))
+	assert.Nil(t, newClientSubnet(config, udp("127.0.0.1"), ecsTestQuery(nil)))
+
+	// The client's own option is used in place of its address, never lengthened...
+	q := ecsTestQuery(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 20, Address: net.ParseIP("198.51.100.0").To4()})
+	ecs = newClientSubnet(config, udp("10.1.2.3"), q)
+	require.NotNil(t, ecs)
+	assert.Equal(t, netip.MustParsePrefix("198.51.96.0/20"), ecs.source)
+
+	// ...and a source prefix length of 0 opts out.
+	q = ecsTestQuery(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, Address: net.IPv4zero.To4()})
+	assert.Nil(t, newClientSubnet(config, udp("192.0.2.1"), q))
+}
+
+func TestClientSubnet_SentTo(t *testing.T) {
+	ecs := &clientSubnet{zones: []string{"example.com.", "cdn.example.net."}}
+
+	assert.True(t, ecs.sentTo("example.com."))
+	assert.True(t, ecs.sentTo("edge.example.com."))
+	assert.True(t, ecs.sentTo("cdn.example.net."))
+	assert.False(t, ecs.sentTo("example.net."))
+	assert.False(t, ecs.sentTo("com."))
+	assert.False(t, ecs.sentTo("."))
+}
+
+func TestClientSubnet_Record(t *testing.T) {
+	// Setup
+	ecs := &clientSubnet{source: netip.MustParsePrefix("192.0.2.0/24")}
+	reply := func(option *dns.EDNS0_SUBNET) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, option)
+		return m
+	}
+
+	// Execute & Assertions - the scope is kept, and the option removed.
+	option := ecs.option()
+	option.SourceScope = 20
+	m := reply(option)
+	scope, err := ecs.record(m)
+	require.NoError(t, err)
+	assert.Equal(t, 20, scope)
+	assert.Nil(t, clientSubnetOption(m))
+
+	// Scopes longer than the source are clamped, and the longest seen is kept.
+	option = ecs.option()
+	option.SourceScope = 28
+	scope, err = ecs.record(reply(option))
+	require.NoError(t, err)
+	assert.Equal(t, 24, scope)
+	assert.Equal(t, netip.MustParsePrefix("192.0.2.0/24"), ecs.scopePrefix())
+
+	// No option means the answer isn't scoped.
+	scope, err = ecs.record(new(dns.Msg))
+	require.NoError(t, err)
+	assert.Equal(t, 0, scope)
+
+	// An option that doesn't match what was sent is rejected.
+	option = ecs.option()
+	option.Address = net.ParseIP("198.51.100.0").To4()
+	_, err = ecs.record(reply(option))
+	assert.ErrorIs(t, err, ErrClientSubnetMismatch)
+}
+
+func TestWithClientSubnet(t *testing.T) {
+	// Setup
+	clientOption := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("198.51.100.1").To4()}
+	q := ecsTestQuery(clientOption)
+	ours := (&clientSubnet{source: netip.MustParsePrefix("192.0.2.0/24")}).option()
+
+	// Execute
+	replaced := withClientSubnet(q, ours)
+	removed := withClientSubnet(q, nil)
+
+	// Assertions
+	assert.Same(t, clientOption, clientSubnetOption(q), "the original is never modified")
+	assert.Equal(t, ours, clientSubnetOption(replaced))
+	assert.Len(t, replaced.IsEdns0().Option, 1)
+	assert.Nil(t, clientSubnetOption(removed))
+	assert.NotNil(t, removed.IsEdns0())
+
+	// Without an OPT record, one is added.
+	plain := ecsTestQuery(nil)
+	assert.Same(t, plain, withClientSubnet(plain, nil))
+	assert.Equal(t, ours, clientSubnetOption(withClientSubnet(plain, ours)))
+}
+
+func TestReplyClientSubnet(t *testing.T) {
+	m := new(dns.Msg)
+	assert.Same(t, m, replyClientSubnet(m, ecsTestQuery(nil), 24))
+
+	q := ecsTestQuery(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.0.2.0").To4()})
+	echoed := clientSubnetOption(replyClientSubnet(m, q, 28))
+	require.NotNil(t, echoed)
+	assert.Equal(t, uint8(24), echoed.SourceNetmask)
+	assert.Equal(t, uint8(24), echoed.SourceScope)
+}
+
+func TestDNSCache_Scoped(t *testing.T) {
+	// Setup
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	answer := func(ip string) *dns.Msg {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}}
+		return m
+	}
+
+	s.cache.setScoped(q, answer("192.0.2.10"), netip.MustParsePrefix("192.0.2.0/24"))
+	s.cache.setScoped(q, answer("192.0.2.20"), netip.MustParsePrefix("192.0.0.0/16"))
+	s.cache.set(q, answer("192.0.2.30"))
+
+	// Execute & Assertions - the most specific variant covering the client wins.
+	for client, expected := range map[string]struct {
+		ip    string
+		scope int
+	}{
+		"192.0.2.77":   {"192.0.2.10", 24},
+		"192.0.9.1":    {"192.0.2.20", 16},
+		"198.51.100.1": {"192.0.2.30", 0},
+		"2001:db8::1":  {"192.0.2.30", 0},
+	} {
+		msg, scope := s.cache.getScoped(q, 1, netip.MustParseAddr(client))
+		require.NotNil(t, msg, client)
+		assert.Equal(t, expected.ip, msg.Answer[0].(*dns.A).A.String(), client)
+		assert.Equal(t, expected.scope, scope, client)
+	}
+
+	// Without a client, only the answer for everyone is returned.
+	msg := s.cache.get(q, 1)
+	require.NotNil(t, msg)
+	assert.Equal(t, "192.0.2.30", msg.Answer[0].(*dns.A).A.String())
+
+	s.cache.Clear()
+	msg, _ = s.cache.getScoped(q, 1, netip.MustParseAddr("192.0.2.77"))
+	assert.Nil(t, msg)
+}
+
+// ecsTestPool answers every query with the scope set, echoing back any ECS option it was sent.
+type ecsTestPool struct {
+	scope uint8
+
+	lock    sync.Mutex
+	queries []*dns.Msg
+}
+
+func (p *ecsTestPool) expired() bool {
+	return false
+}
+
+func (p *ecsTestPool) exchange(ctx context.Context, m *dns.Msg) *Response {
+	p.lock.Lock()
+	p.queries = append(p.queries, m)
+	p.lock.Unlock()
+
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+	if option := clientSubnetOption(m); option != nil {
+		echo := *option
+		echo.SourceScope = p.scope
+		reply = withClientSubnet(reply, &echo)
+	}
+	return &Response{Msg: reply}
+}
+
+func (p *ecsTestPool) sent() []*dns.EDNS0_SUBNET {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	options := make([]*dns.EDNS0_SUBNET, len(p.queries))
+	for i, q := range p.queries {
+		options[i] = clientSubnetOption(q)
+	}
+	return options
+}
+
+func TestZone_Exchange_ClientSubnet(t *testing.T) {
+	// Setup
+	pool := &ecsTestPool{scope: 24}
+	allowed := &zoneImpl{zoneName: "example.com.", pool: pool}
+	other := &zoneImpl{zoneName: "example.net.", pool: pool}
+
+	ecs := &clientSubnet{source: netip.MustParsePrefix("192.0.2.0/24"), zones: []string{"example.com."}}
+	ctx := ecs.withContext(context.Background())
+
+	// The client's own option is never passed on.
+	q := ecsTestQuery(&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("198.51.100.1").To4()})
+
+	// Execute
+	response := allowed.exchange(ctx, q)
+	require.NoError(t, response.Err)
+	other.exchange(ctx, q)
+
+	// Assertions
+	sent := pool.sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, ecs.option(), sent[0])
+	assert.Nil(t, sent[1])
+	assert.Nil(t, clientSubnetOption(response.Msg), "the nameserver's option isn't passed on")
+	assert.Equal(t, 24, ecs.scopeLength())
+}
+
+func TestServer_ProcessQuery_ClientSubnet(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{ClientSubnet: ClientSubnetConfig{Zones: []string{"example.com."}}})
+	defer s.Shutdown(context.Background())
+
+	pool := &ecsTestPool{scope: 24}
+	z := &zoneImpl{zoneName: "example.com.", pool: pool}
+	s.resolver = newTestResolver(nil)
+	s.resolver.funcs.resolveLabel = func(ctx context.Context, d *domain, _ zone, qmsg *dns.Msg, auth *authenticator) (zone, *Response) {
+		return nil, z.exchange(ctx, qmsg)
+	}
+
+	query := func(client string) *dns.Msg {
+		w := &mockResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP(client), Port: 53000}}
+		s.processQuery(w, ecsTestQuery(nil))
+		require.NotNil(t, w.msg())
+		return w.msg()
+	}
+
+	// Execute
+	query("192.0.2.1")
+	query("192.0.2.200")
+	query("198.51.100.1")
+
+	// Assertions - the second client is within the first's scope, so is answered from the cache.
+	sent := pool.sent()
+	require.Len(t, sent, 2)
+	assert.Equal(t, net.ParseIP("192.0.2.0").To4(), sent[0].Address.To4())
+	assert.Equal(t, net.ParseIP("198.51.100.0").To4(), sent[1].Address.To4())
+}
@@ -0,0 +1,105 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"net"
+)
+
+// Extended DNS Errors. See https://datatracker.ietf.org/doc/html/rfc8914
+// They tell clients, and whoever's debugging them, why a name failed to resolve; not just that it did.
+
+// extendedErrorCodes maps the errors we know about onto their info code. The first match wins, so more specific
+// errors come before the ones they may wrap.
+var extendedErrorCodes = []struct {
+	err  error
+	code uint16
+}{
+	{dnssec.ErrSignatureExpired, dns.ExtendedErrorCodeSignatureExpired},
+	{dnssec.ErrSignatureNotYetValid, dns.ExtendedErrorCodeSignatureNotYetValid},
+	{dnssec.ErrKeysNotFound, dns.ExtendedErrorCodeDNSKEYMissing},
+	{dnssec.ErrKeySigningKeysNotFound, dns.ExtendedErrorCodeDNSKEYMissing},
+	{dnssec.ErrNoKeyFoundForSignature, dns.ExtendedErrorCodeDNSKEYMissing},
+	{dnssec.ErrSignatureSetEmpty, dns.ExtendedErrorCodeRRSIGsMissing},
+	{dnssec.ErrUnexpectedSignatureCount, dns.ExtendedErrorCodeRRSIGsMissing},
+	{dnssec.ErrBogusDoeRecordsNotFound, dns.ExtendedErrorCodeNSECMissing},
+	{dnssec.ErrBogusWildcardDoeNotFound, dns.ExtendedErrorCodeNSECMissing},
+	{dnssec.ErrNoParentDSRecords, dns.ExtendedErrorCodeDNSBogus},
+	{dnssec.ErrUnableToFetchDSRecord, dns.ExtendedErrorCodeDNSBogus},
+	{dnssec.ErrInvalidTime, dns.ExtendedErrorCodeDNSBogus},
+	{dnssec.ErrVerifyFailed, dns.ExtendedErrorCodeDNSBogus},
+	{dnssec.ErrInvalidSignature, dns.ExtendedErrorCodeDNSBogus},
+	{dnssec.ErrBogusResultFound, dns.ExtendedErrorCodeDNSBogus},
+	// ErrMaxQueriesPerRequestReached, along with anything else not listed, is reported as Other.
+	{ErrNextNameserversNotFound, dns.ExtendedErrorCodeNoReachableAuthority},
+	{ErrNoPoolConfiguredForZone, dns.ExtendedErrorCodeNoReachableAuthority},
+	{ErrFailedToGetDNSKEYs, dns.ExtendedErrorCodeDNSKEYMissing},
+	{ErrQNameCaseMismatch, dns.ExtendedErrorCodeInvalidData},
+	{ErrCookieMismatch, dns.ExtendedErrorCodeInvalidData},
+	{ErrCookieMissing, dns.ExtendedErrorCodeInvalidData},
+	{ErrClientSubnetMismatch, dns.ExtendedErrorCodeInvalidData},
+	{context.DeadlineExceeded, dns.ExtendedErrorCodeNoReachableAuthority},
+}
+
+// extendedError returns the Extended DNS Error describing why a query failed with err, and the DNSSEC result auth.
+// The error's text is included as the extra text. nil is returned if there's nothing to report.
+func extendedError(err error, auth dnssec.AuthenticationResult) *dns.EDNS0_EDE {
+	if err == nil {
+		if auth == dnssec.Bogus {
+			return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus}
+		}
+		return nil
+	}
+
+	ede := &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther, ExtraText: err.Error()}
+
+	var netErr net.Error
+	switch {
+	case auth == dnssec.Bogus:
+		ede.InfoCode = dns.ExtendedErrorCodeDNSBogus
+	case errors.As(err, &netErr) && netErr.Timeout():
+		ede.InfoCode = dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.As(err, &netErr):
+		ede.InfoCode = dns.ExtendedErrorCodeNetworkError
+	}
+
+	for _, known := range extendedErrorCodes {
+		if errors.Is(err, known.err) {
+			ede.InfoCode = known.code
+			break
+		}
+	}
+
+	return ede
+}
+
+// setExtendedError adds ede to m's OPT record, replacing any already there. EDE is an EDNS option, so it's
+// only added if m has an OPT record.
+func setExtendedError(m *dns.Msg, ede *dns.EDNS0_EDE) {
+	opt := m.IsEdns0()
+	if opt == nil || ede == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_EDE); !ok {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, ede)
+}
+
+// extendedErrorOption returns the EDE option in m, if there is one.
+func extendedErrorOption(m *dns.Msg) *dns.EDNS0_EDE {
+	if opt := m.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				return ede
+			}
+		}
+	}
+	return nil
+}
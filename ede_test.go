@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendedError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		auth dnssec.AuthenticationResult
+		code uint16
+	}{
+		{"max queries", fmt.Errorf("%w. value is currently set to: %d", ErrMaxQueriesPerRequestReached, 50), dnssec.Unknown, dns.ExtendedErrorCodeOther},
+		{"no onward nameservers", fmt.Errorf("%w in the response from zone [com.]", ErrNextNameserversNotFound), dnssec.Unknown, dns.ExtendedErrorCodeNoReachableAuthority},
+		{"timeout", &net.OpError{Op: "read", Err: &net.DNSError{IsTimeout: true}}, dnssec.Unknown, dns.ExtendedErrorCodeNoReachableAuthority},
+		{"deadline", fmt.Errorf("resolving: %w", context.DeadlineExceeded), dnssec.Unknown, dns.ExtendedErrorCodeNoReachableAuthority},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, dnssec.Unknown, dns.ExtendedErrorCodeNetworkError},
+		{"bogus", errors.New("something"), dnssec.Bogus, dns.ExtendedErrorCodeDNSBogus},
+		{"expired", fmt.Errorf("%w: %w", dnssec.ErrInvalidTime, dnssec.ErrSignatureExpired), dnssec.Bogus, dns.ExtendedErrorCodeSignatureExpired},
+		{"not yet valid", fmt.Errorf("%w: %w", dnssec.ErrInvalidTime, dnssec.ErrSignatureNotYetValid), dnssec.Bogus, dns.ExtendedErrorCodeSignatureNotYetValid},
+		{"no keys", dnssec.ErrKeysNotFound, dnssec.Bogus, dns.ExtendedErrorCodeDNSKEYMissing},
+		{"no ds", dnssec.ErrNoParentDSRecords, dnssec.Unknown, dns.ExtendedErrorCodeDNSBogus},
+		{"no nsec", dnssec.ErrBogusDoeRecordsNotFound, dnssec.Bogus, dns.ExtendedErrorCodeNSECMissing},
+		{"spoofed", fmt.Errorf("%w: sent [a], got [A]", ErrQNameCaseMismatch), dnssec.Unknown, dns.ExtendedErrorCodeInvalidData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ede := extendedError(tt.err, tt.auth)
+			require.NotNil(t, ede)
+			assert.Equal(t, tt.code, ede.InfoCode)
+			assert.Equal(t, tt.err.Error(), ede.ExtraText)
+		})
+	}
+
+	// Without an error, only Bogus is reported.
+	assert.Nil(t, extendedError(nil, dnssec.Insecure))
+	assert.Equal(t, dns.ExtendedErrorCodeDNSBogus, extendedError(nil, dnssec.Bogus).InfoCode)
+}
+
+func TestSetExtendedError(t *testing.T) {
+	// Without an OPT record, there's nowhere to put it.
+	m := new(dns.Msg)
+	setExtendedError(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther})
+	assert.Nil(t, m.IsEdns0())
+
+	// Any existing EDE is replaced.
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	setExtendedError(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeOther})
+	setExtendedError(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus})
+	require.Len(t, m.IsEdns0().Option, 1)
+	assert.Equal(t, dns.ExtendedErrorCodeDNSBogus, extendedErrorOption(m).InfoCode)
+}
+
+func TestServer_ProcessQuery_ExtendedError(t *testing.T) {
+	// Setup
+	s := NewServer()
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		return newResponseError(fmt.Errorf("%w in the response from zone [com.]", ErrNextNameserversNotFound))
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	w := newMockUDPResponseWriter()
+
+	// Execute
+	s.processQuery(w, q)
+
+	// Assertions
+	require.NotNil(t, w.msg())
+	assert.Equal(t, dns.RcodeServerFailure, w.msg().Rcode)
+	ede := extendedErrorOption(w.msg())
+	require.NotNil(t, ede)
+	assert.Equal(t, dns.ExtendedErrorCodeNoReachableAuthority, ede.InfoCode)
+	assert.Contains(t, ede.ExtraText, "zone [com.]")
+}
+
+func TestServer_Admit_ExtendedError(t *testing.T) {
+	// Setup - mock clients are at 192.0.2.1.
+	acl, err := ParseACL("deny 192.0.2.0/24")
+	require.NoError(t, err)
+	s := &Server{config: Config{RecursionACL: acl}}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	w := newMockUDPResponseWriter()
+
+	// Execute
+	assert.False(t, s.admit(w, q))
+
+	// Assertions
+	require.NotNil(t, w.msg())
+	assert.Equal(t, dns.RcodeRefused, w.msg().Rcode)
+	require.NotNil(t, extendedErrorOption(w.msg()))
+	assert.Equal(t, dns.ExtendedErrorCodeProhibited, extendedErrorOption(w.msg()).InfoCode)
+}
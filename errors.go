@@ -14,4 +14,16 @@ var (
 	ErrEmptyResponse               = errors.New("the received response is empty")
 	ErrInternalError               = errors.New("internal error")
 	ErrMaxQueriesPerRequestReached = errors.New("max queries per request reached")
+	ErrLoadingTLSKeyPair           = errors.New("failed loading TLS certificate and key")
+	ErrServerClosed                = errors.New("server has been shutdown")
+	ErrServerAlreadyListening      = errors.New("server is already listening")
+	ErrServerNotListening          = errors.New("server is not listening")
+	ErrInvalidACLRule              = errors.New("invalid acl rule")
+	ErrClientSubnetMismatch        = errors.New("client subnet in response does not match the query")
+	ErrQNameCaseMismatch           = errors.New("question in response does not match the case of the query")
+	ErrMalformedCookie             = errors.New("malformed dns cookie")
+	ErrCookieMismatch              = errors.New("client cookie in response does not match the query")
+	ErrBadCookie                   = errors.New("bad server cookie")
+	ErrCookieMissing               = errors.New("response has no cookie, though the nameserver has returned one before")
+	ErrUnsupportedSnapshot         = errors.New("unsupported snapshot version")
 )
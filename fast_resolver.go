@@ -31,7 +31,12 @@ type ResolveResult struct {
 	Error    error
 }
 
+// NewFastResolver returns a FastResolver caching its answers in cache. A MemoryCache is used when cache is nil.
 func NewFastResolver(cache CacheInterface) *FastResolver {
+	if cache == nil {
+		cache = NewMemoryCache(0)
+	}
+
 	fr := &FastResolver{
 		cache:      cache,
 		prefetchCh: make(chan string, 1000),
@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const fileCacheVersion = 1
+
+// FileCache is a MemoryCache that's saved to a file, so its entries survive restarts. It's saved every interval
+// while there are changes, and on Close. Entries are loaded back, with their remaining TTLs, when it's created;
+// anything that's since expired is dropped.
+type FileCache struct {
+	*MemoryCache
+	path string
+
+	dirty  atomic.Bool
+	saving sync.Mutex
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+type fileCacheSnapshot struct {
+	Version int
+	Saved   time.Time
+	Entries []fileCacheEntry
+}
+
+type fileCacheEntry struct {
+	Zone     string
+	Question dns.Question
+	Expires  time.Time
+	Msg      snapshotMsg
+}
+
+// NewFileCache returns a FileCache holding up to maxEntries responses, saved to path every interval. Any entries
+// previously saved to path are loaded. maxEntries and interval default to DefaultMemoryCacheSize and
+// DefaultFileCacheSaveInterval when zero or less.
+func NewFileCache(path string, maxEntries int, interval time.Duration) (*FileCache, error) {
+	if interval <= 0 {
+		interval = DefaultFileCacheSaveInterval
+	}
+
+	c := &FileCache{
+		MemoryCache: NewMemoryCache(maxEntries),
+		path:        path,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+
+	if err := c.load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to load cache file [%s]: %w", path, err)
+	}
+
+	go c.saver(interval)
+	return c, nil
+}
+
+// Update caches msg as the response for question in zone. See MemoryCache.Update.
+func (c *FileCache) Update(zone string, question dns.Question, msg *dns.Msg) error {
+	if err := c.MemoryCache.Update(zone, question, msg); err != nil {
+		return err
+	}
+	c.dirty.Store(true)
+	return nil
+}
+
+// Save writes every unexpired entry to the cache's file. The file is replaced atomically.
+func (c *FileCache) Save() error {
+	c.saving.Lock()
+	defer c.saving.Unlock()
+
+	c.dirty.Store(false)
+	if err := writeFileAtomically(c.path, c.write); err != nil {
+		c.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Close stops the periodic saves, and saves the cache a final time.
+func (c *FileCache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+	})
+	<-c.stopped
+	return c.Save()
+}
+
+// saver saves the cache every interval, if it's changed, until it's closed.
+func (c *FileCache) saver(interval time.Duration) {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if !c.dirty.Load() {
+				continue
+			}
+			if err := c.Save(); err != nil {
+				Warn(fmt.Sprintf("unable to save cache file [%s]: %s", c.path, err.Error()))
+			}
+		}
+	}
+}
+
+// write writes every unexpired entry to w, from the least to the most recently used, with their TTLs as they'd be
+// returned now.
+func (c *FileCache) write(w io.Writer) error {
+	now := time.Now()
+	snap := fileCacheSnapshot{
+		Version: fileCacheVersion,
+		Saved:   now,
+	}
+
+	c.mu.Lock()
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		entry := element.Value.(*memoryCacheEntry)
+		if !now.Before(entry.expires) {
+			continue
+		}
+		msg := entry.msg.Copy()
+		decrementTTLs(msg, now.Sub(entry.cached))
+		snap.Entries = append(snap.Entries, fileCacheEntry{
+			Zone:     entry.key.zone,
+			Question: entry.key.question,
+			Expires:  entry.expires,
+			Msg:      newSnapshotMsg(msg),
+		})
+	}
+	c.mu.Unlock()
+
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// load restores the entries saved to the cache's file, dropping any that have since expired.
+func (c *FileCache) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var snap fileCacheSnapshot
+	if err = json.NewDecoder(f).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != fileCacheVersion {
+		return fmt.Errorf("%w [%d]", ErrUnsupportedSnapshot, snap.Version)
+	}
+
+	now := time.Now()
+	restored := 0
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range snap.Entries {
+		if !now.Before(e.Expires) {
+			continue
+		}
+		msg, err := e.Msg.msg()
+		if err != nil {
+			Warn(fmt.Sprintf("unable to restore cache entry for [%s] in zone [%s]: %s", e.Question.Name, e.Zone, err.Error()))
+			continue
+		}
+		c.insert(&memoryCacheEntry{
+			key:     newMemoryCacheKey(e.Zone, e.Question),
+			msg:     msg,
+			cached:  snap.Saved,
+			expires: e.Expires,
+		})
+		restored++
+	}
+
+	Info(fmt.Sprintf("restored %d cache entries from [%s], saved at %s", restored, c.path, snap.Saved.Format(time.RFC3339)))
+	return nil
+}
@@ -0,0 +1,78 @@
+package resolver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCache(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c, err := NewFileCache(path, 0, 0)
+	require.NoError(t, err)
+	assert.Zero(t, c.Len())
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	expired := dns.Question{Name: "expired.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	require.NoError(t, c.Update("com.", q, staleTestAnswer(q, "192.0.2.1")))
+	require.NoError(t, c.Update("com.", expired, staleTestAnswer(expired, "192.0.2.2")))
+	memoryCacheTestEntry(c.MemoryCache, "com.", q).cached = time.Now().Add(-100 * time.Second)
+	assert.True(t, c.dirty.Load())
+
+	// Execute
+	require.NoError(t, c.Close())
+	assert.False(t, c.dirty.Load())
+	memoryCacheTestEntry(c.MemoryCache, "com.", expired).expires = time.Now()
+	require.NoError(t, c.Save())
+
+	restored, err := NewFileCache(path, 0, 0)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	// Assertions - entries are restored with their remaining TTLs; those that have expired aren't.
+	msg, err := restored.Get("com.", q)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	require.Len(t, msg.Answer, 1)
+	assert.Equal(t, "192.0.2.1", msg.Answer[0].(*dns.A).A.String())
+	assert.InDelta(t, 200, msg.Answer[0].Header().Ttl, 2)
+
+	assert.Equal(t, 1, restored.Len())
+}
+
+func TestFileCache_Saver(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "cache.json")
+	c, err := NewFileCache(path, 0, 10*time.Millisecond)
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Execute
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	require.NoError(t, c.Update("com.", q, staleTestAnswer(q, "192.0.2.1")))
+
+	// Assertions
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestNewFileCache_Invalid(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "cache.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"Version": 99}`), 0o600))
+
+	// Execute
+	_, err := NewFileCache(path, 0, 0)
+
+	// Assertions
+	assert.True(t, errors.Is(err, ErrUnsupportedSnapshot))
+}
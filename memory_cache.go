@@ -0,0 +1,190 @@
+package resolver
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// MemoryCache is an in-memory CacheInterface, holding the responses from each zone's nameservers until their TTLs
+// expire. Once it holds its maximum number of entries, the least recently used are evicted.
+//
+// Set Cache to one to cache the responses for each zone on the path to an answer:
+//
+//	resolver.Cache = resolver.NewMemoryCache(0)
+type MemoryCache struct {
+	mu         sync.Mutex
+	items      map[memoryCacheKey]*list.Element
+	lru        *list.List
+	maxEntries int
+	ttl        ttlPolicy
+	stats      MemoryCacheStats
+}
+
+// MemoryCacheStats reports the state of a MemoryCache.
+type MemoryCacheStats struct {
+	Entries    int
+	MaxEntries int
+	Hits       uint64
+	Misses     uint64
+	Evictions  uint64
+	Expired    uint64
+}
+
+type memoryCacheKey struct {
+	zone     string
+	question dns.Question
+}
+
+type memoryCacheEntry struct {
+	key     memoryCacheKey
+	msg     *dns.Msg
+	cached  time.Time
+	expires time.Time
+}
+
+// NewMemoryCache returns a MemoryCache holding up to maxEntries responses. Defaults to DefaultMemoryCacheSize when
+// maxEntries is zero or less.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMemoryCacheSize
+	}
+	return &MemoryCache{
+		items:      make(map[memoryCacheKey]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		ttl:        newTTLPolicy(CacheTTLConfig{}),
+	}
+}
+
+func newMemoryCacheKey(zone string, question dns.Question) memoryCacheKey {
+	question.Name = canonicalName(question.Name)
+	return memoryCacheKey{zone: canonicalName(zone), question: question}
+}
+
+// Get returns a copy of the response cached for question in zone, with its TTLs lowered by the time it's been cached
+// for. nil is returned if there is none, or it's expired.
+func (c *MemoryCache) Get(zone string, question dns.Question) (*dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[newMemoryCacheKey(zone, question)]
+	if !ok {
+		c.stats.Misses++
+		return nil, nil
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		c.remove(element)
+		c.stats.Expired++
+		c.stats.Misses++
+		return nil, nil
+	}
+
+	c.lru.MoveToFront(element)
+	c.stats.Hits++
+
+	msg := entry.msg.Copy()
+	decrementTTLs(msg, now.Sub(entry.cached))
+	return msg, nil
+}
+
+// Update caches a copy of msg as the response for question in zone, until the lowest of its TTLs expires. That's
+// kept within MaxAllowedTTL and, for negative answers, their SOA's minimum field. Responses without any records to
+// take a TTL from aren't cached.
+func (c *MemoryCache) Update(zone string, question dns.Question, msg *dns.Msg) error {
+	if msg == nil {
+		return nil
+	}
+
+	now := time.Now()
+	msg = msg.Copy()
+
+	ttl := c.ttl.apply(question.Name, msg, now)
+	if negative, ok := negativeTTL(msg); ok {
+		ttl = min(ttl, negative)
+	}
+	if ttl == 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.insert(&memoryCacheEntry{
+		key:     newMemoryCacheKey(zone, question),
+		msg:     msg,
+		cached:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	})
+	return nil
+}
+
+// insert adds entry as the most recently used, replacing any existing entry for its key, and evicts the least
+// recently used entries beyond maxEntries. c.mu must be held.
+func (c *MemoryCache) insert(entry *memoryCacheEntry) {
+	if element, ok := c.items[entry.key]; ok {
+		c.remove(element)
+	}
+	c.items[entry.key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops element from the cache. c.mu must be held.
+func (c *MemoryCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.items, element.Value.(*memoryCacheEntry).key)
+}
+
+// RemoveExpired drops every expired entry, returning how many there were. Expired entries are otherwise only
+// dropped when they're next looked up, or evicted.
+func (c *MemoryCache) RemoveExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for element := c.lru.Back(); element != nil; {
+		prev := element.Prev()
+		if !now.Before(element.Value.(*memoryCacheEntry).expires) {
+			c.remove(element)
+			removed++
+		}
+		element = prev
+	}
+	c.stats.Expired += uint64(removed)
+	return removed
+}
+
+// Len returns the number of entries in the cache, including any that have expired but not yet been dropped.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Clear drops every entry. The stats are kept.
+func (c *MemoryCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[memoryCacheKey]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns the cache's current stats.
+func (c *MemoryCache) Stats() MemoryCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	stats.MaxEntries = c.maxEntries
+	return stats
+}
@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryCacheTestEntry returns the entry cached for question in zone.
+func memoryCacheTestEntry(c *MemoryCache, zone string, question dns.Question) *memoryCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[newMemoryCacheKey(zone, question)]; ok {
+		return element.Value.(*memoryCacheEntry)
+	}
+	return nil
+}
+
+func TestMemoryCache_GetUpdate(t *testing.T) {
+	// Setup
+	c := NewMemoryCache(0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// Execute
+	require.NoError(t, c.Update("com.", q, staleTestAnswer(q, "192.0.2.1")))
+
+	// Assertions - answers are keyed by the zone, and question, case-insensitively.
+	msg, err := c.Get("COM.", dns.Question{Name: "Example.COM.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	require.Len(t, msg.Answer, 1)
+	assert.Equal(t, "192.0.2.1", msg.Answer[0].(*dns.A).A.String())
+
+	msg, _ = c.Get(".", q)
+	assert.Nil(t, msg)
+	msg, _ = c.Get("com.", dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET})
+	assert.Nil(t, msg)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, DefaultMemoryCacheSize, stats.MaxEntries)
+
+	// A copy is returned each time.
+	msg, _ = c.Get("com.", q)
+	msg.Answer = nil
+	msg, _ = c.Get("com.", q)
+	assert.Len(t, msg.Answer, 1)
+}
+
+func TestMemoryCache_TTL(t *testing.T) {
+	// Setup
+	c := NewMemoryCache(0)
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	require.NoError(t, c.Update("com.", q, staleTestAnswer(q, "192.0.2.1")))
+	entry := memoryCacheTestEntry(c, "com.", q)
+	require.NotNil(t, entry)
+
+	// Execute & Assertions - TTLs are returned lowered by the time the answer's been cached for.
+	entry.cached = entry.cached.Add(-100 * time.Second)
+	msg, _ := c.Get("com.", q)
+	require.NotNil(t, msg)
+	assert.Equal(t, uint32(200), msg.Answer[0].Header().Ttl)
+
+	// Expired answers are dropped.
+	entry.expires = time.Now().Add(-time.Second)
+	msg, _ = c.Get("com.", q)
+	assert.Nil(t, msg)
+	assert.Equal(t, uint64(1), c.Stats().Expired)
+	assert.Zero(t, c.Len())
+}
+
+func TestMemoryCache_Update_TTLs(t *testing.T) {
+	// Setup
+	c := NewMemoryCache(0)
+	nx := dns.Question{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	negative := new(dns.Msg)
+	negative.Question = []dns.Question{nx}
+	negative.Rcode = dns.RcodeNameError
+	negative.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600}, Ns: "ns1.example.com.", Mbox: "hostmaster.example.com.", Minttl: 60}}
+
+	empty := dns.Question{Name: "empty.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	zero := dns.Question{Name: "zero.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	zeroTTL := staleTestAnswer(zero, "192.0.2.1")
+	zeroTTL.Answer[0].Header().Ttl = 0
+
+	// Execute
+	require.NoError(t, c.Update("example.com.", nx, negative))
+	require.NoError(t, c.Update("example.com.", empty, new(dns.Msg)))
+	require.NoError(t, c.Update("example.com.", zero, zeroTTL))
+	require.NoError(t, c.Update("example.com.", zero, nil))
+
+	// Assertions - negative answers are cached for their SOA's minimum; those without a TTL aren't cached.
+	entry := memoryCacheTestEntry(c, "example.com.", nx)
+	require.NotNil(t, entry)
+	assert.WithinDuration(t, time.Now().Add(60*time.Second), entry.expires, 2*time.Second)
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestMemoryCache_Eviction(t *testing.T) {
+	// Setup
+	c := NewMemoryCache(3)
+	question := func(i int) dns.Question {
+		return dns.Question{Name: fmt.Sprintf("host%d.example.com.", i), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, c.Update("example.com.", question(i), staleTestAnswer(question(i), "192.0.2.1")))
+	}
+
+	// Execute - host0 is used, so host1 is the least recently used when host3 is added.
+	c.Get("example.com.", question(0))
+	require.NoError(t, c.Update("example.com.", question(3), staleTestAnswer(question(3), "192.0.2.1")))
+
+	// Assertions
+	assert.Equal(t, 3, c.Len())
+	assert.Nil(t, memoryCacheTestEntry(c, "example.com.", question(1)))
+	for _, i := range []int{0, 2, 3} {
+		assert.NotNil(t, memoryCacheTestEntry(c, "example.com.", question(i)), i)
+	}
+	assert.Equal(t, uint64(1), c.Stats().Evictions)
+
+	// Expired entries can be dropped all at once.
+	memoryCacheTestEntry(c, "example.com.", question(0)).expires = time.Now()
+	assert.Equal(t, 1, c.RemoveExpired())
+	assert.Equal(t, 2, c.Len())
+
+	c.Clear()
+	assert.Zero(t, c.Len())
+}
+
+func TestNewFastResolver_DefaultCache(t *testing.T) {
+	r := NewFastResolver(nil)
+	assert.IsType(t, &MemoryCache{}, r.cache)
+}
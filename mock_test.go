@@ -2,8 +2,10 @@ package resolver
 
 import (
 	"context"
+	"crypto/tls"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/mock"
+	"net"
 )
 
 // Mock expiringExchanger to simulate pool expiration behavior and DNS message exchange
@@ -94,3 +96,61 @@ func (z *mockZone) dnskeys(ctx context.Context) ([]dns.RR, error) {
 func (z *mockZone) exchange(ctx context.Context, m *dns.Msg) *Response {
 	return z.mockExchange(ctx, m)
 }
+
+//--------------------------------------------------------------------------
+
+type mockResponseWriter struct {
+	remoteAddr net.Addr
+	tlsState   *tls.ConnectionState
+	msgs       []*dns.Msg
+}
+
+func newMockUDPResponseWriter() *mockResponseWriter {
+	return &mockResponseWriter{remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}}
+}
+
+func newMockTCPResponseWriter() *mockResponseWriter {
+	return &mockResponseWriter{remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000}}
+}
+
+func newMockTLSResponseWriter() *mockResponseWriter {
+	w := newMockTCPResponseWriter()
+	w.tlsState = &tls.ConnectionState{HandshakeComplete: true}
+	return w
+}
+
+// msg returns the last message written, or nil.
+func (w *mockResponseWriter) msg() *dns.Msg {
+	if len(w.msgs) == 0 {
+		return nil
+	}
+	return w.msgs[len(w.msgs)-1]
+}
+
+func (w *mockResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *mockResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msgs = append(w.msgs, m)
+	return len(b), nil
+}
+
+func (w *mockResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.0.2.53"), Port: 53}
+}
+
+func (w *mockResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *mockResponseWriter) Close() error         { return nil }
+func (w *mockResponseWriter) TsigStatus() error    { return nil }
+func (w *mockResponseWriter) TsigTimersOnly(bool)  {}
+func (w *mockResponseWriter) Hijack()              {}
+
+func (w *mockResponseWriter) ConnectionState() *tls.ConnectionState {
+	return w.tlsState
+}
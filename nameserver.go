@@ -2,6 +2,7 @@ package resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/miekg/dns"
 	"net"
@@ -30,6 +31,34 @@ type nameserver struct {
 	protocolRatio       float32
 }
 
+// nameserverState is what a Resolver learns about the nameservers it queries, by address. It's passed to each
+// nameserver's exchange in the context, so it's shared by every pool the nameserver appears in.
+type nameserverState struct {
+	cookies           *cookieJar
+	nonCasePreserving *caseExemptions
+}
+
+func newNameserverState() *nameserverState {
+	return &nameserverState{cookies: newCookieJar(), nonCasePreserving: newCaseExemptions()}
+}
+
+// withNameserverState returns ctx carrying state, unless it already carries one.
+func withNameserverState(ctx context.Context, state *nameserverState) context.Context {
+	if state == nil || ctx.Value(ctxNameserverState) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxNameserverState, state)
+}
+
+// nameserverStateFrom returns the state carried by ctx. Without one, a fresh state is returned; nothing learnt
+// about the nameserver is then kept beyond the exchange.
+func nameserverStateFrom(ctx context.Context) *nameserverState {
+	if state, ok := ctx.Value(ctxNameserverState).(*nameserverState); ok {
+		return state
+	}
+	return newNameserverState()
+}
+
 func (*nameserver) defaultDnsClientFactory(protocol string) dnsClient {
 	timeout := DefaultTimeoutUDP
 	if protocol == "tcp" {
@@ -56,11 +85,26 @@ func (nameserver *nameserver) exchange(ctx context.Context, m *dns.Msg) *Respons
 	// Formats correctly for both ipv4 and ipv6.
 	addr := net.JoinHostPort(nameserver.addr, "53")
 
+	state := nameserverStateFrom(ctx)
+
 	r := Response{}
 	for _, protocol := range []string{"udp", "tcp"} {
 		client := factory(protocol)
 
-		r.Msg, r.Duration, r.Err = client.ExchangeContext(ctx, m, addr)
+		// Any cookie from our own client is replaced with ours. It's built each time, to pick up any new server cookie.
+		var cookie *dns.EDNS0_COOKIE
+		if SendDNSCookies {
+			cookie = state.cookies.cookie(nameserver.addr)
+		}
+		query := withCookie(m, cookie)
+
+		// With case randomisation, sent is the query we actually send, and its reply must match its exact case.
+		sent := query
+		if RandomiseQNameCase && len(m.Question) > 0 && !state.nonCasePreserving.exempt(nameserver.addr) {
+			sent = randomiseCase(query)
+		}
+
+		r.Msg, r.Duration, r.Err = client.ExchangeContext(ctx, sent, addr)
 
 		//---
 
@@ -90,6 +134,41 @@ func (nameserver *nameserver) exchange(ctx context.Context, m *dns.Msg) *Respons
 			continue
 		}
 
+		if sent != query {
+			nonPreserving, err := checkCase(sent, r.Msg)
+			if err != nil {
+				if protocol == "udp" || !nonPreserving {
+					// Over UDP, even a name that's all lower, or upper, case could be a spoofer's guess. We retry over
+					// TCP, which is far harder to spoof.
+					Warn(fmt.Sprintf("possible spoofed response from %s (%s) for [%s]: %s", nameserver.hostname, addr, m.Question[0].Name, err.Error()))
+					r = Response{Err: err}
+					continue
+				}
+
+				// The name came back with its case changed over TCP too, so it's the nameserver rewriting it.
+				Info(fmt.Sprintf("nameserver %s (%s) does not preserve the case of names. it will not be sent randomised names", nameserver.hostname, addr))
+				state.nonCasePreserving.add(nameserver.addr)
+			}
+			restoreCase(m, sent, r.Msg)
+		}
+
+		if cookie != nil {
+			err := state.cookies.record(nameserver.addr, r.Msg)
+			if errors.Is(err, ErrCookieMissing) && protocol == "tcp" {
+				// A response over TCP can't be spoofed off-path, so the nameserver has stopped returning cookies.
+				state.cookies.forget(nameserver.addr)
+				err = nil
+			}
+			if err != nil {
+				// Retrying over TCP also sends any fresh server cookie returned with BADCOOKIE.
+				if errors.Is(err, ErrCookieMismatch) || errors.Is(err, ErrCookieMissing) {
+					Warn(fmt.Sprintf("possible spoofed response from %s (%s) for [%s]: %s", nameserver.hostname, addr, m.Question[0].Name, err.Error()))
+				}
+				r = Response{Err: err}
+				continue
+			}
+		}
+
 		// Then we can return straight away.
 		if !r.Msg.Truncated {
 			return &r
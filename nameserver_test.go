@@ -3,12 +3,14 @@ package resolver
 import (
 	"context"
 	"errors"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 // Mock DNS Client
@@ -261,3 +263,155 @@ func TestDefaultDnsClientFactory_TCP(t *testing.T) {
 	}
 
 }
+
+func withRandomisedQNameCase(t *testing.T) {
+	previous := RandomiseQNameCase
+	RandomiseQNameCase = true
+	t.Cleanup(func() { RandomiseQNameCase = previous })
+}
+
+// caseTestClient answers with an A record, with the QName of the query rewritten by rename.
+type caseTestClient struct {
+	rename func(string) string
+	sent   []*dns.Msg
+}
+
+func (c *caseTestClient) ExchangeContext(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	c.sent = append(c.sent, m)
+	reply := new(dns.Msg)
+	reply.SetReply(m)
+	reply.Question[0].Name = c.rename(m.Question[0].Name)
+	reply.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: reply.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}}}
+	return reply, time.Millisecond, nil
+}
+
+func caseTestQuery() *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example-with-a-long-name.com.", dns.TypeA)
+	return msg
+}
+
+func TestExchange_RandomisedQNameCase(t *testing.T) {
+	// Setup
+	withRandomisedQNameCase(t)
+	client := &caseTestClient{rename: func(name string) string { return name }}
+	ns := &nameserver{addr: "192.0.2.54", dnsClientFactory: func(protocol string) dnsClient { return client }}
+	msg := caseTestQuery()
+
+	// Execute
+	response := ns.exchange(context.TODO(), msg)
+
+	// Assertions - the original name is restored in the response.
+	assert.NoError(t, response.Err)
+	require.Len(t, client.sent, 1)
+	sent := client.sent[0].Question[0].Name
+	assert.NotEqual(t, msg.Question[0].Name, sent)
+	assert.True(t, strings.EqualFold(msg.Question[0].Name, sent))
+	assert.Equal(t, "www.example-with-a-long-name.com.", msg.Question[0].Name, "the query isn't modified")
+	assert.Equal(t, msg.Question[0].Name, response.Msg.Question[0].Name)
+	assert.Equal(t, msg.Question[0].Name, response.Msg.Answer[0].Header().Name)
+}
+
+func TestExchange_RandomisedQNameCase_Spoofed(t *testing.T) {
+	// Setup - a spoofer can only guess the case.
+	withRandomisedQNameCase(t)
+	udpClient := &caseTestClient{rename: func(name string) string { return "wWw.ExAmPlE-WiTh-A-LoNg-NaMe.CoM." }}
+	tcpClient := &caseTestClient{rename: func(name string) string { return name }}
+	ns := &nameserver{addr: "192.0.2.55", dnsClientFactory: func(protocol string) dnsClient {
+		if protocol == "udp" {
+			return udpClient
+		}
+		return tcpClient
+	}}
+
+	state := newNameserverState()
+	ctx := withNameserverState(context.TODO(), state)
+
+	// Execute
+	response := ns.exchange(ctx, caseTestQuery())
+
+	// Assertions - the query is retried over TCP, and the server isn't exempted.
+	assert.NoError(t, response.Err)
+	require.Len(t, tcpClient.sent, 1)
+	assert.True(t, strings.EqualFold("www.example-with-a-long-name.com.", tcpClient.sent[0].Question[0].Name))
+	assert.Equal(t, "www.example-with-a-long-name.com.", response.Msg.Question[0].Name)
+	assert.False(t, state.nonCasePreserving.exempt("192.0.2.55"))
+
+	// Over TCP too, the response is rejected.
+	tcpClient.rename = udpClient.rename
+	response = ns.exchange(ctx, caseTestQuery())
+	assert.ErrorIs(t, response.Err, ErrQNameCaseMismatch)
+}
+
+func TestExchange_RandomisedQNameCase_NonPreserving(t *testing.T) {
+	// Setup
+	withRandomisedQNameCase(t)
+	client := &caseTestClient{rename: strings.ToLower}
+	ns := &nameserver{addr: "192.0.2.56", dnsClientFactory: func(protocol string) dnsClient { return client }}
+
+	state := newNameserverState()
+	ctx := withNameserverState(context.TODO(), state)
+
+	// Execute
+	first := ns.exchange(ctx, caseTestQuery())
+	second := ns.exchange(ctx, caseTestQuery())
+
+	// Assertions - confirmed over TCP, the server is no longer sent randomised names.
+	assert.NoError(t, first.Err)
+	assert.NoError(t, second.Err)
+	assert.Equal(t, "www.example-with-a-long-name.com.", first.Msg.Answer[0].Header().Name)
+	assert.True(t, state.nonCasePreserving.exempt("192.0.2.56"))
+	require.Len(t, client.sent, 3)
+	assert.NotEqual(t, "www.example-with-a-long-name.com.", client.sent[1].Question[0].Name, "the TCP retry is randomised")
+	assert.Equal(t, "www.example-with-a-long-name.com.", client.sent[2].Question[0].Name)
+}
+
+func TestExchange_RandomisedQNameCase_LowerCaseSpoofOverUDP(t *testing.T) {
+	// Setup - a spoofer that can't guess the case sends the name in lower case.
+	withRandomisedQNameCase(t)
+	udpClient := &caseTestClient{rename: strings.ToLower}
+	tcpClient := &caseTestClient{rename: func(name string) string { return name }}
+	ns := &nameserver{addr: "192.0.2.57", dnsClientFactory: func(protocol string) dnsClient {
+		if protocol == "udp" {
+			return udpClient
+		}
+		return tcpClient
+	}}
+
+	state := newNameserverState()
+
+	// Execute
+	response := ns.exchange(withNameserverState(context.TODO(), state), caseTestQuery())
+
+	// Assertions - the server's genuine reply over TCP preserves the case, so it's not exempted.
+	assert.NoError(t, response.Err)
+	require.Len(t, tcpClient.sent, 1)
+	assert.False(t, state.nonCasePreserving.exempt("192.0.2.57"))
+}
+
+func TestWithNameserverState(t *testing.T) {
+	// Setup
+	state := newNameserverState()
+	ctx := withNameserverState(context.TODO(), state)
+
+	// Assertions - the first state given is kept, and used by each exchange.
+	assert.Same(t, state, nameserverStateFrom(ctx))
+	assert.Same(t, state, nameserverStateFrom(withNameserverState(ctx, newNameserverState())))
+
+	// Without one, each exchange has a fresh state.
+	assert.NotSame(t, nameserverStateFrom(context.TODO()), nameserverStateFrom(context.TODO()))
+}
+
+func TestCaseExemptions_Expire(t *testing.T) {
+	// Setup
+	e := &caseExemptions{servers: make(map[string]time.Time)}
+	e.add("192.0.2.1")
+
+	// Assertions
+	assert.True(t, e.exempt("192.0.2.1"))
+	assert.False(t, e.exempt("192.0.2.2"))
+
+	e.servers["192.0.2.1"] = time.Now().Add(-time.Second)
+	assert.False(t, e.exempt("192.0.2.1"))
+	assert.Empty(t, e.servers)
+}
@@ -0,0 +1,71 @@
+package resolver
+
+import (
+	"github.com/miekg/dns"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// Negative caching. See https://datatracker.ietf.org/doc/html/rfc2308
+//
+// NXDOMAIN and NODATA answers are cached like any other, but for the negative TTL given by the zone's SOA, which is
+// returned along with them.
+
+// isNegativeResponse returns true if msg is an NXDOMAIN, or NODATA, answer.
+func isNegativeResponse(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+}
+
+// negativeTTL returns how long the negative answer msg can be cached for; the lower of its SOA's TTL and minimum
+// field, along with any records leading to it. false is returned if there's no SOA.
+// See https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	soas := extractRecords[*dns.SOA](msg.Ns)
+	if len(soas) == 0 {
+		return 0, false
+	}
+
+	ttl := min(soas[0].Hdr.Ttl, soas[0].Minttl)
+	for _, rr := range msg.Answer {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl, true
+}
+
+// setNegative caches the NXDOMAIN or NODATA answer msg for the negative TTL given by the SOA in its authority
+// section; the lower of the SOA's TTL and its minimum field. The TTLs of the SOA, and the other records in the
+// authority section, are lowered to match, as they're returned to clients. Answers without a SOA aren't cached.
+// See https://datatracker.ietf.org/doc/html/rfc2308#section-5 and https://datatracker.ietf.org/doc/html/rfc9077
+func (c *DNSCache) setNegative(q dns.Question, variant cacheVariant, resp *Response, subnet netip.Prefix) {
+	ttl, ok := negativeTTL(resp.Msg)
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	msg := resp.Msg.Copy()
+	for _, rr := range msg.Ns {
+		rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+	}
+
+	if ttl = c.ttl.apply(q.Name, msg, now); ttl == 0 {
+		return
+	}
+
+	expires := now.Add(time.Duration(ttl) * time.Second)
+
+	// Negative answers are served stale, as positive ones are, while the nameservers can't be reached.
+	c.add(variant.baseKey(q), &cacheEntry{
+		msg:        msg,
+		expires:    expires,
+		stale:      expires.Add(c.staleWindow),
+		cached:     now,
+		isNegative: true,
+		frequency:  1,
+		auth:       resp.Auth,
+		doe:        resp.Doe,
+	}, subnet)
+
+	atomic.AddUint64(&c.stats.Negative, 1)
+}
@@ -0,0 +1,167 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// negativeTestAnswer returns a response to q with rcode, and example.com.'s SOA with the given TTL and minimum.
+func negativeTestAnswer(q dns.Question, rcode int, ttl, minimum uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.Question = []dns.Question{q}
+	m.Rcode = rcode
+	m.Ns = []dns.RR{&dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: minimum,
+	}}
+	return m
+}
+
+func TestIsNegativeResponse(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	assert.True(t, isNegativeResponse(negativeTestAnswer(q, dns.RcodeNameError, 3600, 300)))
+	assert.True(t, isNegativeResponse(negativeTestAnswer(q, dns.RcodeSuccess, 3600, 300)))
+	assert.False(t, isNegativeResponse(negativeTestAnswer(q, dns.RcodeServerFailure, 3600, 300)))
+	assert.False(t, isNegativeResponse(staleTestAnswer(q, "192.0.2.1")))
+}
+
+func TestNegativeTTL(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// The lower of the SOA's TTL and minimum.
+	ttl, ok := negativeTTL(negativeTestAnswer(q, dns.RcodeNameError, 3600, 300))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(300), ttl)
+
+	ttl, ok = negativeTTL(negativeTestAnswer(q, dns.RcodeNameError, 60, 300))
+	assert.True(t, ok)
+	assert.Equal(t, uint32(60), ttl)
+
+	// Along with any CNAMEs leading to it.
+	m := negativeTestAnswer(q, dns.RcodeNameError, 3600, 300)
+	m.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30}, Target: "missing.example.com."}}
+	ttl, ok = negativeTTL(m)
+	assert.True(t, ok)
+	assert.Equal(t, uint32(30), ttl)
+
+	// Without a SOA, there's no negative TTL.
+	m.Ns = nil
+	_, ok = negativeTTL(m)
+	assert.False(t, ok)
+}
+
+func TestDNSCache_SetNegative(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{}).cache
+	nxdomain := dns.Question{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	nodata := dns.Question{Name: "example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	unsigned := dns.Question{Name: "nosoa.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	// Execute
+	c.set(nxdomain, negativeTestAnswer(nxdomain, dns.RcodeNameError, 3600, 300))
+	c.set(nodata, negativeTestAnswer(nodata, dns.RcodeSuccess, 120, 300))
+	withoutSOA := negativeTestAnswer(unsigned, dns.RcodeNameError, 3600, 300)
+	withoutSOA.Ns = nil
+	c.set(unsigned, withoutSOA)
+
+	// Assertions - the SOA is returned, with the negative TTL.
+	m := c.get(nxdomain, 7)
+	require.NotNil(t, m)
+	assert.Equal(t, uint16(7), m.Id)
+	assert.Equal(t, dns.RcodeNameError, m.Rcode)
+	require.Len(t, m.Ns, 1)
+	assert.Equal(t, uint32(300), m.Ns[0].Header().Ttl)
+
+	m = c.get(nodata, 1)
+	require.NotNil(t, m)
+	assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+	assert.Empty(t, m.Answer)
+	assert.Equal(t, uint32(120), m.Ns[0].Header().Ttl)
+
+	// Negative answers without a SOA aren't cached.
+	assert.Nil(t, c.get(unsigned, 1))
+	assert.Equal(t, uint64(2), c.Stats().Negative)
+
+	// The entries expire with the negative TTL.
+	entry := c.getShard("missing.example.com.-1-1").items["missing.example.com.-1-1"]
+	require.NotNil(t, entry)
+	assert.True(t, entry.isNegative)
+	assert.WithinDuration(t, time.Now().Add(300*time.Second), entry.expires, 5*time.Second)
+}
+
+func TestServer_ProcessQuery_NegativeCache(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		m := negativeTestAnswer(qmsg.Question[0], dns.RcodeNameError, 3600, 300)
+		m.SetReply(qmsg)
+		m.Rcode = dns.RcodeNameError
+		return &Response{Msg: m}
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("missing.example.com.", dns.TypeA)
+	w := newMockUDPResponseWriter()
+
+	// Execute
+	s.processQuery(w, q)
+	s.processQuery(w, q)
+
+	// Assertions - the second is answered from the cache, both with the SOA.
+	assert.Equal(t, int32(1), calls.Load())
+	require.Len(t, w.msgs, 2)
+	for _, m := range w.msgs {
+		assert.Equal(t, dns.RcodeNameError, m.Rcode)
+		assert.Len(t, extractRecords[*dns.SOA](m.Ns), 1)
+	}
+	assert.Equal(t, uint32(300), w.msgs[1].Ns[0].Header().Ttl)
+
+	// Scoped negative answers are only returned to clients in the scope.
+	s.cache.setScoped(q.Question[0], negativeTestAnswer(q.Question[0], dns.RcodeNameError, 3600, 60), netip.MustParsePrefix("192.0.2.0/24"))
+	m, scope := s.cache.getScoped(q.Question[0], 1, netip.MustParseAddr("192.0.2.1"))
+	require.NotNil(t, m)
+	assert.Equal(t, 24, scope)
+	assert.Equal(t, uint32(60), m.Ns[0].Header().Ttl)
+}
+
+func TestServer_ProcessQuery_StaleNegative(t *testing.T) {
+	// Setup - an expired NXDOMAIN answer, with resolving failing.
+	s := NewServerWithConfig(&Config{ServeStale: ServeStaleConfig{Window: time.Hour}})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		return newResponseError(&net.OpError{Op: "read", Err: errors.New("connection refused")})
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("missing.example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	s.cache.set(q.Question[0], negativeTestAnswer(q.Question[0], dns.RcodeNameError, 3600, 60))
+	expireCacheEntry(s.cache, q.Question[0], 10*time.Minute)
+
+	// Execute
+	w := newMockUDPResponseWriter()
+	s.processQuery(w, q)
+
+	// Assertions - the NXDOMAIN is returned stale, rather than SERVFAIL.
+	require.NotNil(t, w.msg())
+	assert.Equal(t, dns.RcodeNameError, w.msg().Rcode)
+	require.Len(t, w.msg().Ns, 1)
+	assert.Equal(t, uint32(DefaultStaleAnswerTTL), w.msg().Ns[0].Header().Ttl)
+	require.NotNil(t, extendedErrorOption(w.msg()))
+	assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, extendedErrorOption(w.msg()).InfoCode)
+}
@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// OverloadAction is what the Server does with queries that arrive while every worker is busy, and the queue is full.
+type OverloadAction uint8
+
+const (
+	// OverloadDrop drops the query without a reply; the client will retry.
+	OverloadDrop OverloadAction = iota
+
+	// OverloadServFail answers the query with SERVFAIL.
+	OverloadServFail
+
+	// OverloadRefused answers the query with REFUSED.
+	OverloadRefused
+)
+
+func (a OverloadAction) String() string {
+	switch a {
+	case OverloadServFail:
+		return "servfail"
+	case OverloadRefused:
+		return "refused"
+	default:
+		return "drop"
+	}
+}
+
+// ServerStats reports how the Server's workers are keeping up with the queries they're sent.
+type ServerStats struct {
+	// Workers is how many queries are answered at once. Queued is how many are waiting for a worker, out of a
+	// queue of QueueSize.
+	Workers   int
+	Queued    int
+	QueueSize int
+
+	// Processed counts the queries taken from the queue by a worker. QueueWait is the total time they waited, and
+	// MaxQueueWait the longest any one did.
+	Processed    uint64
+	QueueWait    time.Duration
+	MaxQueueWait time.Duration
+
+	// Overloaded counts the queries shed as the queue was full; TimedOut those not resolved within the query
+	// timeout.
+	Overloaded uint64
+	TimedOut   uint64
+}
+
+// AverageQueueWait returns how long queries waited for a worker, on average.
+func (stats ServerStats) AverageQueueWait() time.Duration {
+	if stats.Processed == 0 {
+		return 0
+	}
+	return stats.QueueWait / time.Duration(stats.Processed)
+}
+
+type serverStats struct {
+	processed    atomic.Uint64
+	queueWait    atomic.Int64
+	maxQueueWait atomic.Int64
+	overloaded   atomic.Uint64
+	timedOut     atomic.Uint64
+}
+
+// waited records that a query waited for wait in the queue.
+func (stats *serverStats) waited(wait time.Duration) {
+	stats.processed.Add(1)
+	stats.queueWait.Add(int64(wait))
+	for {
+		longest := stats.maxQueueWait.Load()
+		if int64(wait) <= longest || stats.maxQueueWait.CompareAndSwap(longest, int64(wait)) {
+			return
+		}
+	}
+}
+
+// Stats returns how the Server's workers are keeping up with the queries they're sent.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Workers:      s.workers,
+		Queued:       len(s.queries),
+		QueueSize:    cap(s.queries),
+		Processed:    s.stats.processed.Load(),
+		QueueWait:    time.Duration(s.stats.queueWait.Load()),
+		MaxQueueWait: time.Duration(s.stats.maxQueueWait.Load()),
+		Overloaded:   s.stats.overloaded.Load(),
+		TimedOut:     s.stats.timedOut.Load(),
+	}
+}
+
+// shed deals with query r, which arrived while the queue was full, as configured by WorkerConfig.Overload.
+func (s *Server) shed(w dns.ResponseWriter, r *dns.Msg) {
+	s.stats.overloaded.Add(1)
+
+	var rcode int
+	switch s.config.Workers.Overload {
+	case OverloadServFail:
+		rcode = dns.RcodeServerFailure
+	case OverloadRefused:
+		rcode = dns.RcodeRefused
+	default:
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(MaxUDPResponseSize, opt.Do())
+	}
+	s.writeMsg(w, r, m)
+}
+
+// queryTimeout returns how long each query has to be resolved.
+func (s *Server) queryTimeout() time.Duration {
+	if s.config.Workers.QueryTimeout > 0 {
+		return s.config.Workers.QueryTimeout
+	}
+	return DefaultQueryTimeout
+}
+
+// resolveWithin resolves r as resolveShared does, giving up once the query timeout passes.
+func (s *Server) resolveWithin(ctx context.Context, r *dns.Msg, ecs *clientSubnet) *Response {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout())
+	defer cancel()
+
+	resp := s.resolveShared(ctx, r, ecs)
+	if resp.HasError() && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.stats.timedOut.Add(1)
+	}
+	return resp
+}
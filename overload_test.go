@@ -0,0 +1,114 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// overloadTestServer returns a Server whose resolutions block until release is closed.
+func overloadTestServer(config *Config, calls *atomic.Int32, release chan struct{}) *Server {
+	s := NewServerWithConfig(config)
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		<-release
+		return &Response{Msg: staleTestAnswer(qmsg.Question[0], "192.0.2.1")}
+	})
+	return s
+}
+
+func TestServer_HandleDNS_Overload(t *testing.T) {
+	for action, rcode := range map[OverloadAction]int{
+		OverloadDrop:     -1,
+		OverloadServFail: dns.RcodeServerFailure,
+		OverloadRefused:  dns.RcodeRefused,
+	} {
+		t.Run(action.String(), func(t *testing.T) {
+			// Setup - one worker, busy with the first query, and room for one more in the queue.
+			var calls atomic.Int32
+			release := make(chan struct{})
+			s := overloadTestServer(&Config{Workers: WorkerConfig{Count: 1, QueueSize: 1, Overload: action}}, &calls, release)
+			defer s.Shutdown(context.Background())
+
+			var wg sync.WaitGroup
+			for i, name := range []string{"one.example.com.", "two.example.com."} {
+				r := new(dns.Msg)
+				r.SetQuestion(name, dns.TypeA)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					s.handleDNS(newMockUDPResponseWriter(), r)
+				}()
+				require.Eventually(t, func() bool {
+					return calls.Load() == 1 && s.Stats().Queued == i
+				}, time.Second, time.Millisecond)
+			}
+
+			// Execute
+			w := newMockUDPResponseWriter()
+			r := new(dns.Msg)
+			r.SetQuestion("three.example.com.", dns.TypeA)
+			s.handleDNS(w, r)
+
+			// Assertions - the query is shed straight away, rather than waiting for room in the queue.
+			if rcode < 0 {
+				assert.Nil(t, w.msg())
+			} else {
+				require.NotNil(t, w.msg())
+				assert.Equal(t, rcode, w.msg().Rcode)
+				assert.Equal(t, r.Id, w.msg().Id)
+			}
+
+			close(release)
+			wg.Wait()
+
+			stats := s.Stats()
+			assert.Equal(t, uint64(1), stats.Overloaded)
+			assert.Equal(t, uint64(2), stats.Processed)
+			assert.Equal(t, 1, stats.Workers)
+			assert.Equal(t, 1, stats.QueueSize)
+			assert.Positive(t, stats.MaxQueueWait)
+			assert.LessOrEqual(t, stats.AverageQueueWait(), stats.MaxQueueWait)
+		})
+	}
+}
+
+func TestServer_ProcessQuery_Timeout(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	s := overloadTestServer(&Config{Workers: WorkerConfig{QueryTimeout: 20 * time.Millisecond}}, &calls, release)
+	defer s.Shutdown(context.Background())
+
+	w := newMockUDPResponseWriter()
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	// Execute
+	start := time.Now()
+	s.processQuery(w, r)
+
+	// Assertions - the query isn't left waiting on a resolution that's taking too long.
+	assert.Less(t, time.Since(start), time.Second)
+	require.NotNil(t, w.msg())
+	assert.Equal(t, dns.RcodeServerFailure, w.msg().Rcode)
+	assert.Equal(t, uint64(1), s.Stats().TimedOut)
+}
+
+func TestServer_Workers_Defaults(t *testing.T) {
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+
+	stats := s.Stats()
+	assert.Equal(t, DefaultWorkers, stats.Workers)
+	assert.Equal(t, DefaultQueueSize, stats.QueueSize)
+	assert.Equal(t, DefaultQueryTimeout, s.queryTimeout())
+	assert.Equal(t, OverloadDrop, s.config.Workers.Overload)
+}
@@ -0,0 +1,55 @@
+package resolver
+
+import (
+	"github.com/miekg/dns"
+)
+
+// paddingRequested returns true if the query included the EDNS(0) Padding option (RFC 7830).
+func paddingRequested(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptedTransport returns true if w writes to a TLS (or QUIC) protected connection.
+func encryptedTransport(w dns.ResponseWriter) bool {
+	cs, ok := w.(dns.ConnectionStater)
+	return ok && cs.ConnectionState() != nil
+}
+
+// padResponse pads m, using the EDNS(0) Padding option, such that its length is a multiple of blockSize.
+// Any existing padding is replaced. If padding would take m past the maximum message size, none is added.
+// m is only padded if it already has an OPT record, as one mustn't be added to a reply to a query without EDNS.
+func padResponse(m *dns.Msg, blockSize int) {
+	opt := m.IsEdns0()
+	if blockSize <= 0 || opt == nil {
+		return
+	}
+
+	options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+	for _, o := range opt.Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); !ok {
+			options = append(options, o)
+		}
+	}
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(options, padding)
+
+	// The length here includes the padding option's own 4 byte header.
+	length := m.Len()
+	if remainder := length % blockSize; remainder != 0 {
+		if length+blockSize-remainder > dns.MaxMsgSize {
+			opt.Option = options
+			return
+		}
+		padding.Padding = make([]byte, blockSize-remainder)
+	}
+}
@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func paddedQuery() *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	return r
+}
+
+func TestPaddingRequested(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, paddingRequested(r))
+
+	r.SetEdns0(4096, false)
+	assert.False(t, paddingRequested(r))
+
+	assert.True(t, paddingRequested(paddedQuery()))
+}
+
+func TestPadResponse(t *testing.T) {
+	for _, answers := range []int{0, 1, 10, 50} {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		m := largeReply(r, answers)
+		m.SetEdns0(4096, false)
+
+		padResponse(m, 468)
+
+		assert.Equal(t, 0, m.Len()%468, "answers: %d", answers)
+
+		// The result must pack to the length we padded to.
+		b, err := m.Pack()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, len(b)%468, "answers: %d", answers)
+	}
+}
+
+func TestPadResponse_ReplacesExistingPadding(t *testing.T) {
+	m := paddedQuery()
+
+	padResponse(m, 128)
+
+	paddingOptions := 0
+	for _, o := range m.IsEdns0().Option {
+		if _, ok := o.(*dns.EDNS0_PADDING); ok {
+			paddingOptions++
+		}
+	}
+	assert.Equal(t, 1, paddingOptions)
+	assert.Equal(t, 0, m.Len()%128)
+}
+
+func TestPadResponse_WithoutEDNS(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	m := largeReply(r, 3)
+
+	padResponse(m, 128)
+
+	assert.Nil(t, m.IsEdns0())
+}
+
+func TestServer_WriteMsg_PadsOnlyEncryptedTransports(t *testing.T) {
+	s := &Server{}
+	r := paddedQuery()
+
+	// Over TLS, with padding requested, the reply is padded.
+	w := newMockTLSResponseWriter()
+	assert.NoError(t, s.writeMsg(w, r, largeReply(r, 3)))
+	assert.Equal(t, 0, w.msg().Len()%ResponsePaddingBlockSize)
+	assert.True(t, paddingRequested(w.msg()))
+
+	// Over plain TCP, it is not.
+	w = newMockTCPResponseWriter()
+	assert.NoError(t, s.writeMsg(w, r, largeReply(r, 3)))
+	assert.False(t, paddingRequested(w.msg()))
+
+	// Over TLS without padding requested, it is not.
+	unpadded := new(dns.Msg)
+	unpadded.SetQuestion("example.com.", dns.TypeA)
+	w = newMockTLSResponseWriter()
+	assert.NoError(t, s.writeMsg(w, unpadded, largeReply(unpadded, 3)))
+	assert.False(t, paddingRequested(w.msg()))
+}
@@ -0,0 +1,190 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// prefetcher refreshes popular answers in the cache as they near expiry, through a fixed number of workers.
+// See PrefetchConfig.
+type prefetcher struct {
+	cache   *DNSCache
+	resolve func(ctx context.Context, r *dns.Msg) *Response
+	queue   chan prefetchTask
+
+	// window is the fraction of an entry's TTL in which it's refreshed; minHits how popular it must be, as
+	// estimated by each shard's popularity sketch.
+	window  float64
+	minHits uint8
+
+	// ctx is cancelled when the owning Server shuts down; wg tracks the workers.
+	ctx context.Context
+	wg  sync.WaitGroup
+}
+
+// prefetchTask is an entry, cached at key, due to be refreshed.
+type prefetchTask struct {
+	key      string
+	question dns.Question
+	variant  cacheVariant
+}
+
+// newPrefetcher returns a prefetcher refreshing the entries in cache with resolve, and starts its workers. nil is
+// returned if prefetching is disabled.
+func newPrefetcher(ctx context.Context, config PrefetchConfig, cache *DNSCache, resolve func(ctx context.Context, r *dns.Msg) *Response) *prefetcher {
+	if config.Disabled {
+		return nil
+	}
+
+	workers := config.Workers
+	if workers <= 0 {
+		workers = DefaultPrefetchWorkers
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultPrefetchQueueSize
+	}
+	window := config.Window
+	if window <= 0 || window > 1 {
+		window = DefaultPrefetchWindow
+	}
+	minHits := config.MinHits
+	if minHits <= 0 {
+		minHits = DefaultPrefetchMinHits
+	}
+	keys := config.Keys
+	if keys <= 0 {
+		keys = DefaultPrefetchKeys
+	}
+
+	p := &prefetcher{
+		cache:   cache,
+		resolve: resolve,
+		queue:   make(chan prefetchTask, queueSize),
+		window:  window,
+		minHits: uint8(min(minHits, countMinSketchMaxCount)),
+		ctx:     ctx,
+	}
+	for _, shard := range cache.shards {
+		shard.popularity = newCountMinSketch(keys / len(cache.shards))
+	}
+	cache.prefetch = p
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Wait blocks until every worker has returned.
+func (p *prefetcher) Wait() {
+	p.wg.Wait()
+}
+
+// offer is told of each time entry is returned from the cache. Once it's popular enough, and within the last window
+// of its TTL, it's queued to be refreshed. Variants for a client subnet are refreshed by those clients' own queries.
+// The lock of shard, which holds entry, must be held.
+func (p *prefetcher) offer(shard *cacheShard, entry *cacheEntry, now time.Time) {
+	if p == nil || entry.subnet.IsValid() || len(entry.msg.Question) == 0 {
+		return
+	}
+
+	shard.popularity.increment(entry.key)
+	hits := shard.popularity.estimate(entry.key)
+
+	if entry.refreshing || hits < p.minHits {
+		return
+	}
+
+	ttl := entry.expires.Sub(entry.cached)
+	if entry.expires.Sub(now) > time.Duration(float64(ttl)*p.window) {
+		return
+	}
+
+	select {
+	case p.queue <- prefetchTask{key: entry.key, question: entry.msg.Question[0], variant: keyVariant(entry.key)}:
+		entry.refreshing = true
+	default:
+		// The workers are busy; the entry can be offered again on its next hit.
+		atomic.AddUint64(&p.cache.stats.PrefetchDropped, 1)
+	}
+}
+
+func (p *prefetcher) worker() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case task := <-p.queue:
+			p.refresh(task)
+		}
+	}
+}
+
+// refresh resolves the task's question again, which caches the new answer in place of the old.
+func (p *prefetcher) refresh(task prefetchTask) {
+	started := time.Now()
+	if resp := p.resolve(p.ctx, task.query()); resp.HasError() {
+		p.cache.refreshFailed(task.key)
+		return
+	}
+	if p.cache.markPrefetched(task.key, started) {
+		atomic.AddUint64(&p.cache.stats.Prefetches, 1)
+	}
+}
+
+// query returns a query for the variant of the answer the task refreshes.
+func (t prefetchTask) query() *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(t.question.Name, t.question.Qtype)
+	r.Question[0].Qclass = t.question.Qclass
+	if t.variant != cachePlain {
+		r.SetEdns0(MaxUDPResponseSize, true)
+		r.CheckingDisabled = t.variant == cacheUnchecked
+	}
+	return r
+}
+
+// markPrefetched records that the entry at key was cached by prefetching, so whether it's then used can be counted.
+// It returns false if the entry hasn't been cached since started; the answer wasn't cacheable.
+func (c *DNSCache) markPrefetched(key string, started time.Time) bool {
+	shard := c.getShard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.items[key]
+	if !ok || entry.cached.Before(started) {
+		return false
+	}
+	entry.prefetched = true
+	return true
+}
+
+// refreshFailed records that refreshing the entry at key failed. The old answer is still cached, so its next hit
+// can offer it again.
+func (c *DNSCache) refreshFailed(key string) {
+	shard := c.getShard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if entry, ok := shard.items[key]; ok {
+		entry.refreshing = false
+	}
+}
+
+// resolvePrefetch resolves r on behalf of the prefetcher, caching the answer. As for client queries, it gives up once
+// the query timeout passes, so a slow nameserver can't hold up a worker.
+func (s *Server) resolvePrefetch(ctx context.Context, r *dns.Msg) *Response {
+	ctx, cancel := context.WithTimeout(ctx, s.queryTimeout())
+	defer cancel()
+	return s.resolve(ctx, r, nil)
+}
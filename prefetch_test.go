@@ -0,0 +1,212 @@
+package resolver
+
+import (
+	"context"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// prefetchTestEntry returns the entry cached at key, moved on in time so it's the last 20 seconds of its 300 second
+// TTL; within the default window.
+func prefetchTestEntry(t *testing.T, c *DNSCache, key string) *cacheEntry {
+	entry := c.getShard(key).items[key]
+	require.NotNil(t, entry)
+	now := time.Now()
+	entry.cached = now.Add(-280 * time.Second)
+	entry.expires = now.Add(20 * time.Second)
+	entry.stale = entry.expires
+	return entry
+}
+
+func TestPrefetcher_Refresh(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		return &Response{Msg: staleTestAnswer(qmsg.Question[0], "192.0.2.2")}
+	})
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	prefetchTestEntry(t, s.cache, "example.com.-1-1")
+
+	// Execute - popular enough on its second hit.
+	assert.NotNil(t, s.cache.get(q, 1))
+	assert.NotNil(t, s.cache.get(q, 1))
+
+	// Assertions - the answer is refreshed in the background.
+	assert.Eventually(t, func() bool {
+		return s.cache.Stats().Prefetches == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(1), calls.Load())
+
+	msg := s.cache.get(q, 1)
+	require.NotNil(t, msg)
+	assert.Equal(t, "192.0.2.2", msg.Answer[0].(*dns.A).A.String())
+	assert.Equal(t, uint32(300), msg.Answer[0].Header().Ttl)
+
+	stats := s.cache.Stats()
+	assert.Equal(t, uint64(1), stats.PrefetchHits)
+	assert.Zero(t, stats.PrefetchWasted)
+}
+
+func TestPrefetcher_RefreshFailed(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+	s.resolver = newTestResolver(func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		return newResponseError(context.DeadlineExceeded)
+	})
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	entry := prefetchTestEntry(t, s.cache, "example.com.-1-1")
+
+	// Execute - popular enough on its second hit.
+	assert.NotNil(t, s.cache.get(q, 1))
+	assert.NotNil(t, s.cache.get(q, 1))
+
+	// Assertions - once the refresh fails, the entry is no longer marked as refreshing...
+	shard := s.cache.getShard("example.com.-1-1")
+	assert.Eventually(t, func() bool {
+		shard.mu.RLock()
+		defer shard.mu.RUnlock()
+		return calls.Load() == 1 && !entry.refreshing
+	}, time.Second, 10*time.Millisecond)
+
+	// ...so its next hit offers it again.
+	assert.NotNil(t, s.cache.get(q, 1))
+	assert.Eventually(t, func() bool { return calls.Load() == 2 }, time.Second, 10*time.Millisecond)
+	assert.Zero(t, s.cache.Stats().Prefetches)
+}
+
+func TestPrefetcher_Offer(t *testing.T) {
+	// Setup - a prefetcher without any workers, so what's queued stays queued.
+	c := NewServerWithConfig(&Config{Prefetch: PrefetchConfig{Disabled: true}}).cache
+	p := &prefetcher{cache: c, queue: make(chan prefetchTask, 1), window: 0.1, minHits: 2}
+	for _, shard := range c.shards {
+		shard.popularity = newCountMinSketch(64)
+	}
+	offer := func(entry *cacheEntry) {
+		p.offer(c.getShard(entry.key), entry, time.Now())
+	}
+
+	fresh := dns.Question{Name: "fresh.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(fresh, staleTestAnswer(fresh, "192.0.2.1"))
+	due := dns.Question{Name: "due.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	r := dnssecTestQuery(true, false)
+	r.Question[0] = due
+	c.setAnswer(r, &Response{Msg: staleTestAnswer(due, "192.0.2.1")}, netip.Prefix{})
+	another := dns.Question{Name: "another.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(another, staleTestAnswer(another, "192.0.2.1"))
+
+	freshEntry := c.getShard("fresh.example.com.-1-1").items["fresh.example.com.-1-1"]
+	dueEntry := prefetchTestEntry(t, c, "due.example.com.-1-1-do")
+	anotherEntry := prefetchTestEntry(t, c, "another.example.com.-1-1")
+
+	// Execute & Assertions - popular entries aren't refreshed until they're within the window.
+	for i := 0; i < 3; i++ {
+		offer(freshEntry)
+	}
+	assert.Empty(t, p.queue)
+
+	// Entries that are due are refreshed once they're popular, and only queued once.
+	offer(dueEntry)
+	assert.Empty(t, p.queue)
+	offer(dueEntry)
+	offer(dueEntry)
+	require.Len(t, p.queue, 1)
+	assert.True(t, dueEntry.refreshing)
+
+	// The refresh is for the same variant of the answer.
+	task := <-p.queue
+	assert.Equal(t, "due.example.com.-1-1-do", task.key)
+	query := task.query()
+	assert.Equal(t, due, query.Question[0])
+	assert.True(t, isSetDO(query))
+	assert.False(t, query.CheckingDisabled)
+
+	// Refreshes are skipped while the queue is full.
+	p.queue <- prefetchTask{}
+	offer(anotherEntry)
+	offer(anotherEntry)
+	assert.False(t, anotherEntry.refreshing)
+	assert.Equal(t, uint64(1), c.Stats().PrefetchDropped)
+	<-p.queue
+
+	// Variants for a client subnet aren't refreshed.
+	c.setScoped(another, staleTestAnswer(another, "192.0.2.1"), netip.MustParsePrefix("192.0.2.0/24"))
+	scoped := prefetchTestEntry(t, c, scopedKey("another.example.com.-1-1", netip.MustParsePrefix("192.0.2.0/24")))
+	for i := 0; i < 3; i++ {
+		p.offer(c.getShard("another.example.com.-1-1"), scoped, time.Now())
+	}
+	assert.Empty(t, p.queue)
+}
+
+func TestPrefetcher_Wasted(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, staleTestAnswer(q, "192.0.2.1"))
+
+	// Execute & Assertions - only answers cached since the prefetch started are marked.
+	assert.False(t, c.markPrefetched("example.com.-1-1", time.Now().Add(time.Second)))
+	assert.False(t, c.markPrefetched("missing.example.com.-1-1", time.Time{}))
+	require.True(t, c.markPrefetched("example.com.-1-1", time.Time{}))
+
+	// An entry that expires without being used was wasted.
+	entry := c.getShard("example.com.-1-1").items["example.com.-1-1"]
+	entry.expires = time.Now().Add(-time.Second)
+	entry.stale = entry.expires
+	c.cleanExpired()
+
+	assert.Equal(t, uint64(1), c.Stats().PrefetchWasted)
+}
+
+func TestServer_ResolvePrefetch_Timeout(t *testing.T) {
+	// Setup - a resolution that only ends once its context does.
+	s := NewServerWithConfig(&Config{Workers: WorkerConfig{QueryTimeout: 20 * time.Millisecond}})
+	defer s.Shutdown(context.Background())
+	resolver := newTestResolver(nil)
+	resolver.funcs.resolveLabel = func(ctx context.Context, d *domain, z zone, qmsg *dns.Msg, auth *authenticator) (zone, *Response) {
+		<-ctx.Done()
+		return nil, newResponseError(ctx.Err())
+	}
+	s.resolver = resolver
+
+	// Execute
+	start := time.Now()
+	resp := s.resolvePrefetch(s.ctx, prefetchTask{question: dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}.query())
+
+	// Assertions - a refresh isn't left waiting on a resolution that's taking too long.
+	assert.Less(t, time.Since(start), time.Second)
+	assert.True(t, resp.HasError())
+}
+
+func TestPrefetcher_Disabled(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{Prefetch: PrefetchConfig{Disabled: true}})
+	defer s.Shutdown(context.Background())
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	prefetchTestEntry(t, s.cache, "example.com.-1-1")
+
+	// Execute & Assertions
+	assert.Nil(t, s.prefetch)
+	assert.Nil(t, s.cache.prefetch)
+	for i := 0; i < 3; i++ {
+		assert.NotNil(t, s.cache.get(q, 1))
+	}
+	assert.Zero(t, s.cache.Stats().PrefetchDropped)
+}
@@ -0,0 +1,107 @@
+package resolver
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caseExemptions tracks the nameservers, by address, that have been seen not to preserve the case of the QName in
+// their responses. They're not sent randomised names until their exemption expires.
+type caseExemptions struct {
+	lock    sync.Mutex
+	servers map[string]time.Time
+}
+
+func newCaseExemptions() *caseExemptions {
+	return &caseExemptions{servers: make(map[string]time.Time)}
+}
+
+func (e *caseExemptions) exempt(addr string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	expires, found := e.servers[addr]
+	if found && time.Now().After(expires) {
+		delete(e.servers, addr)
+		return false
+	}
+	return found
+}
+
+func (e *caseExemptions) add(addr string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.servers[addr] = time.Now().Add(QNameCaseExemptionPeriod)
+}
+
+//---
+
+// randomiseCase returns a copy of m with the case of each letter in its QName randomly flipped.
+// See https://datatracker.ietf.org/doc/html/draft-vixie-dnsext-dns0x20-00
+// Only the question is replaced, so the copy is shallow; m itself is never modified.
+func randomiseCase(m *dns.Msg) *dns.Msg {
+	name := []byte(m.Question[0].Name)
+
+	var bits uint64
+	for i, c := range name {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') {
+			if bits&1 == 1 {
+				name[i] = c ^ 0x20
+			}
+		}
+		bits >>= 1
+	}
+
+	randomised := *m
+	randomised.Question = []dns.Question{m.Question[0]}
+	randomised.Question[0].Name = string(name)
+	return &randomised
+}
+
+// checkCase confirms the question in response r exactly matches that in the randomised query sent.
+// nonPreserving is true if the mismatch looks like the nameserver rewriting the name, rather than a spoofed answer.
+// That's only to be trusted over TCP; an off-path spoofer that can't see the case sent will send it the same way.
+func checkCase(sent, r *dns.Msg) (nonPreserving bool, err error) {
+	name := sent.Question[0].Name
+	if len(r.Question) == 0 {
+		return false, fmt.Errorf("%w: sent [%s], got no question", ErrQNameCaseMismatch, name)
+	}
+
+	got := r.Question[0].Name
+	if got == name {
+		return false, nil
+	}
+
+	err = fmt.Errorf("%w: sent [%s], got [%s]", ErrQNameCaseMismatch, name, got)
+	if !strings.EqualFold(got, name) {
+		return false, err
+	}
+
+	// Names which are consistently lower, or upper, case come from the nameserver; a spoofer would be guessing.
+	return got == strings.ToLower(name) || got == strings.ToUpper(name), err
+}
+
+// restoreCase puts the original QName back into r, both in its question and as the owner of any records,
+// so the randomised name, or the nameserver's rewriting of it, doesn't leak out to clients.
+func restoreCase(original, sent, r *dns.Msg) {
+	name := original.Question[0].Name
+	randomised := sent.Question[0].Name
+
+	if len(r.Question) > 0 {
+		r.Question[0].Name = name
+	}
+	for _, section := range [][]dns.RR{r.Answer, r.Ns, r.Extra} {
+		for _, rr := range section {
+			if strings.EqualFold(rr.Header().Name, randomised) {
+				rr.Header().Name = name
+			}
+		}
+	}
+}
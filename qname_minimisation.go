@@ -0,0 +1,118 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+type QNameMinimisationMode uint8
+
+const (
+	// QNameMinimisationOff sends the full QName to every zone.
+	QNameMinimisationOff QNameMinimisationMode = iota
+
+	// QNameMinimisationRelaxed falls back to sending the full QName when a zone's nameservers respond to a
+	// minimised query with an error, or NXDOMAIN. Some nameservers wrongly return NXDOMAIN for empty non-terminals.
+	QNameMinimisationRelaxed
+
+	// QNameMinimisationStrict never falls back to sending the full QName. Errors, and NXDOMAIN, are returned as-is.
+	QNameMinimisationStrict
+)
+
+func (m QNameMinimisationMode) String() string {
+	switch m {
+	case QNameMinimisationRelaxed:
+		return "Relaxed"
+	case QNameMinimisationStrict:
+		return "Strict"
+	default:
+		return "Off"
+	}
+}
+
+// minimisedQuery returns the query to send to the zone expected to know about d.current(), when QName minimisation
+// is enabled. nil is returned when the full QName should be sent, including when we've reached the QName itself.
+func minimisedQuery(d *domain, qmsg *dns.Msg) *dns.Msg {
+	if QNameMinimisation == QNameMinimisationOff || d.last() {
+		return nil
+	}
+
+	mmsg := qmsg.Copy()
+	mmsg.Question[0].Name = d.current()
+	mmsg.Question[0].Qtype = QNameMinimisationQType
+	return mmsg
+}
+
+// resolveMinimised sends the minimised query mmsg to z. If the response can't be used, and we're in relaxed mode,
+// handled is false, and the caller should fallback to sending the full QName.
+// Otherwise, the results are as per resolveLabel(): the zone to ask about the next label; or the final response.
+func (resolver *Resolver) resolveMinimised(ctx context.Context, z zone, qmsg, mmsg *dns.Msg, auth *authenticator) (next zone, response *Response, handled bool) {
+	strict := QNameMinimisation == QNameMinimisationStrict
+
+	response = z.exchange(ctx, mmsg)
+
+	if response.HasError() || response.IsEmpty() {
+		if strict {
+			if !response.HasError() {
+				response = newResponseError(fmt.Errorf("%w - without an error. mysterious", ErrEmptyResponse))
+			}
+			return nil, response, true
+		}
+		Debug(fmt.Sprintf("falling back to the full qname for [%s] in zone [%s] after error: %v", qmsg.Question[0].Name, z.name(), response.Err))
+		return nil, nil, false
+	}
+
+	rmsg := response.Msg
+
+	switch {
+	case rmsg.Rcode == dns.RcodeNameError:
+		if !strict {
+			Debug(fmt.Sprintf("falling back to the full qname for [%s] in zone [%s] after NXDOMAIN for [%s]", qmsg.Question[0].Name, z.name(), mmsg.Question[0].Name))
+			return nil, nil, false
+		}
+
+		// Nothing can exist below a name that doesn't exist (RFC 8020); so neither does the QName.
+		if auth != nil {
+			auth.addResponse(z, rmsg)
+		}
+		rmsg.Question = qmsg.Question
+		return nil, resolver.funcs.finaliseResponse(ctx, auth, qmsg, response), true
+
+	case rmsg.Rcode != dns.RcodeSuccess:
+		if strict {
+			return nil, resolver.funcs.finaliseResponse(ctx, auth, qmsg, response), true
+		}
+		Debug(fmt.Sprintf("falling back to the full qname for [%s] in zone [%s] after %s", qmsg.Question[0].Name, z.name(), RcodeToString(rmsg.Rcode)))
+		return nil, nil, false
+
+	case len(rmsg.Answer) == 0 && recordsOfTypeExist(rmsg.Ns, dns.TypeNS) && !recordsOfTypeExist(rmsg.Ns, dns.TypeSOA):
+		// A delegation to the next zone.
+		if auth != nil {
+			auth.addResponse(z, rmsg)
+		}
+		next, response = resolver.funcs.processDelegation(ctx, z, rmsg)
+		return next, response, true
+
+	case recordsOfTypeExist(rmsg.Answer, dns.TypeCNAME):
+		// The name is an alias, so can't be the parent of anything. The zone's nameservers are authoritative for it,
+		// so asking them the full question discloses nothing further about the QName's position.
+		return nil, nil, false
+	}
+
+	// The name exists, but there's no zone cut at it. Unless its SOA was returned, then it's a zone apex served by
+	// the same nameservers as its parent.
+	name := mmsg.Question[0].Name
+	for _, soa := range extractRecords[*dns.SOA](append(rmsg.Answer, rmsg.Ns...)) {
+		if canonicalName(soa.Header().Name) == name && name != z.name() {
+			newZone := z.clone(name, z.name())
+			if auth != nil {
+				auth.addDelegationSignerLink(z, newZone.name())
+			}
+			resolver.zones.add(newZone)
+			return newZone, nil, true
+		}
+	}
+
+	return z, nil, true
+}
@@ -0,0 +1,293 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// qminTestZones is a small hierarchy of mock zones: root -> com. -> example.com.
+// Each zone records the questions it's asked. Only the root is known to the resolver at the start.
+type qminTestZones struct {
+	lock  sync.Mutex
+	zones map[string]zone
+	known map[string]zone
+	asked map[string][]dns.Question
+
+	// handlers answer the questions sent to example.com. and its children, by name.
+	handlers map[string]func(q dns.Question) *dns.Msg
+}
+
+func newQminTestZones() *qminTestZones {
+	hz := &qminTestZones{
+		zones:    make(map[string]zone),
+		known:    make(map[string]zone),
+		asked:    make(map[string][]dns.Question),
+		handlers: make(map[string]func(q dns.Question) *dns.Msg),
+	}
+	delegate := func(child string) func(q dns.Question) *dns.Msg {
+		return func(q dns.Question) *dns.Msg {
+			m := new(dns.Msg)
+			m.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: child, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1." + child}}
+			return m
+		}
+	}
+	hz.add(hz.zone(".", "", delegate("com.")))
+	hz.zone("com.", ".", delegate("example.com."))
+	hz.zone("example.com.", "com.", nil)
+	return hz
+}
+
+func (hz *qminTestZones) zone(name, parent string, handler func(q dns.Question) *dns.Msg) zone {
+	z := &mockZone{
+		mockName:   func() string { return name },
+		mockParent: func() string { return parent },
+		mockSoa:    func(ctx context.Context, name string) (*dns.SOA, error) { return nil, nil },
+	}
+	z.mockClone = func(child, parent string) zone {
+		return hz.zone(child, parent, nil)
+	}
+	z.mockExchange = func(ctx context.Context, m *dns.Msg) *Response {
+		hz.lock.Lock()
+		hz.asked[name] = append(hz.asked[name], m.Question[0])
+		h := handler
+		if h == nil {
+			h = hz.handlers[m.Question[0].Name]
+		}
+		hz.lock.Unlock()
+
+		rmsg := h(m.Question[0])
+		rcode := rmsg.Rcode
+		rmsg.SetReply(m)
+		rmsg.Rcode = rcode
+		return &Response{Msg: rmsg}
+	}
+
+	hz.lock.Lock()
+	defer hz.lock.Unlock()
+	hz.zones[name] = z
+	return z
+}
+
+func (hz *qminTestZones) add(z zone) {
+	hz.lock.Lock()
+	defer hz.lock.Unlock()
+	hz.known[z.name()] = z
+}
+
+func (hz *qminTestZones) get(name string) zone {
+	hz.lock.Lock()
+	defer hz.lock.Unlock()
+	return hz.known[name]
+}
+
+func (hz *qminTestZones) questions(zone string) []dns.Question {
+	hz.lock.Lock()
+	defer hz.lock.Unlock()
+	return hz.asked[zone]
+}
+
+func (hz *qminTestZones) resolver() *Resolver {
+	r := &Resolver{
+		zones: mockZoneStore{
+			mockZoneList: func(name string) []zone { return []zone{hz.get(".")} },
+			mockGet:      hz.get,
+			mockAdd:      hz.add,
+		},
+	}
+	r.funcs = resolverFunctions{
+		resolveLabel:         r.resolveLabel,
+		checkForMissingZones: r.checkForMissingZones,
+		finaliseResponse:     r.finaliseResponse,
+		processDelegation:    r.processDelegation,
+		createZone: func(ctx context.Context, name, parent string, nameservers []*dns.NS, extra []dns.RR, exchanger exchanger) (zone, error) {
+			hz.lock.Lock()
+			defer hz.lock.Unlock()
+			return hz.zones[name], nil
+		},
+		cname: func(ctx context.Context, qmsg *dns.Msg, r *Response, exchanger exchanger, cache *DNSCache) error {
+			return nil
+		},
+		getExchanger: r.getExchanger,
+	}
+	return r
+}
+
+func qminAnswer(q dns.Question) *dns.Msg {
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+	return m
+}
+
+func qminNoData(apex string) func(q dns.Question) *dns.Msg {
+	return func(q dns.Question) *dns.Msg {
+		m := new(dns.Msg)
+		m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1." + apex, Mbox: "hostmaster." + apex, Minttl: 300}}
+		return m
+	}
+}
+
+func qminNXDomain(q dns.Question) *dns.Msg {
+	m := qminNoData("example.com.")(q)
+	m.Rcode = dns.RcodeNameError
+	return m
+}
+
+func withQNameMinimisation(t *testing.T, mode QNameMinimisationMode) {
+	previous := QNameMinimisation
+	QNameMinimisation = mode
+	t.Cleanup(func() { QNameMinimisation = previous })
+}
+
+func qminQuery() *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion("a.b.example.com.", dns.TypeAAAA)
+	return q
+}
+
+func TestResolver_QNameMinimisation(t *testing.T) {
+	// Setup - b.example.com. is an empty non-terminal.
+	withQNameMinimisation(t, QNameMinimisationRelaxed)
+	hz := newQminTestZones()
+	hz.handlers["b.example.com."] = qminNoData("example.com.")
+	hz.handlers["a.b.example.com."] = qminAnswer
+
+	// Execute
+	response := hz.resolver().exchange(context.Background(), qminQuery())
+
+	// Assertions - each zone only sees the next label, until the QName's own zone is reached.
+	require.NoError(t, response.Err)
+	assert.Len(t, response.Msg.Answer, 1)
+	assert.Equal(t, []dns.Question{{Name: "com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, hz.questions("."))
+	assert.Equal(t, []dns.Question{{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}, hz.questions("com."))
+	assert.Equal(t, []dns.Question{
+		{Name: "b.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		{Name: "a.b.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET},
+	}, hz.questions("example.com."))
+}
+
+func TestResolver_QNameMinimisation_Off(t *testing.T) {
+	// Setup
+	withQNameMinimisation(t, QNameMinimisationOff)
+	hz := newQminTestZones()
+	hz.handlers["a.b.example.com."] = qminAnswer
+
+	// Execute
+	response := hz.resolver().exchange(context.Background(), qminQuery())
+
+	// Assertions
+	require.NoError(t, response.Err)
+	full := dns.Question{Name: "a.b.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	assert.Equal(t, []dns.Question{full}, hz.questions("."))
+	assert.Equal(t, []dns.Question{full}, hz.questions("com."))
+	assert.Equal(t, []dns.Question{full}, hz.questions("example.com."))
+}
+
+func TestResolver_QNameMinimisation_NXDomain(t *testing.T) {
+	// Setup - the nameservers wrongly return NXDOMAIN for the empty non-terminal.
+	newZones := func() *qminTestZones {
+		hz := newQminTestZones()
+		hz.handlers["b.example.com."] = qminNXDomain
+		hz.handlers["a.b.example.com."] = qminAnswer
+		return hz
+	}
+
+	t.Run("relaxed falls back to the full name", func(t *testing.T) {
+		withQNameMinimisation(t, QNameMinimisationRelaxed)
+		hz := newZones()
+
+		// Execute
+		response := hz.resolver().exchange(context.Background(), qminQuery())
+
+		// Assertions
+		require.NoError(t, response.Err)
+		assert.Equal(t, dns.RcodeSuccess, response.Msg.Rcode)
+		assert.Len(t, response.Msg.Answer, 1)
+		assert.Len(t, hz.questions("example.com."), 2)
+	})
+
+	t.Run("strict returns the NXDOMAIN", func(t *testing.T) {
+		withQNameMinimisation(t, QNameMinimisationStrict)
+		hz := newZones()
+
+		// Execute
+		response := hz.resolver().exchange(context.Background(), qminQuery())
+
+		// Assertions
+		require.NoError(t, response.Err)
+		assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+		assert.Equal(t, "a.b.example.com.", response.Msg.Question[0].Name)
+		assert.Len(t, hz.questions("example.com."), 1)
+	})
+}
+
+func TestResolver_QNameMinimisation_ServerFailure(t *testing.T) {
+	// Setup
+	newZones := func() *qminTestZones {
+		hz := newQminTestZones()
+		hz.handlers["b.example.com."] = func(q dns.Question) *dns.Msg {
+			m := new(dns.Msg)
+			m.Rcode = dns.RcodeServerFailure
+			return m
+		}
+		hz.handlers["a.b.example.com."] = qminAnswer
+		return hz
+	}
+
+	t.Run("relaxed", func(t *testing.T) {
+		withQNameMinimisation(t, QNameMinimisationRelaxed)
+		response := newZones().resolver().exchange(context.Background(), qminQuery())
+		require.NoError(t, response.Err)
+		assert.Len(t, response.Msg.Answer, 1)
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		withQNameMinimisation(t, QNameMinimisationStrict)
+		response := newZones().resolver().exchange(context.Background(), qminQuery())
+		assert.Error(t, response.Err)
+	})
+}
+
+func TestResolver_QNameMinimisation_CNAME(t *testing.T) {
+	// Setup - b.example.com. is an alias, so a.b.example.com. can't exist beneath it.
+	withQNameMinimisation(t, QNameMinimisationStrict)
+	hz := newQminTestZones()
+	hz.handlers["b.example.com."] = func(q dns.Question) *dns.Msg {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "www.example.net."}}
+		return m
+	}
+	hz.handlers["a.b.example.com."] = qminNXDomain
+
+	// Execute
+	response := hz.resolver().exchange(context.Background(), qminQuery())
+
+	// Assertions - the full question is asked of the same zone, even in strict mode.
+	require.NoError(t, response.Err)
+	assert.Equal(t, dns.RcodeNameError, response.Msg.Rcode)
+	questions := hz.questions("example.com.")
+	require.Len(t, questions, 2)
+	assert.Equal(t, "a.b.example.com.", questions[1].Name)
+}
+
+func TestResolver_QNameMinimisation_ZoneCutWithoutDelegation(t *testing.T) {
+	// Setup - b.example.com. is its own zone, but served by the same nameservers as example.com.
+	withQNameMinimisation(t, QNameMinimisationRelaxed)
+	hz := newQminTestZones()
+	hz.handlers["b.example.com."] = qminNoData("b.example.com.")
+	hz.handlers["a.b.example.com."] = qminAnswer
+
+	// Execute
+	response := hz.resolver().exchange(context.Background(), qminQuery())
+
+	// Assertions - the final question goes to the new zone.
+	require.NoError(t, response.Err)
+	assert.Len(t, response.Msg.Answer, 1)
+	assert.Len(t, hz.questions("example.com."), 1)
+	assert.Equal(t, []dns.Question{{Name: "a.b.example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}}, hz.questions("b.example.com."))
+}
@@ -10,6 +10,12 @@ type Resolver struct {
 	zones zoneStore
 	funcs resolverFunctions
 	cache *DNSCache
+
+	// nsec holds the validated NSEC and NSEC3 records for AggressiveNSEC.
+	nsec *nsecCache
+
+	// nameservers holds what's been learnt about the nameservers queried.
+	nameservers *nameserverState
 }
 
 // The core, top level, resolving functions. They're defined as variables to aid overriding them for testing.
@@ -38,8 +44,10 @@ func NewResolver(cache *DNSCache) *Resolver {
 	})
 
 	resolver := &Resolver{
-		zones: z,
-		cache: cache,
+		zones:       z,
+		cache:       cache,
+		nsec:        newNSECCache(),
+		nameservers: newNameserverState(),
 	}
 
 	// When not testing, we point to the concrete instances of the functions.
@@ -38,6 +38,8 @@ func (resolver *Resolver) exchange(ctx context.Context, qmsg *dns.Msg) *Response
 		ctx = context.WithValue(ctx, ctxStartTime, start)
 	}
 
+	ctx = withNameserverState(ctx, resolver.nameservers)
+
 	//---
 
 	trace, ok := ctx.Value(CtxTrace).(*Trace)
@@ -60,6 +62,21 @@ func (resolver *Resolver) exchange(ctx context.Context, qmsg *dns.Msg) *Response
 		ctx = context.WithValue(ctx, ctxSessionQueries, counter)
 	}
 
+	//----------------------------------------------------------------------------
+	// We determine what zones we already know about for the QName
+
+	// Returns a list zones that make up the QName that we already have nameservers for.
+	// Items are only included is we have a valid chain from leaf to root.
+	// They are ordered most specific (i.e. longest FQDN), to shortest.
+	// The last element will always be the root (.).
+	knownZones := resolver.zones.getZoneList(qmsg.Question[0].Name)
+
+	// If the most specific zone has already proven the answer doesn't exist, we don't need to ask it again.
+	if response := resolver.nsec.synthesise(qmsg, knownZones[0].name()); response != nil {
+		response.Duration = time.Since(start)
+		return response
+	}
+
 	//----------------------------------------------------------------------------
 	// We setup the DNSSEC Authenticator
 
@@ -70,15 +87,6 @@ func (resolver *Resolver) exchange(ctx context.Context, qmsg *dns.Msg) *Response
 		defer auth.close()
 	}
 
-	//----------------------------------------------------------------------------
-	// We determine what zones we already know about for the QName
-
-	// Returns a list zones that make up the QName that we already have nameservers for.
-	// Items are only included is we have a valid chain from leaf to root.
-	// They are ordered most specific (i.e. longest FQDN), to shortest.
-	// The last element will always be the root (.).
-	knownZones := resolver.zones.getZoneList(qmsg.Question[0].Name)
-
 	if auth != nil {
 		// Lookup the DNSSEC details for these zones.
 		// We don't do this lookup for the root, thus len()-1.
@@ -141,6 +149,13 @@ func (resolver *Resolver) resolveLabel(ctx context.Context, d *domain, z zone, q
 		go z.dnskeys(ctx)
 	}
 
+	// With QName minimisation, the zone is only asked about the next label; unless we need to fall back.
+	if mmsg := minimisedQuery(d, qmsg); mmsg != nil {
+		if next, response, handled := resolver.resolveMinimised(ctx, z, qmsg, mmsg, auth); handled {
+			return next, response
+		}
+	}
+
 	response := z.exchange(ctx, qmsg)
 
 	if response.HasError() {
@@ -308,6 +323,9 @@ func (resolver *Resolver) finaliseResponse(ctx context.Context, auth *authentica
 					rr.Header().Ttl = min(rtypeTTL.ttl, rr.Header().Ttl)
 				}
 			}
+
+			// Keep any NSEC, or NSEC3, records proving the answer, for AggressiveNSEC.
+			resolver.nsec.add(response.Msg, response.Doe)
 		}
 	}
 
@@ -373,10 +391,15 @@ func (resolver *Resolver) finaliseResponse(ctx context.Context, auth *authentica
 			if response.Auth == dnssec.Bogus {
 				response.Msg.Rcode = dns.RcodeServerFailure
 				if SuppressBogusResponseSections {
+					opt := response.Msg.IsEdns0()
 					response.Msg.Answer = []dns.RR{}
 					response.Msg.Ns = []dns.RR{}
 					response.Msg.Extra = []dns.RR{}
+					if opt != nil {
+						response.Msg.Extra = []dns.RR{opt}
+					}
 				}
+				setExtendedError(response.Msg, extendedError(response.Err, response.Auth))
 			}
 		}
 	}
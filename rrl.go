@@ -0,0 +1,234 @@
+package resolver
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type rrlResponseType uint8
+
+const (
+	rrlResponse rrlResponseType = iota
+	rrlNXDomain
+	rrlError
+)
+
+func (t rrlResponseType) String() string {
+	switch t {
+	case rrlNXDomain:
+		return "nxdomains"
+	case rrlError:
+		return "errors"
+	default:
+		return "responses"
+	}
+}
+
+type rrlAction uint8
+
+const (
+	rrlSend rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// rateLimiter implements Response Rate Limiting. Each bucket holds at most one second's worth of responses, and can
+// go into debt of up to Window's worth. A client that keeps sending queries therefore stays limited, and one that
+// stops is let back in once its debt has been repaid.
+type rateLimiter struct {
+	config RateLimitConfig
+	now    func() time.Time
+
+	// buckets holds up to MaxTableSize buckets; lru orders them by when they were last updated, most recent first.
+	lock    sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type rrlBucket struct {
+	key     string
+	balance float64
+	updated time.Time
+	// dropped counts the responses dropped since the last truncated reply was sent.
+	dropped int
+	limited bool
+}
+
+// newRateLimiter returns nil when rate limiting is disabled.
+func newRateLimiter(config RateLimitConfig) *rateLimiter {
+	if config.ResponsesPerSecond <= 0 {
+		return nil
+	}
+
+	if config.NXDomainsPerSecond <= 0 {
+		config.NXDomainsPerSecond = config.ResponsesPerSecond
+	}
+	if config.ErrorsPerSecond <= 0 {
+		config.ErrorsPerSecond = config.ResponsesPerSecond
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultRRLWindow
+	}
+	if config.Slip == 0 {
+		config.Slip = DefaultRRLSlip
+	}
+	if config.IPv4PrefixLength <= 0 || config.IPv4PrefixLength > 32 {
+		config.IPv4PrefixLength = DefaultRRLIPv4PrefixLength
+	}
+	if config.IPv6PrefixLength <= 0 || config.IPv6PrefixLength > 128 {
+		config.IPv6PrefixLength = DefaultRRLIPv6PrefixLength
+	}
+	if config.MaxTableSize <= 0 {
+		config.MaxTableSize = DefaultRRLMaxTableSize
+	}
+
+	return &rateLimiter{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// check accounts for response m being sent to client, and returns what should be done with it.
+func (l *rateLimiter) check(client net.IP, m *dns.Msg) rrlAction {
+	responseType := rrlTypeOf(m)
+	rate := float64(l.rate(responseType))
+
+	qname := rrlName(m, responseType)
+	prefix := l.prefix(client)
+	key := prefix + "|" + responseType.String() + "|" + qname
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	var bucket *rrlBucket
+	if element, ok := l.buckets[key]; ok {
+		bucket = element.Value.(*rrlBucket)
+		l.lru.MoveToFront(element)
+	} else {
+		bucket = &rrlBucket{key: key, balance: rate, updated: now}
+		l.buckets[key] = l.lru.PushFront(bucket)
+
+		// Once the table is full, the buckets updated longest ago make way.
+		for l.lru.Len() > l.config.MaxTableSize {
+			l.remove(l.lru.Back())
+		}
+	}
+
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.updated = now
+	bucket.balance = min(bucket.balance+elapsed*rate, rate) - 1
+	bucket.balance = max(bucket.balance, -rate*l.config.Window.Seconds())
+
+	if bucket.balance >= 0 {
+		bucket.limited = false
+		bucket.dropped = 0
+		return rrlSend
+	}
+
+	if !bucket.limited {
+		bucket.limited = true
+		if l.config.LogOnly {
+			Info(fmt.Sprintf("rrl: would limit %s to %s for %s", responseType, prefix, qname))
+		} else {
+			Info(fmt.Sprintf("rrl: limiting %s to %s for %s", responseType, prefix, qname))
+		}
+	}
+
+	if l.config.LogOnly {
+		return rrlSend
+	}
+
+	bucket.dropped++
+	if l.config.Slip > 0 && bucket.dropped >= l.config.Slip {
+		bucket.dropped = 0
+		return rrlSlip
+	}
+	return rrlDrop
+}
+
+// prune removes the buckets that have been idle long enough to have fully recovered. l.lock must be held.
+func (l *rateLimiter) prune(now time.Time) {
+	idle := l.config.Window + time.Second
+	for element := l.lru.Back(); element != nil; element = l.lru.Back() {
+		if now.Sub(element.Value.(*rrlBucket).updated) < idle {
+			return
+		}
+		l.remove(element)
+	}
+}
+
+// remove drops the bucket held in element. l.lock must be held.
+func (l *rateLimiter) remove(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.buckets, element.Value.(*rrlBucket).key)
+}
+
+func (l *rateLimiter) rate(t rrlResponseType) int {
+	switch t {
+	case rrlNXDomain:
+		return l.config.NXDomainsPerSecond
+	case rrlError:
+		return l.config.ErrorsPerSecond
+	default:
+		return l.config.ResponsesPerSecond
+	}
+}
+
+// prefix returns the network, in CIDR notation, that client is grouped into.
+func (l *rateLimiter) prefix(client net.IP) string {
+	if ip4 := client.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.config.IPv4PrefixLength, 32)).String() + "/" + strconv.Itoa(l.config.IPv4PrefixLength)
+	}
+	return client.Mask(net.CIDRMask(l.config.IPv6PrefixLength, 128)).String() + "/" + strconv.Itoa(l.config.IPv6PrefixLength)
+}
+
+// rrlName returns the name response m is counted against. Answers are counted against their query name. As in BIND,
+// NXDOMAIN and error responses are counted against their zone, taken from the SOA record in the authority section,
+// so a flood of queries for random names within a zone share one bucket; those without an SOA record all share one.
+func rrlName(m *dns.Msg, t rrlResponseType) string {
+	if t == rrlResponse {
+		if len(m.Question) > 0 {
+			return strings.ToLower(m.Question[0].Name)
+		}
+		return ""
+	}
+
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return strings.ToLower(soa.Hdr.Name)
+		}
+	}
+	return ""
+}
+
+func rrlTypeOf(m *dns.Msg) rrlResponseType {
+	switch m.Rcode {
+	case dns.RcodeSuccess:
+		return rrlResponse
+	case dns.RcodeNameError:
+		return rrlNXDomain
+	default:
+		return rrlError
+	}
+}
+
+// slipReply returns an empty, truncated, reply to r, prompting a genuine client to retry over TCP.
+func slipReply(r *dns.Msg, m *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+	reply.Rcode = m.Rcode
+	reply.RecursionAvailable = m.RecursionAvailable
+	reply.Truncated = true
+	return reply
+}
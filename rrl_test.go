@@ -0,0 +1,229 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRateLimiter returns a limiter with a clock that only moves when the test moves it.
+func newTestRateLimiter(config RateLimitConfig) (*rateLimiter, *time.Time) {
+	l := newRateLimiter(config)
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time {
+		return now
+	}
+	return l, &now
+}
+
+func rrlTestResponse(qname string, rcode int) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(qname, dns.TypeA)
+	m := new(dns.Msg)
+	m.SetRcode(q, rcode)
+	return m
+}
+
+func TestNewRateLimiter_Defaults(t *testing.T) {
+	assert.Nil(t, newRateLimiter(RateLimitConfig{}))
+
+	l := newRateLimiter(RateLimitConfig{ResponsesPerSecond: 5})
+	require.NotNil(t, l)
+	assert.Equal(t, 5, l.config.NXDomainsPerSecond)
+	assert.Equal(t, 5, l.config.ErrorsPerSecond)
+	assert.Equal(t, DefaultRRLWindow, l.config.Window)
+	assert.Equal(t, DefaultRRLSlip, l.config.Slip)
+	assert.Equal(t, DefaultRRLIPv4PrefixLength, l.config.IPv4PrefixLength)
+	assert.Equal(t, DefaultRRLIPv6PrefixLength, l.config.IPv6PrefixLength)
+	assert.Equal(t, DefaultRRLMaxTableSize, l.config.MaxTableSize)
+}
+
+func TestRateLimiter_LimitsAndSlips(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 2, Slip: 2})
+	client := net.ParseIP("192.0.2.1")
+	m := rrlTestResponse("example.com.", dns.RcodeSuccess)
+
+	// Execute
+	var actions []rrlAction
+	for i := 0; i < 6; i++ {
+		actions = append(actions, l.check(client, m))
+	}
+
+	// Assertions
+	assert.Equal(t, []rrlAction{rrlSend, rrlSend, rrlDrop, rrlSlip, rrlDrop, rrlSlip}, actions)
+}
+
+func TestRateLimiter_NoSlip(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: -1})
+	client := net.ParseIP("192.0.2.1")
+	m := rrlTestResponse("example.com.", dns.RcodeSuccess)
+
+	// Execute & Assertions
+	assert.Equal(t, rrlSend, l.check(client, m))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, rrlDrop, l.check(client, m))
+	}
+}
+
+func TestRateLimiter_BucketKeys(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: -1})
+	m := rrlTestResponse("example.com.", dns.RcodeSuccess)
+
+	// Execute & Assertions
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("192.0.2.1"), m))
+
+	// Same /24, and the same name in a different case, share the bucket.
+	assert.Equal(t, rrlDrop, l.check(net.ParseIP("192.0.2.200"), m))
+	assert.Equal(t, rrlDrop, l.check(net.ParseIP("192.0.2.1"), rrlTestResponse("EXAMPLE.com.", dns.RcodeSuccess)))
+
+	// A different prefix, name, or type of response each have their own.
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("192.0.3.1"), m))
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("192.0.2.1"), rrlTestResponse("example.net.", dns.RcodeSuccess)))
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("192.0.2.1"), rrlTestResponse("example.com.", dns.RcodeNameError)))
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("192.0.2.1"), rrlTestResponse("example.com.", dns.RcodeServerFailure)))
+
+	// IPv6 clients are grouped by /56.
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("2001:db8:0:100::1"), m))
+	assert.Equal(t, rrlDrop, l.check(net.ParseIP("2001:db8:0:1ff::1"), m))
+	assert.Equal(t, rrlSend, l.check(net.ParseIP("2001:db8:0:200::1"), m))
+}
+
+func TestRateLimiter_NXDomainsShareTheirZonesBucket(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: -1})
+	client := net.ParseIP("192.0.2.1")
+	nxdomain := func(qname, zone string) *dns.Msg {
+		m := rrlTestResponse(qname, dns.RcodeNameError)
+		m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300}, Minttl: 60}}
+		return m
+	}
+
+	// Execute & Assertions - random names within a zone are counted against the zone...
+	assert.Equal(t, rrlSend, l.check(client, nxdomain("a1.example.com.", "example.com.")))
+	assert.Equal(t, rrlDrop, l.check(client, nxdomain("b2.example.com.", "EXAMPLE.com.")))
+	assert.Equal(t, rrlSend, l.check(client, nxdomain("a1.example.net.", "example.net.")))
+
+	// ...and errors without a zone all share one bucket.
+	assert.Equal(t, rrlSend, l.check(client, rrlTestResponse("a1.example.org.", dns.RcodeServerFailure)))
+	assert.Equal(t, rrlDrop, l.check(client, rrlTestResponse("b2.example.org.", dns.RcodeServerFailure)))
+	assert.Len(t, l.buckets, 3)
+}
+
+func TestRateLimiter_MaxTableSize(t *testing.T) {
+	// Setup
+	l, now := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: -1, MaxTableSize: 2})
+	client := net.ParseIP("192.0.2.1")
+
+	// Execute
+	for _, qname := range []string{"one.example.com.", "two.example.com.", "three.example.com."} {
+		l.check(client, rrlTestResponse(qname, dns.RcodeSuccess))
+		*now = now.Add(time.Millisecond)
+	}
+
+	// Assertions - the oldest bucket has made way.
+	require.Len(t, l.buckets, 2)
+	assert.NotContains(t, l.buckets, "192.0.2.0/24|responses|one.example.com.")
+	assert.Equal(t, rrlSend, l.check(client, rrlTestResponse("one.example.com.", dns.RcodeSuccess)))
+	assert.Equal(t, rrlDrop, l.check(client, rrlTestResponse("three.example.com.", dns.RcodeSuccess)))
+}
+
+func TestRateLimiter_PerTypeRates(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 5, NXDomainsPerSecond: 1, Slip: -1})
+	client := net.ParseIP("192.0.2.1")
+	m := rrlTestResponse("example.com.", dns.RcodeNameError)
+
+	// Execute & Assertions
+	assert.Equal(t, rrlSend, l.check(client, m))
+	assert.Equal(t, rrlDrop, l.check(client, m))
+}
+
+func TestRateLimiter_RecoversAfterWindow(t *testing.T) {
+	// Setup
+	l, now := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 10, Window: 5 * time.Second, Slip: -1})
+	client := net.ParseIP("192.0.2.1")
+	m := rrlTestResponse("example.com.", dns.RcodeSuccess)
+
+	// A flood builds up the maximum debt.
+	for i := 0; i < 1000; i++ {
+		l.check(client, m)
+	}
+
+	// Execute & Assertions - still limited part way through the window...
+	*now = now.Add(4 * time.Second)
+	assert.Equal(t, rrlDrop, l.check(client, m))
+
+	// ...and let back in once the debt has been repaid.
+	*now = now.Add(6 * time.Second)
+	assert.Equal(t, rrlSend, l.check(client, m))
+}
+
+func TestRateLimiter_PrunesIdleBuckets(t *testing.T) {
+	// Setup
+	l, now := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Window: 5 * time.Second})
+	l.check(net.ParseIP("192.0.2.1"), rrlTestResponse("example.com.", dns.RcodeSuccess))
+	require.Len(t, l.buckets, 1)
+
+	// Execute
+	*now = now.Add(10 * time.Second)
+	l.check(net.ParseIP("192.0.3.1"), rrlTestResponse("example.com.", dns.RcodeSuccess))
+
+	// Assertions
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestRateLimiter_LogOnly(t *testing.T) {
+	// Setup
+	l, _ := newTestRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, LogOnly: true})
+	client := net.ParseIP("192.0.2.1")
+	m := rrlTestResponse("example.com.", dns.RcodeSuccess)
+
+	var logged []string
+	original := Info
+	Info = func(s string) { logged = append(logged, s) }
+	defer func() { Info = original }()
+
+	// Execute & Assertions
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, rrlSend, l.check(client, m))
+	}
+	assert.Equal(t, []string{"rrl: would limit responses to 192.0.2.0/24 for example.com."}, logged)
+}
+
+func TestServer_WriteMsg_RateLimitsPlainUDPOnly(t *testing.T) {
+	// Setup
+	s := &Server{rrl: newRateLimiter(RateLimitConfig{ResponsesPerSecond: 1, Slip: 2})}
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	answer := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(q)
+		m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, 1)}}
+		return m
+	}
+
+	// Execute & Assertions - over UDP the first is answered, the second dropped, and the third slips.
+	w := newMockUDPResponseWriter()
+	require.NoError(t, s.writeMsg(w, q, answer()))
+	require.NoError(t, s.writeMsg(w, q, answer()))
+	require.NoError(t, s.writeMsg(w, q, answer()))
+	require.Len(t, w.msgs, 2)
+	assert.Len(t, w.msgs[0].Answer, 1)
+	assert.True(t, w.msgs[1].Truncated)
+	assert.Empty(t, w.msgs[1].Answer)
+
+	// TCP can't be spoofed, so isn't limited.
+	w = newMockTCPResponseWriter()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, s.writeMsg(w, q, answer()))
+	}
+	assert.Len(t, w.msgs, 3)
+}
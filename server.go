@@ -2,16 +2,19 @@ package resolver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"github.com/miekg/dns"
 	"github.com/nsmithuk/resolver/dnssec"
 	"hash/fnv"
-	"strconv"
-	"strings"
+	"net"
+	"net/netip"
+	"sort"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
-	"container/list"
 )
 
 type Server struct {
@@ -19,19 +22,66 @@ type Server struct {
 	cache           *DNSCache
 	workers         int
 	queries         chan queryRequest
-	prefetch        *prefetchManager
+	prefetch        *prefetcher
 	dnssecValidator *dnssec.Authenticator
+	config          Config
+	rrl             *rateLimiter
+	cookies         *serverCookies
+
+	// flights coalesces identical queries being resolved.
+	flights flightGroup[serverResolution]
+
+	// stats counts how the workers are keeping up with the queries queued for them.
+	stats serverStats
+
+	// ctx is cancelled by Shutdown, stopping all background goroutines.
+	ctx          context.Context
+	cancel       context.CancelFunc
+	workerWG     sync.WaitGroup
+	backgroundWG sync.WaitGroup
+
+	// queriesLock guards queries being closed by Shutdown.
+	queriesLock   sync.RWMutex
+	queriesClosed bool
+
+	listenersLock sync.Mutex
+	shutdown      bool
+	listening     bool
+	serving       bool
+	dnsServers    []*dns.Server
+	dohServer     *http.Server
+	dohListener   net.Listener
+	doqServer     *doqServer
 }
 
 type queryRequest struct {
-	w dns.ResponseWriter
-	r *dns.Msg
+	w    dns.ResponseWriter
+	r    *dns.Msg
+	done chan struct{}
+	// queued is when the query was queued.
+	queued time.Time
 }
 
 type DNSCache struct {
 	shards    [32]*cacheShard
 	maxSize   int
 	stats     CacheStats
+
+	// maxBytes is the memory budget of the cached entries, as estimated by entrySize; unlimited when 0. eviction
+	// chooses the entries evicted once either it, or maxSize, is reached.
+	maxBytes int64
+	eviction EvictionPolicy
+
+	// staleWindow is how long entries are kept after they expire, to be served stale; failureRecheck is how long
+	// stale answers are served without trying to resolve again, after failing to.
+	staleWindow    time.Duration
+	failureRecheck time.Duration
+
+	// ttl bounds how long answers are cached for.
+	ttl ttlPolicy
+
+	// prefetch is offered each hit, to refresh popular entries before they expire; nil if prefetching is disabled.
+	prefetch *prefetcher
 }
 
 type CacheStats struct {
@@ -40,13 +90,40 @@ type CacheStats struct {
 	Evictions   uint64
 	Expired     uint64
 	Negative    uint64
+	Stale       uint64
+
+	// Policy is the eviction policy in use, and HitRate the fraction of lookups it's answered from the cache. A
+	// DNSCache's policy is fixed when it's created, so Hits, Misses and HitRate are all that policy's; policies are
+	// compared by the HitRate of caches using each.
+	Policy  EvictionPolicy
+	HitRate float64
+	// Bytes is the estimated memory used by the cached entries, and MaxBytes its budget; unlimited when 0.
+	Bytes    uint64
+	MaxBytes uint64
+	// Admitted and Rejected count the entries EvictionTinyLFU let into, or kept out of, its main cache.
+	Admitted uint64
+	Rejected uint64
+	// Prefetches counts the entries refreshed before they expired; PrefetchHits those then returned from the cache,
+	// and PrefetchWasted those evicted, or expired, without being. PrefetchDropped counts the refreshes skipped as
+	// the prefetch queue was full.
+	Prefetches      uint64
+	PrefetchHits    uint64
+	PrefetchWasted  uint64
+	PrefetchDropped uint64
 }
 
 type cacheShard struct {
 	mu       sync.RWMutex
 	items    map[string]*cacheEntry
-	lruList  *list.List
-	lruMap   map[string]*list.Element
+	policy   evictionPolicy
+	// bytes is the sum of the items' sizes.
+	bytes int64
+	// stats is the owning cache's, for counting the prefetched entries removed unused.
+	stats *CacheStats
+	// scopes counts the ECS variants cached for each question, by scope prefix length.
+	scopes map[string]map[int]int
+	// popularity estimates how often each entry has been returned, for the prefetcher; nil if it's disabled.
+	popularity *countMinSketch
 }
 
 type cacheEntry struct {
@@ -56,37 +133,53 @@ type cacheEntry struct {
 	key       string
 	isNegative bool
 	frequency uint32 // для LFU-like eviction
+	// size is the estimated memory used by the entry, in bytes.
+	size int64
+	// auth and doe are the DNSSEC state the answer was validated with.
+	auth dnssec.AuthenticationResult
+	doe  dnssec.DenialOfExistenceState
+	// baseKey and subnet are set on variants cached for the clients within an ECS scope.
+	baseKey string
+	subnet  netip.Prefix
+	// stale is when the entry can no longer be served stale; failed is when resolving a fresh answer last failed,
+	// in Unix nanoseconds.
+	stale  time.Time
+	failed atomic.Int64
+	// cached is when the entry was cached; its records' TTLs are decremented from then.
+	cached time.Time
+	// refreshing is set once the entry is queued to be prefetched; prefetched if it was cached by prefetching, until
+	// it's first returned from the cache.
+	refreshing bool
+	prefetched bool
 }
 
 func NewServer() *Server {
 	cache := &DNSCache{
 		maxSize: 10000, // максимальный размер кэша
+		ttl:     newTTLPolicy(CacheTTLConfig{}),
 	}
 	// Инициализируем шарды кэша
 	for i := range cache.shards {
-		cache.shards[i] = &cacheShard{
-			items:   make(map[string]*cacheEntry),
-			lruList: list.New(),
-			lruMap:  make(map[string]*list.Element),
-		}
+		cache.shards[i] = cache.newShard()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	s := &Server{
 		resolver:        NewResolver(cache),
 		cache:         cache,
-		workers:       10,
-		queries:       make(chan queryRequest, 100),
-		prefetch:      newPrefetchManager(cache, NewResolver(cache)),
+		workers:         DefaultWorkers,
+		queries:         make(chan queryRequest, DefaultQueueSize),
 		dnssecValidator: nil, // DNSSEC валидатор не инициализирован по умолчанию
+		config:          Config{},
+		cookies:         newServerCookies(CookieConfig{}),
+		ctx:             ctx,
+		cancel:          cancel,
 	}
+	s.prefetch = newPrefetcher(ctx, PrefetchConfig{}, cache, s.resolvePrefetch)
 	
-	// Запускаем воркеры для параллельной обработки
-	for i := 0; i < s.workers; i++ {
-		go s.worker()
-	}
-	
-	// Запускаем периодическую очистку кэша
-	go s.cacheCleaner()
+	// Запускаем воркеры и периодическую очистку кэша
+	s.startBackground()
 	
 	return s
 }
@@ -96,147 +189,85 @@ func NewServerWithConfig(config *Config) *Server {
 	if config.CacheSize > 0 {
 		cacheSize = config.CacheSize
 	}
+
+	workers := config.Workers.Count
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	queueSize := config.Workers.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
 	
 	cache := &DNSCache{
-		maxSize: cacheSize,
+		maxSize:        cacheSize,
+		staleWindow:    config.ServeStale.Window,
+		failureRecheck: config.ServeStale.FailureRecheck,
+		ttl:            newTTLPolicy(config.CacheTTL),
+		maxBytes:       config.CacheMaxBytes,
+		eviction:       config.CacheEviction,
+	}
+	if cache.failureRecheck <= 0 {
+		cache.failureRecheck = DefaultStaleFailureRecheck
 	}
 	for i := range cache.shards {
-		cache.shards[i] = &cacheShard{
-			items:   make(map[string]*cacheEntry),
-			lruList: list.New(),
-			lruMap:  make(map[string]*list.Element),
-		}
+		cache.shards[i] = cache.newShard()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	s := &Server{
 		resolver:        NewResolver(cache),
 		cache:           cache,
-		workers:       50,    // Увеличиваем количество воркеров
-		queries:       make(chan queryRequest, 1000), // Увеличиваем буфер
-		prefetch:      newPrefetchManager(cache, NewResolver(cache)),
+		workers:         workers,
+		queries:         make(chan queryRequest, queueSize),
 		dnssecValidator: nil,
+		config:          *config,
+		rrl:             newRateLimiter(config.RateLimit),
+		cookies:         newServerCookies(config.Cookies),
+		ctx:             ctx,
+		cancel:          cancel,
 	}
+	s.prefetch = newPrefetcher(ctx, config.Prefetch, cache, s.resolvePrefetch)
 	
 	if config.EnableDNSSEC {
 		s.dnssecValidator = dnssec.NewAuth(context.Background(), dns.Question{})
 	}
-	
-	for i := 0; i < s.workers; i++ {
-		go s.worker()
-	}
-	go s.cacheCleaner()
-	
-	return s
-}
-
-type prefetchManager struct {
-	cache     *DNSCache
-	resolver  *Resolver
-	popular   map[string]int
-	mu        sync.RWMutex
-	threshold int
-}
 
-func newPrefetchManager(cache *DNSCache, resolver *Resolver) *prefetchManager {
-	pm := &prefetchManager{
-		cache:     cache,
-		resolver:  resolver,
-		popular:   make(map[string]int),
-		threshold: 3, // уменьшаем порог для более агрессивного prefetch
-	}
-	
-	// Запускаем периодическое обновление для всех доменов
-	go pm.prefetchAllDomains()
-	
-	return pm
-}
-
-func (pm *prefetchManager) recordAccess(q dns.Question) {
-	key := fmt.Sprintf("%s-%d-%d", q.Name, q.Qtype, q.Qclass)
-	
-	pm.mu.Lock()
-	defer pm.mu.Unlock()
-	
-	pm.popular[key]++
-	
-	// Если достигли порога популярности, запускаем prefetch
-	if pm.popular[key] >= pm.threshold {
-		go pm.prefetchRecord(q)
-		// Сбрасываем счетчик после prefetch
-		pm.popular[key] = 0
-	}
-}
-
-func (pm *prefetchManager) prefetchRecord(q dns.Question) {
-	// Проверяем, есть ли уже в кэше
-	if pm.cache.get(q, 0) != nil {
-		return
-	}
-	
-	// Выполняем prefetch
-	msg := new(dns.Msg)
-	msg.SetQuestion(q.Name, q.Qtype)
-	msg.SetEdns0(4096, true)
-	
-	ctx := context.Background()
-	resp := pm.resolver.Exchange(ctx, msg)
-	
-	if !resp.HasError() {
-		pm.cache.set(q, resp.Msg)
-	}
-}
-
-func (pm *prefetchManager) prefetchAllDomains() {
-	ticker := time.NewTicker(1 * time.Minute)
-	defer ticker.Stop()
-	
-	for range ticker.C {
-		pm.mu.Lock()
-		
-		// Агрессивное prefetch для всех доменов из кэша
-		allDomains := pm.cache.getAllDomains()
-		for _, q := range allDomains {
-			go pm.prefetchRecord(q)
+	// Warm the cache, and known zones, from the last snapshot.
+	if config.Snapshot.Path != "" {
+		if err := s.LoadSnapshot(config.Snapshot.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			Warn(fmt.Sprintf("unable to load snapshot [%s]: %s", config.Snapshot.Path, err.Error()))
 		}
-		
-		// Очищаем статистику
-		pm.popular = make(map[string]int)
-		pm.mu.Unlock()
 	}
-}
-
-func (s *Server) Start() error {
-	dns.HandleFunc(".", s.handleDNS)
-
-	server := &dns.Server{
-		Addr: ":5355",
-		Net:  "udp",
-	}
-
-	fmt.Printf("Starting DNS server on port 5355\n")
 	
-	// Выводим статистику кэша каждую минуту
-	go s.printStats()
+	s.startBackground()
 	
-	return server.ListenAndServe()
+	return s
 }
 
 func (s *Server) printStats() {
+	defer s.backgroundWG.Done()
+
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		stats := s.cache.Stats()
 		size := s.cache.Size()
 		
-		total := stats.Hits + stats.Misses
-		hitRate := float64(0)
-		if total > 0 {
-			hitRate = float64(stats.Hits) / float64(total) * 100
-		}
-		
-		fmt.Printf("Cache stats: size=%d, hits=%d, misses=%d, hit_rate=%.2f%%, evictions=%d, expired=%d, negative=%d\n",
-			size, stats.Hits, stats.Misses, hitRate, stats.Evictions, stats.Expired, stats.Negative)
+		serverStats := s.Stats()
+		fmt.Printf("Query stats: workers=%d, queued=%d/%d, processed=%d, avg_queue_wait=%s, max_queue_wait=%s, overloaded=%d, timed_out=%d\n",
+			serverStats.Workers, serverStats.Queued, serverStats.QueueSize, serverStats.Processed, serverStats.AverageQueueWait(),
+			serverStats.MaxQueueWait, serverStats.Overloaded, serverStats.TimedOut)
+		fmt.Printf("Cache stats: size=%d, bytes=%d, policy=%s, hits=%d, misses=%d, hit_rate=%.2f%%, evictions=%d, expired=%d, negative=%d, prefetches=%d, prefetch_hits=%d, prefetch_wasted=%d\n",
+			size, stats.Bytes, stats.Policy, stats.Hits, stats.Misses, stats.HitRate*100, stats.Evictions, stats.Expired, stats.Negative, stats.Prefetches, stats.PrefetchHits, stats.PrefetchWasted)
 	}
 }
 
@@ -285,14 +316,43 @@ func (z *basicZone) GetDSRecords() ([]dns.RR, error) {
 }
 
 func (s *Server) worker() {
+	defer s.workerWG.Done()
+
 	for query := range s.queries {
+		s.stats.waited(time.Since(query.queued))
 		s.processQuery(query.w, query.r)
+		close(query.done)
 	}
 }
 
+// handleDNS queues the query for a worker, and waits until the reply has been written. Waiting means the
+// listeners know which queries are still in flight, so a graceful Shutdown can let them finish. If the queue is
+// full, the query is shed instead.
 func (s *Server) handleDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.admit(w, r) {
+		return
+	}
+
+	s.queriesLock.RLock()
+	if s.queriesClosed {
+		// The server is shutting down; the query is dropped.
+		s.queriesLock.RUnlock()
+		return
+	}
+
+	done := make(chan struct{})
+
 	// Отправляем запрос в очередь для обработки
-	s.queries <- queryRequest{w: w, r: r}
+	select {
+	case s.queries <- queryRequest{w: w, r: r, done: done, queued: time.Now()}:
+		s.queriesLock.RUnlock()
+	default:
+		s.queriesLock.RUnlock()
+		s.shed(w, r)
+		return
+	}
+
+	<-done
 }
 
 func (s *Server) processQuery(w dns.ResponseWriter, r *dns.Msg) {
@@ -303,64 +363,114 @@ func (s *Server) processQuery(w dns.ResponseWriter, r *dns.Msg) {
 	// Включаем DNSSEC если запрошено
 	opt := r.IsEdns0()
 	if opt != nil {
-		m.SetEdns0(4096, opt.Do())
+		m.SetEdns0(MaxUDPResponseSize, opt.Do())
 	}
 
+	// With EDNS Client Subnet enabled, answers may be tailored to the client's network.
+	ecs := newClientSubnet(s.config.ClientSubnet, w.RemoteAddr(), r)
+
 	// Проверяем кэш перед резолвингом
-	if cached := s.cache.get(r.Question[0], r.Id); cached != nil {
-		// Добавляем DNSSEC флаг к кэшированному ответу если включено
-		if opt != nil && opt.Do() {
-			cached.AuthenticatedData = true
-		}
-		w.WriteMsg(cached)
+	if cached, scope := s.cache.getResponse(r, ecs.client()); cached != nil {
+		recordResponse(w, cached)
+		s.writeMsg(w, r, replyClientSubnet(cached.Msg, r, scope))
+		return
+	}
+
+	// A stale answer we can fall back on, if resolving a fresh one fails or takes too long.
+	stale, staleScope, recheck := s.cache.getStale(r.Question[0], queryVariant(r), r.Id, ecs.client())
+	if stale != nil && recheck {
+		// Resolving it failed recently, so we don't try again yet.
+		s.writeStale(w, r, stale, staleScope)
 		return
 	}
-	
-	// Регистрируем обращение для prefetch анализа
-	s.prefetch.recordAccess(r.Question[0])
 
 	// Выполняем резолвинг с DNSSEC валидацией
-	ctx := context.Background()
-	
-	// Выполняем резолвинг
-	resp := s.resolver.Exchange(ctx, r)
+	ctx := ecs.withContext(s.ctx)
+
+	var resp *Response
+	if stale == nil {
+		resp = s.resolveWithin(ctx, r, ecs)
+	} else {
+		// If we stop waiting, the resolution carries on in the background, refreshing the cache.
+		result := make(chan *Response, 1)
+		s.backgroundWG.Add(1)
+		go func() {
+			defer s.backgroundWG.Done()
+			result <- s.resolveWithin(ctx, r, ecs)
+		}()
+
+		timer := time.NewTimer(s.staleClientResponseTimeout())
+		defer timer.Stop()
+
+		select {
+		case resp = <-result:
+		case <-timer.C:
+			s.writeStale(w, r, stale, staleScope)
+			return
+		}
+	}
+
 	if resp.HasError() {
-		// Negative caching для NXDOMAIN и других ошибок
-		if resp.Err.Error() == "NXDOMAIN" {
-			s.cache.setNegative(r.Question[0], dns.RcodeNameError)
-			m.Rcode = dns.RcodeNameError
-		} else {
-			s.cache.setNegative(r.Question[0], dns.RcodeServerFailure)
-			m.Rcode = dns.RcodeServerFailure
+		if stale != nil {
+			s.writeStale(w, r, stale, staleScope)
+			return
 		}
-		w.WriteMsg(m)
+		recordResponse(w, resp)
+		m.Rcode = dns.RcodeServerFailure
+		setExtendedError(m, extendedError(resp.Err, resp.Auth))
+		s.writeMsg(w, r, m)
 		return
 	}
 
+	recordResponse(w, resp)
+	s.writeMsg(w, r, replyClientSubnet(resp.Msg, r, ecs.scopeLength()))
+}
+
+// writeStale writes the stale answer as the reply to r.
+func (s *Server) writeStale(w dns.ResponseWriter, r *dns.Msg, stale *Response, scope int) {
+	recordResponse(w, stale)
+	s.writeMsg(w, r, s.cache.staleReply(stale.Msg, r, scope))
+}
+
+// resolve resolves r, then validates and caches the answer. A failure is recorded against any stale answer to r.
+func (s *Server) resolve(ctx context.Context, r *dns.Msg, ecs *clientSubnet) *Response {
+	// Выполняем резолвинг
+	resp := s.resolver.Exchange(ctx, r)
+
 	// DNSSEC валидация если включено
-	if opt != nil && opt.Do() {
+	if opt := r.IsEdns0(); !resp.HasError() && opt != nil && opt.Do() {
 		// Проверяем DNSSEC валидацию
 		if s.dnssecValidator != nil {
 			authResult, err := s.validateDNSSEC(ctx, resp.Msg)
 			if err != nil || authResult != "Secure" {
 				// Ошибка валидации DNSSEC - возвращаем SERVFAIL
-				m.Rcode = dns.RcodeServerFailure
-				w.WriteMsg(m)
-				return
+				result := dnssec.Unknown
+				if authResult == "Bogus" {
+					result = dnssec.Bogus
+				}
+				if err == nil {
+					err = fmt.Errorf("dnssec validation result was %s", authResult)
+				}
+				resp = &Response{Err: err, Auth: result}
+			} else {
+				// Валидация прошла успешно
+				resp.Msg.AuthenticatedData = true
+				resp.Auth = dnssec.Secure
 			}
-			
-			// Валидация прошла успешно
-			resp.Msg.AuthenticatedData = true
 		} else {
-			// DNSSEC включен но валидатор не настроен
-			resp.Msg.AuthenticatedData = false
+			// Without a validator of our own, we rely on the resolver's validation.
+			resp.Msg.AuthenticatedData = resp.Auth == dnssec.Secure && !r.CheckingDisabled
 		}
 	}
 
-	// Кэшируем ответ
-	s.cache.set(r.Question[0], resp.Msg)
+	if resp.HasError() {
+		s.cache.staleFailed(r.Question[0], queryVariant(r), ecs.client())
+		return resp
+	}
 
-	w.WriteMsg(resp.Msg)
+	// Кэшируем ответ
+	s.cache.setAnswer(r, resp, ecs.scopePrefix())
+	return resp
 }
 
 func (c *DNSCache) getShard(key string) *cacheShard {
@@ -370,172 +480,241 @@ func (c *DNSCache) getShard(key string) *cacheShard {
 }
 
 func (c *DNSCache) get(q dns.Question, requestID uint16) *dns.Msg {
-	key := fmt.Sprintf("%s-%d-%d", q.Name, q.Qtype, q.Qclass)
-	shard := c.getShard(key)
+	msg, _ := c.getScoped(q, requestID, netip.Addr{})
+	return msg
+}
+
+// getScoped returns the cached answer to q for a client at addr, along with the ECS scope prefix length it was
+// cached with. The most specific variant covering the client is preferred; failing that, the answer for all clients.
+// If addr is the zero Addr, only the answer for all clients is considered.
+func (c *DNSCache) getScoped(q dns.Question, requestID uint16, client netip.Addr) (*dns.Msg, int) {
+	if resp, scope := c.find(cachePlain.baseKey(q), requestID, client); resp != nil {
+		return resp.Msg, scope
+	}
 
-	shard.mu.RLock()
-	defer shard.mu.RUnlock()
+	atomic.AddUint64(&c.stats.Misses, 1)
+	return nil, 0
+}
 
-	if elem, exists := shard.lruMap[key]; exists {
-		entry := elem.Value.(*cacheEntry)
-		
+// find returns the cached answer at baseKey for a client at addr, with the DNSSEC state it was validated with,
+// along with its ECS scope, as getScoped does. Misses aren't counted, as the caller may go on to try another variant.
+func (c *DNSCache) find(baseKey string, requestID uint16, client netip.Addr) (*Response, int) {
+	shard := c.getShard(baseKey)
+
+	// A write lock, as a hit updates the eviction policy.
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if client.IsValid() {
+		for _, scope := range shard.scopeLengths(baseKey) {
+			subnet, err := client.Prefix(scope)
+			if err != nil {
+				continue
+			}
+			if resp := c.lookup(shard, scopedKey(baseKey, subnet), requestID); resp != nil {
+				return resp, scope
+			}
+		}
+	}
+
+	return c.lookup(shard, baseKey, requestID), 0
+}
+
+// lookup returns a copy of the entry at key, if it's not expired. shard's lock must be held.
+func (c *DNSCache) lookup(shard *cacheShard, key string, requestID uint16) *Response {
+	if entry, exists := shard.items[key]; exists {
 		if time.Now().Before(entry.expires) {
 			atomic.AddUint64(&c.stats.Hits, 1)
 			entry.frequency++
-			shard.lruList.MoveToFront(elem)
+			shard.policy.hit(entry)
+			if entry.prefetched {
+				entry.prefetched = false
+				atomic.AddUint64(&c.stats.PrefetchHits, 1)
+			}
+			c.prefetch.offer(shard, entry, time.Now())
 			
 			copy := entry.msg.Copy()
 			copy.Id = requestID
-			return copy
-		} else {
+			copy.AuthenticatedData = entry.auth == dnssec.Secure
+			decrementTTLs(copy, time.Since(entry.cached))
+			return &Response{Msg: copy, Auth: entry.auth, Doe: entry.doe}
+		} else if entry.removable(time.Now()) {
 			atomic.AddUint64(&c.stats.Expired, 1)
-			c.evictEntry(shard, elem)
+			shard.remove(entry)
 		}
 	}
-	
-	atomic.AddUint64(&c.stats.Misses, 1)
 	return nil
 }
 
 func (c *DNSCache) set(q dns.Question, msg *dns.Msg) {
-	key := fmt.Sprintf("%s-%d-%d", q.Name, q.Qtype, q.Qclass)
-	shard := c.getShard(key)
-
-	shard.mu.Lock()
-	defer shard.mu.Unlock()
-
-	// Проверяем размер кэша и удаляем старые записи при необходимости
-	c.ensureCapacity(shard)
+	c.setScoped(q, msg, netip.Prefix{})
+}
 
-	ttl := uint32(3600) // Значение по умолчанию 1 час
+// setScoped caches msg as the answer to q for clients within subnet; or for all clients if subnet is the zero Prefix.
+func (c *DNSCache) setScoped(q dns.Question, msg *dns.Msg, subnet netip.Prefix) {
+	c.store(q, cachePlain, &Response{Msg: msg}, subnet)
+}
 
-	// Находим минимальный TTL из всех записей
-	for _, rr := range msg.Answer {
-		if rr.Header().Ttl < ttl {
-			ttl = rr.Header().Ttl
-		}
-	}
-	
-	for _, rr := range msg.Ns {
-		if rr.Header().Ttl < ttl {
-			ttl = rr.Header().Ttl
-		}
-	}
-	
-	for _, rr := range msg.Extra {
-		if rr.Header().Ttl < ttl {
-			ttl = rr.Header().Ttl
-		}
+// store caches resp as the variant of the answer to q for clients within subnet, along with the DNSSEC state it
+// was validated with.
+func (c *DNSCache) store(q dns.Question, variant cacheVariant, resp *Response, subnet netip.Prefix) {
+	// NXDOMAIN and NODATA answers are cached for their negative TTL. See https://datatracker.ietf.org/doc/html/rfc2308
+	if isNegativeResponse(resp.Msg) {
+		c.setNegative(q, variant, resp, subnet)
+		return
 	}
-	
-	// Если TTL = 0, используем минимальный разумный
+
+	// Records are cached with their TTLs bounded by the policy, and the entry expires with the first of them.
+	now := time.Now()
+	msg := resp.Msg.Copy()
+	ttl := c.ttl.apply(q.Name, msg, now)
 	if ttl == 0 {
-		ttl = 300 // 5 минут
+		return
 	}
-	
-	// Увеличиваем максимальный TTL для максимального кэширования
-		if ttl > 86400 {
-			ttl = 86400 // max 24 hours
-		}
-		
-		// Минимальный TTL для предотвращения слишком частого обновления
-		if ttl < 60 {
-			ttl = 60 // min 1 minute
-		}
-		
-		expires := time.Now().Add(time.Duration(ttl) * time.Second)
-	
-	entry := &cacheEntry{
-		msg:       msg.Copy(),
+
+	expires := now.Add(time.Duration(ttl) * time.Second)
+
+	c.add(variant.baseKey(q), &cacheEntry{
+		msg:       msg,
 		expires:   expires,
-		key:       key,
+		stale:     expires.Add(c.staleWindow),
+		cached:    now,
 		frequency: 1,
+		auth:      resp.Auth,
+		doe:       resp.Doe,
+	}, subnet)
+}
+
+// add caches entry at baseKey for clients within subnet, replacing any already cached.
+func (c *DNSCache) add(baseKey string, entry *cacheEntry, subnet netip.Prefix) {
+	entry.key = baseKey
+	if subnet.IsValid() {
+		entry.key = scopedKey(baseKey, subnet)
+		entry.baseKey = baseKey
+		entry.subnet = subnet.Masked()
 	}
-	
-	// Если запись уже существует, обновляем её
-	if elem, exists := shard.lruMap[key]; exists {
-		shard.lruList.Remove(elem)
-		delete(shard.lruMap, key)
-		delete(shard.items, key)
-	}
-	
-	// Добавляем новую запись
-	elem := shard.lruList.PushFront(entry)
-	shard.lruMap[key] = elem
-	shard.items[key] = entry
+	c.insert(baseKey, entry)
 }
 
-func (c *DNSCache) setNegative(q dns.Question, rcode int) {
-	key := fmt.Sprintf("%s-%d-%d-negative", q.Name, q.Qtype, q.Qclass)
-	shard := c.getShard(key)
+// insert caches entry, whose keys are already set, replacing any already cached.
+func (c *DNSCache) insert(baseKey string, entry *cacheEntry) {
+	shard := c.getShard(baseKey)
 
 	shard.mu.Lock()
 	defer shard.mu.Unlock()
 
-	c.ensureCapacity(shard)
+	// Если запись уже существует, обновляем её
+	if existing, exists := shard.items[entry.key]; exists {
+		shard.remove(existing)
+	}
 
-	// Negative TTL для NXDOMAIN обычно меньше
-	ttl := uint32(300) // 5 minutes for negative cache
-	
-	msg := new(dns.Msg)
-	msg.SetRcode(&dns.Msg{Question: []dns.Question{q}}, rcode)
-	
-	expires := time.Now().Add(time.Duration(ttl) * time.Second)
-	
-	entry := &cacheEntry{
-		msg:        msg,
-		expires:    expires,
-		key:        key,
-		isNegative: true,
-		frequency:  1,
+	// Проверяем размер кэша и удаляем старые записи при необходимости
+	entry.size = entrySize(entry)
+	if !c.ensureCapacity(shard, entry.size) {
+		return
 	}
-	
-	if elem, exists := shard.lruMap[key]; exists {
-		shard.lruList.Remove(elem)
-		delete(shard.lruMap, key)
-		delete(shard.items, key)
+
+	// Добавляем новую запись
+	shard.items[entry.key] = entry
+	shard.bytes += entry.size
+	shard.policy.add(entry)
+	shard.addScope(entry)
+}
+
+// scopedKey returns the key of the variant of baseKey cached for the clients within subnet.
+func scopedKey(baseKey string, subnet netip.Prefix) string {
+	return baseKey + "/" + subnet.Masked().String()
+}
+
+// addScope records that entry is a variant cached for a client subnet, so lookups know which scope lengths to try.
+func (shard *cacheShard) addScope(entry *cacheEntry) {
+	if !entry.subnet.IsValid() {
+		return
 	}
-	
-	elem := shard.lruList.PushFront(entry)
-	shard.lruMap[key] = elem
-	shard.items[key] = entry
-	
-	atomic.AddUint64(&c.stats.Negative, 1)
+	if shard.scopes == nil {
+		shard.scopes = make(map[string]map[int]int)
+	}
+	lengths, ok := shard.scopes[entry.baseKey]
+	if !ok {
+		lengths = make(map[int]int)
+		shard.scopes[entry.baseKey] = lengths
+	}
+	lengths[entry.subnet.Bits()]++
 }
 
-func (c *DNSCache) ensureCapacity(shard *cacheShard) {
-	maxShardSize := c.maxSize / len(c.shards)
-	
-	for len(shard.items) >= maxShardSize {
-		c.evictOldest(shard)
+func (shard *cacheShard) forgetScope(entry *cacheEntry) {
+	if !entry.subnet.IsValid() {
+		return
+	}
+	lengths := shard.scopes[entry.baseKey]
+	if lengths[entry.subnet.Bits()]--; lengths[entry.subnet.Bits()] <= 0 {
+		delete(lengths, entry.subnet.Bits())
+	}
+	if len(lengths) == 0 {
+		delete(shard.scopes, entry.baseKey)
 	}
 }
 
-func (c *DNSCache) evictOldest(shard *cacheShard) {
-	elem := shard.lruList.Back()
-	if elem != nil {
-		c.evictEntry(shard, elem)
+// scopeLengths returns the scope lengths of the variants cached for baseKey, longest first.
+func (shard *cacheShard) scopeLengths(baseKey string) []int {
+	lengths := make([]int, 0, len(shard.scopes[baseKey]))
+	for length := range shard.scopes[baseKey] {
+		lengths = append(lengths, length)
 	}
+	sort.Sort(sort.Reverse(sort.IntSlice(lengths)))
+	return lengths
 }
 
-func (c *DNSCache) evictEntry(shard *cacheShard, elem *list.Element) {
-	entry := elem.Value.(*cacheEntry)
-	
-	delete(shard.items, entry.key)
-	delete(shard.lruMap, entry.key)
-	shard.lruList.Remove(elem)
+// ensureCapacity evicts entries from shard until there's room for another of size bytes. It returns false if the
+// entry is larger than the shard's whole budget.
+func (c *DNSCache) ensureCapacity(shard *cacheShard, size int64) bool {
+	maxShardSize, maxShardBytes := c.shardCapacity()
+	if maxShardBytes > 0 && size > maxShardBytes {
+		return false
+	}
+
+	for len(shard.items) >= maxShardSize || (maxShardBytes > 0 && shard.bytes+size > maxShardBytes) {
+		victim := shard.policy.victim()
+		if victim == nil {
+			break
+		}
+		c.evictEntry(shard, victim)
+	}
+	return true
+}
+
+func (c *DNSCache) evictEntry(shard *cacheShard, entry *cacheEntry) {
+	shard.remove(entry)
 	
 	atomic.AddUint64(&c.stats.Evictions, 1)
 }
 
 func (c *DNSCache) Stats() CacheStats {
-	return CacheStats{
-		Hits:      atomic.LoadUint64(&c.stats.Hits),
-		Misses:    atomic.LoadUint64(&c.stats.Misses),
-		Evictions: atomic.LoadUint64(&c.stats.Evictions),
-		Expired:   atomic.LoadUint64(&c.stats.Expired),
-		Negative:  atomic.LoadUint64(&c.stats.Negative),
+	stats := CacheStats{
+		Hits:            atomic.LoadUint64(&c.stats.Hits),
+		Misses:          atomic.LoadUint64(&c.stats.Misses),
+		Evictions:       atomic.LoadUint64(&c.stats.Evictions),
+		Expired:         atomic.LoadUint64(&c.stats.Expired),
+		Negative:        atomic.LoadUint64(&c.stats.Negative),
+		Stale:           atomic.LoadUint64(&c.stats.Stale),
+		Policy:          c.eviction,
+		MaxBytes:        uint64(c.maxBytes),
+		Admitted:        atomic.LoadUint64(&c.stats.Admitted),
+		Rejected:        atomic.LoadUint64(&c.stats.Rejected),
+		Prefetches:      atomic.LoadUint64(&c.stats.Prefetches),
+		PrefetchHits:    atomic.LoadUint64(&c.stats.PrefetchHits),
+		PrefetchWasted:  atomic.LoadUint64(&c.stats.PrefetchWasted),
+		PrefetchDropped: atomic.LoadUint64(&c.stats.PrefetchDropped),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
 	}
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		stats.Bytes += uint64(shard.bytes)
+		shard.mu.RUnlock()
+	}
+	return stats
 }
 
 func (c *DNSCache) Size() int {
@@ -552,44 +731,26 @@ func (c *DNSCache) Clear() {
 	for _, shard := range c.shards {
 		shard.mu.Lock()
 		shard.items = make(map[string]*cacheEntry)
-		shard.lruList = list.New()
-		shard.lruMap = make(map[string]*list.Element)
+		shard.policy = c.newPolicy()
+		shard.bytes = 0
+		shard.scopes = nil
 		shard.mu.Unlock()
 	}
 }
 
-func (c *DNSCache) getAllDomains() []dns.Question {
-	var domains []dns.Question
-	
-	for _, shard := range c.shards {
-		shard.mu.RLock()
-		for key, entry := range shard.items {
-			if time.Now().Before(entry.expires) {
-				// Парсим ключ обратно в Question
-				parts := strings.Split(key, "-")
-				if len(parts) == 3 {
-					qtype, _ := strconv.Atoi(parts[1])
-					qclass, _ := strconv.Atoi(parts[2])
-					domains = append(domains, dns.Question{
-						Name:   parts[0],
-						Qtype:  uint16(qtype),
-						Qclass: uint16(qclass),
-					})
-				}
-			}
-		}
-		shard.mu.RUnlock()
-	}
-	
-	return domains
-}
-
 func (s *Server) cacheCleaner() {
+	defer s.backgroundWG.Done()
+
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		s.cache.cleanExpired()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.cache.cleanExpired()
+		}
 	}
 }
 
@@ -599,13 +760,9 @@ func (c *DNSCache) cleanExpired() {
 	for _, shard := range c.shards {
 		shard.mu.Lock()
 		
-		for key, entry := range shard.items {
-			if now.After(entry.expires) {
-				if elem, exists := shard.lruMap[key]; exists {
-					shard.lruList.Remove(elem)
-					delete(shard.lruMap, key)
-				}
-				delete(shard.items, key)
+		for _, entry := range shard.items {
+			if entry.removable(now) {
+				shard.remove(entry)
 				atomic.AddUint64(&c.stats.Expired, 1)
 			}
 		}
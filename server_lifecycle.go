@@ -0,0 +1,355 @@
+package resolver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"net/http"
+)
+
+// startBackground starts the query workers, the cache cleaner, and any snapshot saver. All are stopped by Shutdown.
+func (s *Server) startBackground() {
+	// Запускаем воркеры для параллельной обработки
+	s.workerWG.Add(s.workers)
+	for i := 0; i < s.workers; i++ {
+		go s.worker()
+	}
+
+	// Запускаем периодическую очистку кэша
+	s.backgroundWG.Add(1)
+	go s.cacheCleaner()
+
+	if s.config.Snapshot.Path != "" {
+		s.backgroundWG.Add(1)
+		go s.snapshotSaver()
+	}
+}
+
+// Start binds every configured listener, then serves queries until either a listener fails, or Shutdown is called.
+// After a Shutdown, Start returns nil.
+func (s *Server) Start() error {
+	if err := s.Listen(); err != nil {
+		return err
+	}
+	return s.Serve()
+}
+
+// Listen binds every configured listener, without yet serving any queries. Any error binding a listener is
+// returned, and nothing is left bound. Once Listen returns, the bound addresses are available via Addrs.
+func (s *Server) Listen() error {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	if s.shutdown {
+		return ErrServerClosed
+	}
+	if s.listening {
+		return ErrServerAlreadyListening
+	}
+
+	// Each Server has its own handler, so several Servers can run side by side in one process.
+	handler := dns.HandlerFunc(s.handleDNS)
+
+	listeners := s.config.Listeners
+	if len(listeners) == 0 {
+		// UDP and TCP are served side by side on the same port, so clients receiving a truncated UDP reply can
+		// retry over TCP.
+		listeners = []Listener{
+			{Net: "udp", Addr: DefaultListenAddr},
+			{Net: "tcp", Addr: DefaultListenAddr},
+		}
+	}
+
+	servers := make([]*dns.Server, 0, len(listeners)+1)
+	for _, listener := range listeners {
+		switch listener.Net {
+		case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		default:
+			return fmt.Errorf("unsupported listener network [%s]", listener.Net)
+		}
+		servers = append(servers, &dns.Server{Addr: listener.Addr, Net: listener.Net, Handler: handler})
+	}
+
+	if s.config.TLSCertFile != "" {
+		server, err := s.newTLSServer()
+		if err != nil {
+			return err
+		}
+		server.Handler = handler
+		servers = append(servers, server)
+	}
+
+	var dohServer *http.Server
+	var dohListener net.Listener
+	if s.config.DoHListenAddr != "" {
+		dohServer = s.newDoHServer()
+	}
+
+	var doqServer *doqServer
+	if s.config.DoQListenAddr != "" {
+		var err error
+		if doqServer, err = s.newDoQServer(); err != nil {
+			return err
+		}
+	}
+
+	// We bind everything up-front, so any error is returned before we start serving anything.
+	err := func() error {
+		for _, server := range servers {
+			if err := listenDNS(server); err != nil {
+				return err
+			}
+		}
+		if dohServer != nil {
+			var err error
+			if dohListener, err = net.Listen("tcp", dohServer.Addr); err != nil {
+				return err
+			}
+		}
+		if doqServer != nil {
+			if err := doqServer.Listen(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}()
+	if err != nil {
+		closeDNSListeners(servers)
+		if dohListener != nil {
+			dohListener.Close()
+		}
+		return err
+	}
+
+	s.listening = true
+	s.dnsServers = servers
+	s.dohServer = dohServer
+	s.dohListener = dohListener
+	s.doqServer = doqServer
+	return nil
+}
+
+// Addrs returns the addresses of the plain DNS and DoT listeners, in the order they were configured.
+// It returns nil until Listen has been called.
+func (s *Server) Addrs() []net.Addr {
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	var addrs []net.Addr
+	for _, server := range s.dnsServers {
+		if server.PacketConn != nil {
+			addrs = append(addrs, server.PacketConn.LocalAddr())
+		} else if server.Listener != nil {
+			addrs = append(addrs, server.Listener.Addr())
+		}
+	}
+	return addrs
+}
+
+// Serve serves queries on the listeners bound by Listen, until either a listener fails, or Shutdown is called.
+// After a Shutdown, Serve returns nil. If a listener fails, the Server is shutdown, so none of the others are left
+// running, and the listener's error is returned.
+func (s *Server) Serve() error {
+	s.listenersLock.Lock()
+
+	if s.shutdown {
+		s.listenersLock.Unlock()
+		return ErrServerClosed
+	}
+	if !s.listening {
+		s.listenersLock.Unlock()
+		return ErrServerNotListening
+	}
+	if s.serving {
+		s.listenersLock.Unlock()
+		return ErrServerAlreadyListening
+	}
+	s.serving = true
+
+	// Added while holding the lock, so it can't race with Shutdown waiting on backgroundWG.
+	s.backgroundWG.Add(1)
+
+	servers, dohServer, dohListener, doqServer := s.dnsServers, s.dohServer, s.dohListener, s.doqServer
+	s.listenersLock.Unlock()
+
+	//---
+
+	errs := make(chan error, len(servers)+2)
+	for _, server := range servers {
+		go func() {
+			errs <- server.ActivateAndServe()
+		}()
+		fmt.Printf("Starting DNS server on %s (%s)\n", server.Addr, server.Net)
+	}
+
+	if dohServer != nil {
+		go func() {
+			errs <- s.runDoHServer(dohServer, dohListener)
+		}()
+		fmt.Printf("Starting DNS-over-HTTPS server on %s%s\n", dohServer.Addr, DoHPath)
+	}
+
+	if doqServer != nil {
+		go func() {
+			errs <- doqServer.Serve()
+		}()
+		fmt.Printf("Starting DNS-over-QUIC server on %s\n", doqServer.addr)
+	}
+
+	// Выводим статистику кэша каждую минуту
+	go s.printStats()
+
+	err := <-errs
+
+	s.listenersLock.Lock()
+	shutdown := s.shutdown
+	s.listenersLock.Unlock()
+	if shutdown {
+		// We've been shutdown, so whatever the listener returned is expected.
+		return nil
+	}
+
+	if shutdownErr := s.Shutdown(context.Background()); shutdownErr != nil {
+		return errors.Join(err, shutdownErr)
+	}
+	return err
+}
+
+// Shutdown gracefully stops the Server. It stops accepting new queries, waits for those already received to be
+// answered, then stops the workers and every background goroutine, and saves any snapshot. If ctx expires first,
+// any resolutions still in flight are cancelled and ctx's error is returned. A Server cannot be restarted after
+// it's been shutdown.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	s.listenersLock.Lock()
+
+	// Ensures a concurrent, or later, call to Start() doesn't open new listeners.
+	s.shutdown = true
+
+	// Listeners wait for their in-flight queries to be answered.
+	for _, server := range s.dnsServers {
+		if err := server.ShutdownContext(ctx); err != nil {
+			// If the server had not finished starting, we close its sockets directly.
+			closeDNSListeners([]*dns.Server{server})
+			if !isNotStartedError(err) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if s.dohServer != nil {
+		if err := s.dohServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.doqServer != nil {
+		if err := s.doqServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.dohListener != nil && !s.serving {
+		// Listen was called, but Serve never was, so the DoH server doesn't yet own its listener.
+		s.dohListener.Close()
+	}
+	s.dnsServers, s.dohServer, s.dohListener, s.doqServer = nil, nil, nil, nil
+	s.listenersLock.Unlock()
+
+	// No new queries can now be queued. The workers drain the queue, then return.
+	s.queriesLock.Lock()
+	if !s.queriesClosed {
+		s.queriesClosed = true
+		close(s.queries)
+	}
+	s.queriesLock.Unlock()
+
+	if err := waitContext(ctx, &s.workerWG); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Stops the tickers, prefetching, and any resolutions still running.
+	s.cancel()
+
+	if err := waitContext(ctx, &s.backgroundWG); err != nil {
+		errs = append(errs, err)
+	}
+	if s.prefetch != nil {
+		if err := waitContext(ctx, s.prefetch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Saved last, so it includes everything resolved while draining the queue.
+	if s.config.Snapshot.Path != "" {
+		if err := s.SaveSnapshot(s.config.Snapshot.Path); err != nil {
+			errs = append(errs, fmt.Errorf("unable to save snapshot [%s]: %w", s.config.Snapshot.Path, err))
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return errors.Join(errs...)
+}
+
+//---
+
+// listenDNS binds the socket for server, such that it can be started with ActivateAndServe().
+func listenDNS(server *dns.Server) error {
+	switch server.Net {
+	case "udp", "udp4", "udp6":
+		conn, err := net.ListenPacket(server.Net, server.Addr)
+		if err != nil {
+			return err
+		}
+		server.PacketConn = conn
+	case "tcp", "tcp4", "tcp6":
+		listener, err := net.Listen(server.Net, server.Addr)
+		if err != nil {
+			return err
+		}
+		server.Listener = listener
+	case "tcp-tls", "tcp4-tls", "tcp6-tls":
+		listener, err := tls.Listen(server.Net[:len(server.Net)-4], server.Addr, server.TLSConfig)
+		if err != nil {
+			return err
+		}
+		server.Listener = listener
+	default:
+		return fmt.Errorf("unsupported network [%s]", server.Net)
+	}
+	return nil
+}
+
+func closeDNSListeners(servers []*dns.Server) {
+	for _, server := range servers {
+		if server.PacketConn != nil {
+			server.PacketConn.Close()
+		}
+		if server.Listener != nil {
+			server.Listener.Close()
+		}
+	}
+}
+
+func isNotStartedError(err error) bool {
+	var dnsErr *dns.Error
+	return errors.As(err, &dnsErr) && dnsErr.Error() == "dns: server not started"
+}
+
+// waitContext waits for wg, or for ctx to be done, whichever happens first.
+func waitContext(ctx context.Context, wg interface{ Wait() }) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
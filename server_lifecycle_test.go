@@ -0,0 +1,255 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Shutdown_StopsAllGoroutines(t *testing.T) {
+	// Setup - servers left running by other tests are excluded.
+	before := serverGoroutines()
+
+	servers := []*Server{NewServer(), NewServerWithConfig(&Config{})}
+	assert.NotEmpty(t, newServerGoroutines(before))
+
+	// Execute
+	for _, s := range servers {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		assert.NoError(t, s.Shutdown(ctx))
+		cancel()
+	}
+
+	// Assertions
+	assert.Eventually(t, func() bool {
+		return len(newServerGoroutines(before)) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// serverGoroutines returns the IDs of the running goroutines started by a Server, or its prefetcher.
+func serverGoroutines() map[string]bool {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+
+	ids := make(map[string]bool)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		if !strings.Contains(stack, "resolver.(*Server)") && !strings.Contains(stack, "resolver.(*prefetcher)") {
+			continue
+		}
+		// Each stack starts "goroutine <id> [<state>]:"
+		if fields := strings.Fields(stack); len(fields) > 1 {
+			ids[fields[1]] = true
+		}
+	}
+	return ids
+}
+
+func newServerGoroutines(before map[string]bool) []string {
+	var ids []string
+	for id := range serverGoroutines() {
+		if !before[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestServer_Shutdown_AnswersQueuedQueries(t *testing.T) {
+	// Setup
+	s, q := newDoHTestServer()
+
+	const queries = 200
+	writers := make([]*mockResponseWriter, queries)
+
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		writers[i] = newMockUDPResponseWriter()
+		r := q.Copy()
+		r.Id = uint16(i)
+
+		wg.Add(1)
+		go func(w *mockResponseWriter) {
+			defer wg.Done()
+			s.handleDNS(w, r)
+		}(writers[i])
+	}
+
+	// Execute - only once every query has been accepted by handleDNS.
+	wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx))
+
+	// Assertions
+	for i, w := range writers {
+		require.NotNil(t, w.msg(), "query %d was not answered", i)
+		assert.Equal(t, uint16(i), w.msg().Id)
+		assert.Len(t, w.msg().Answer, 2)
+	}
+}
+
+func TestServer_AfterShutdown(t *testing.T) {
+	// Setup
+	s, q := newDoHTestServer()
+
+	// Execute
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	// Assertions - queries are dropped, rather than panicking on the closed queue.
+	w := newMockUDPResponseWriter()
+	s.handleDNS(w, q)
+	assert.Nil(t, w.msg())
+
+	// The server can't be restarted.
+	assert.ErrorIs(t, s.Start(), ErrServerClosed)
+
+	// Calling Shutdown again is harmless.
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestServer_Shutdown_ContextExpired(t *testing.T) {
+	// Setup
+	s := NewServer()
+
+	// A worker stuck on a write which never completes.
+	blocked := make(chan struct{})
+	defer close(blocked)
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	s.cache.set(q.Question[0], new(dns.Msg))
+	entered := make(chan struct{})
+	go s.handleDNS(&blockingResponseWriter{mockResponseWriter: newMockUDPResponseWriter(), entered: entered, block: blocked}, q)
+	<-entered
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// Execute
+	err := s.Shutdown(ctx)
+
+	// Assertions
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+type blockingResponseWriter struct {
+	*mockResponseWriter
+	entered chan struct{}
+	block   chan struct{}
+}
+
+func (w *blockingResponseWriter) WriteMsg(m *dns.Msg) error {
+	close(w.entered)
+	<-w.block
+	return w.mockResponseWriter.WriteMsg(m)
+}
+
+func TestServer_SideBySideOnEphemeralPorts(t *testing.T) {
+	// Setup - two servers in one process, each with a different cached answer.
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	servers := make([]*Server, 2)
+	for i := range servers {
+		servers[i] = NewServerWithConfig(&Config{Listeners: []Listener{
+			{Net: "udp", Addr: "127.0.0.1:0"},
+			{Net: "tcp", Addr: "127.0.0.1:0"},
+		}})
+
+		answer := new(dns.Msg)
+		answer.SetReply(q)
+		answer.Answer = []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.IPv4(192, 0, 2, byte(i+1))},
+		}
+		servers[i].cache.set(q.Question[0], answer)
+
+		require.NoError(t, servers[i].Listen())
+		go servers[i].Serve()
+	}
+	defer func() {
+		for _, s := range servers {
+			s.Shutdown(context.Background())
+		}
+	}()
+
+	// Execute & Assertions - each server answers with its own handler, over both networks.
+	for i, s := range servers {
+		addrs := s.Addrs()
+		require.Len(t, addrs, 2)
+		require.IsType(t, new(net.UDPAddr), addrs[0])
+		require.IsType(t, new(net.TCPAddr), addrs[1])
+
+		for _, addr := range addrs {
+			client := &dns.Client{Net: addr.Network(), Timeout: time.Second}
+			response, _, err := client.Exchange(q, addr.String())
+			require.NoError(t, err)
+			require.Len(t, response.Answer, 1)
+			assert.Equal(t, net.IPv4(192, 0, 2, byte(i+1)).String(), response.Answer[0].(*dns.A).A.String())
+		}
+	}
+}
+
+func TestServer_Serve_ListenerFails(t *testing.T) {
+	// Setup - the UDP listener fails as soon as it's served.
+	s := NewServerWithConfig(&Config{Listeners: []Listener{
+		{Net: "udp", Addr: "127.0.0.1:0"},
+		{Net: "tcp", Addr: "127.0.0.1:0"},
+	}})
+	require.NoError(t, s.Listen())
+	tcpAddr := s.Addrs()[1].String()
+	s.dnsServers[0].PacketConn.Close()
+
+	// Execute
+	err := s.Serve()
+
+	// Assertions - the error is returned, and the TCP listener is stopped too.
+	assert.Error(t, err)
+	assert.ErrorIs(t, s.Serve(), ErrServerClosed)
+	listener, err := net.Listen("tcp", tcpAddr)
+	require.NoError(t, err)
+	listener.Close()
+}
+
+func TestServer_Listen_UnsupportedNetwork(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{Listeners: []Listener{{Net: "sctp", Addr: "127.0.0.1:0"}}})
+	defer s.Shutdown(context.Background())
+
+	// Execute
+	err := s.Listen()
+
+	// Assertions
+	assert.ErrorContains(t, err, "unsupported listener network [sctp]")
+	assert.Nil(t, s.Addrs())
+}
+
+func TestServer_ListenAndServeOrdering(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{Listeners: []Listener{{Net: "udp", Addr: "127.0.0.1:0"}}})
+
+	// Execute & Assertions
+	assert.ErrorIs(t, s.Serve(), ErrServerNotListening)
+	require.NoError(t, s.Listen())
+	assert.ErrorIs(t, s.Listen(), ErrServerAlreadyListening)
+
+	// Shutting down a server which never served releases its socket.
+	addr := s.Addrs()[0].String()
+	require.NoError(t, s.Shutdown(context.Background()))
+	conn, err := net.ListenPacket("udp", addr)
+	require.NoError(t, err)
+	conn.Close()
+}
@@ -0,0 +1,52 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/miekg/dns"
+	"time"
+)
+
+// newTLSServer builds the DNS-over-TLS (RFC 7858) listener, using the certificate and key configured on the Server.
+// Queries are passed through the same handler as UDP and TCP.
+func (s *Server) newTLSServer() (*dns.Server, error) {
+	tlsConfig, err := s.loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := s.config.TLSListenAddr
+	if addr == "" {
+		addr = DefaultTLSListenAddr
+	}
+
+	idleTimeout := s.config.TLSIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultTLSIdleTimeout
+	}
+
+	return &dns.Server{
+		Addr:      addr,
+		Net:       "tcp-tls",
+		TLSConfig: tlsConfig,
+		// Clients are expected to reuse a connection for many queries; we only close it once it's idle.
+		MaxTCPQueries: -1,
+		IdleTimeout: func() time.Duration {
+			return idleTimeout
+		},
+	}, nil
+}
+
+// loadTLSConfig reads the Server's certificate and key from disk.
+func (s *Server) loadTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w [%s]: %w", ErrLoadingTLSKeyPair, s.config.TLSCertFile, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"dot"},
+	}, nil
+}
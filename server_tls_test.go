@@ -0,0 +1,113 @@
+package resolver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestKeyPair writes a self-signed certificate, and its key, for 127.0.0.1 into dir.
+func writeTestKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "resolver.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile
+}
+
+func TestServer_NewTLSServer_MissingKeyPair(t *testing.T) {
+	s := &Server{config: Config{TLSCertFile: "/does/not/exist.pem", TLSKeyFile: "/does/not/exist.key"}}
+
+	server, err := s.newTLSServer()
+
+	assert.Nil(t, server)
+	assert.ErrorIs(t, err, ErrLoadingTLSKeyPair)
+}
+
+func TestServer_NewTLSServer_Defaults(t *testing.T) {
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir())
+	s := &Server{config: Config{TLSCertFile: certFile, TLSKeyFile: keyFile}}
+
+	server, err := s.newTLSServer()
+
+	require.NoError(t, err)
+	assert.Equal(t, DefaultTLSListenAddr, server.Addr)
+	assert.Equal(t, "tcp-tls", server.Net)
+	assert.Equal(t, -1, server.MaxTCPQueries)
+	assert.Equal(t, DefaultTLSIdleTimeout, server.IdleTimeout())
+	assert.Len(t, server.TLSConfig.Certificates, 1)
+}
+
+func TestServer_TLS_MultipleQueriesOnOneConnection(t *testing.T) {
+	// Setup
+	certFile, keyFile := writeTestKeyPair(t, t.TempDir())
+	s := &Server{config: Config{
+		TLSCertFile:    certFile,
+		TLSKeyFile:     keyFile,
+		TLSListenAddr:  "127.0.0.1:0",
+		TLSIdleTimeout: time.Second,
+	}}
+
+	server, err := s.newTLSServer()
+	require.NoError(t, err)
+
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		s.writeMsg(w, r, largeReply(r, 2))
+	})
+
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ListenAndServe()
+	defer server.Shutdown()
+	<-started
+
+	client := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	conn, err := client.Dial(server.Listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Execute & Assertions
+	for i := 0; i < 3; i++ {
+		r := paddedQuery()
+		response, _, err := client.ExchangeWithConn(r, conn)
+		require.NoError(t, err)
+
+		assert.Equal(t, r.Id, response.Id)
+		assert.Len(t, response.Answer, 2)
+		assert.True(t, paddingRequested(response))
+		assert.Equal(t, 0, response.Len()%ResponsePaddingBlockSize)
+	}
+}
@@ -0,0 +1,66 @@
+package resolver
+
+import (
+	"github.com/miekg/dns"
+	"net"
+)
+
+// writeMsg sends m as the reply to r. Replies over UDP are truncated to the payload size the client advertised
+// in its OPT record, or 512 bytes without EDNS (RFC 1035, RFC 6891). If any records have to be dropped
+// the TC bit is set, so the client knows to retry over TCP.
+//
+// Replies over encrypted transports are padded (RFC 7830) when the client's query was.
+//
+// Replies over plain UDP are subject to response rate limiting, when it's enabled, as UDP's source address
+// can be spoofed. Clients that return a valid server cookie have proven their address, so are exempt.
+func (s *Server) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) error {
+	cookie, verified := s.replyCookie(w, r)
+
+	if s.rrl != nil && plainUDP(w) && !verified {
+		switch s.rrl.check(w.RemoteAddr().(*net.UDPAddr).IP, m) {
+		case rrlDrop:
+			return nil
+		case rrlSlip:
+			m = slipReply(r, m)
+		}
+	}
+
+	if cookie != nil {
+		if m.IsEdns0() == nil {
+			m.SetEdns0(MaxUDPResponseSize, r.IsEdns0().Do())
+		}
+		m = withCookie(m, cookie)
+	}
+
+	if encryptedTransport(w) && r.IsEdns0() != nil && m.IsEdns0() == nil {
+		// The reply needs an OPT record to carry any padding. See https://datatracker.ietf.org/doc/html/rfc8467
+		m.SetEdns0(MaxUDPResponseSize, r.IsEdns0().Do())
+	}
+
+	m.Truncate(maxResponseSize(w, r))
+	if encryptedTransport(w) && paddingRequested(r) {
+		padResponse(m, ResponsePaddingBlockSize)
+	}
+	return w.WriteMsg(m)
+}
+
+// maxResponseSize returns the largest reply, in bytes, that can be sent to the client on w.
+func maxResponseSize(w dns.ResponseWriter, r *dns.Msg) int {
+	if !plainUDP(w) {
+		// Stream based transports are only limited by the two byte length prefix.
+		return dns.MaxMsgSize
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(size, int(opt.UDPSize()))
+	}
+
+	return min(size, int(MaxUDPResponseSize))
+}
+
+// plainUDP returns true if w replies over unencrypted UDP. DoQ also runs over UDP, but within a QUIC stream.
+func plainUDP(w dns.ResponseWriter) bool {
+	_, ok := w.RemoteAddr().(*net.UDPAddr)
+	return ok && !encryptedTransport(w)
+}
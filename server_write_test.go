@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// largeReply builds a reply to r with n A records, which will exceed 512 bytes for any reasonable n.
+func largeReply(r *dns.Msg, n int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for i := 0; i < n; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("host-%d.example.com.", i), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, byte(i)),
+		})
+	}
+	return m
+}
+
+func TestServer_WriteMsg_UDPWithoutEDNSTruncatesTo512(t *testing.T) {
+	// Setup
+	s := &Server{}
+	w := newMockUDPResponseWriter()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	// Execute
+	err := s.writeMsg(w, r, largeReply(r, 100))
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.True(t, w.msg().Truncated)
+	assert.LessOrEqual(t, w.msg().Len(), dns.MinMsgSize)
+	assert.NotEmpty(t, w.msg().Answer)
+}
+
+func TestServer_WriteMsg_UDPHonoursEDNSBufferSize(t *testing.T) {
+	// Setup
+	s := &Server{}
+	w := newMockUDPResponseWriter()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+
+	// Execute
+	err := s.writeMsg(w, r, largeReply(r, 100))
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.True(t, w.msg().Truncated)
+	assert.LessOrEqual(t, w.msg().Len(), 1232)
+	assert.Greater(t, w.msg().Len(), dns.MinMsgSize)
+}
+
+func TestServer_WriteMsg_UDPSmallResponseNotTruncated(t *testing.T) {
+	// Setup
+	s := &Server{}
+	w := newMockUDPResponseWriter()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	// Execute
+	err := s.writeMsg(w, r, largeReply(r, 2))
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.False(t, w.msg().Truncated)
+	assert.Len(t, w.msg().Answer, 2)
+}
+
+func TestServer_WriteMsg_TCPNotTruncated(t *testing.T) {
+	// Setup
+	s := &Server{}
+	w := newMockTCPResponseWriter()
+
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	// Execute
+	err := s.writeMsg(w, r, largeReply(r, 100))
+
+	// Assertions
+	assert.NoError(t, err)
+	assert.False(t, w.msg().Truncated)
+	assert.Len(t, w.msg().Answer, 100)
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+
+	assert.Equal(t, dns.MinMsgSize, maxResponseSize(newMockUDPResponseWriter(), r))
+	assert.Equal(t, dns.MaxMsgSize, maxResponseSize(newMockTCPResponseWriter(), r))
+
+	// A client asking for less than 512 bytes still gets 512.
+	r.SetEdns0(256, false)
+	assert.Equal(t, dns.MinMsgSize, maxResponseSize(newMockUDPResponseWriter(), r))
+
+	// We never send more than we advertise ourselves.
+	r = new(dns.Msg)
+	r.SetQuestion("example.com.", dns.TypeA)
+	r.SetEdns0(65000, false)
+	assert.Equal(t, int(MaxUDPResponseSize), maxResponseSize(newMockUDPResponseWriter(), r))
+}
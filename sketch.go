@@ -0,0 +1,94 @@
+package resolver
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// countMinSketch estimates how often each key has been seen, in a fixed amount of memory. Counters are 4 bits wide,
+// packed two to a byte, and all are halved once enough keys have been counted, so the estimates favour recent
+// popularity.
+// See https://arxiv.org/abs/1512.00727
+//
+// It's not safe for concurrent use.
+type countMinSketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+const countMinSketchMaxCount = 15
+
+// newCountMinSketch returns a sketch sized for around width distinct keys.
+func newCountMinSketch(width int) *countMinSketch {
+	width = max(width, 64)
+	width = 1 << bits.Len(uint(width-1))
+
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		resetAt: width * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width/2)
+	}
+	return s
+}
+
+// increment counts another sighting of key.
+func (s *countMinSketch) increment(key string) {
+	h := sketchHash(key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.counter(i, idx) < countMinSketchMaxCount {
+			s.rows[i][idx>>1] += 1 << counterShift(idx)
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// estimate returns how many times key has been seen; possibly more, never fewer, up to the counters' maximum.
+func (s *countMinSketch) estimate(key string) uint8 {
+	h := sketchHash(key)
+	estimate := uint8(countMinSketchMaxCount)
+	for i := range s.rows {
+		estimate = min(estimate, s.counter(i, s.index(h, i)))
+	}
+	return estimate
+}
+
+// reset halves every counter, so keys that were popular a while ago give way to those that are popular now.
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			// Both counters in the byte are halved; the bit shifted from the high counter into the low is dropped.
+			s.rows[i][j] = s.rows[i][j] >> 1 & 0x77
+		}
+	}
+	s.additions /= 2
+}
+
+// counter returns the value of counter idx in row.
+func (s *countMinSketch) counter(row int, idx uint64) uint8 {
+	return s.rows[row][idx>>1] >> counterShift(idx) & 0x0f
+}
+
+// counterShift returns the position of counter idx within its byte; even counters take the low 4 bits.
+func counterShift(idx uint64) uint8 {
+	return uint8(idx&1) * 4
+}
+
+// index returns the counter for h in row. Each row uses a different combination of h's two halves.
+func (s *countMinSketch) index(h uint64, row int) uint64 {
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func sketchHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
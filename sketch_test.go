@@ -0,0 +1,61 @@
+package resolver
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	// Setup
+	s := newCountMinSketch(100)
+
+	// Execute
+	for i := 0; i < 5; i++ {
+		s.increment("popular")
+	}
+	s.increment("rare")
+	for i := 0; i < 20; i++ {
+		s.increment("saturated")
+	}
+
+	// Assertions
+	assert.GreaterOrEqual(t, s.estimate("popular"), uint8(5))
+	assert.GreaterOrEqual(t, s.estimate("rare"), uint8(1))
+	assert.Less(t, s.estimate("rare"), s.estimate("popular"))
+	assert.Equal(t, uint8(countMinSketchMaxCount), s.estimate("saturated"))
+}
+
+func TestCountMinSketch_Reset(t *testing.T) {
+	// Setup
+	s := newCountMinSketch(64)
+	for i := 0; i < 8; i++ {
+		s.increment("popular")
+	}
+	before := s.estimate("popular")
+
+	// Execute - enough other keys to trigger the counters being halved.
+	for i := 0; i < s.resetAt; i++ {
+		s.increment(fmt.Sprintf("key-%d", i))
+	}
+
+	// Assertions
+	assert.Less(t, s.estimate("popular"), before)
+}
+
+func TestCountMinSketch_PackedCounters(t *testing.T) {
+	// Setup - two counters share each byte; counter 0 holds 3, and counter 1 is saturated.
+	s := newCountMinSketch(64)
+	assert.Len(t, s.rows[0], 32)
+	s.rows[0][0] = 0xf3
+
+	// Assertions
+	assert.Equal(t, uint8(3), s.counter(0, 0))
+	assert.Equal(t, uint8(countMinSketchMaxCount), s.counter(0, 1))
+
+	// Execute & Assertions - neighbouring counters are halved independently.
+	s.reset()
+	assert.Equal(t, uint8(1), s.counter(0, 0))
+	assert.Equal(t, uint8(7), s.counter(0, 1))
+}
@@ -0,0 +1,458 @@
+package resolver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshots of the cache, and of the zones learned while resolving, so a restarted Server doesn't start cold.
+//
+// A snapshot is indented JSON, with every record in its presentation format, so it can be read, and diffed, by hand.
+// Records are written with their remaining TTLs as at Saved; on load they carry on counting down from then.
+
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int
+	Saved   time.Time
+	Cache   []snapshotEntry
+	Zones   []snapshotZone
+}
+
+type snapshotEntry struct {
+	Key      string
+	BaseKey  string `json:",omitempty"`
+	Subnet   string `json:",omitempty"`
+	Negative bool   `json:",omitempty"`
+	// Auth and DOE are the DNSSEC state the answer was validated with.
+	Auth    dnssec.AuthenticationResult   `json:",omitempty"`
+	DOE     dnssec.DenialOfExistenceState `json:",omitempty"`
+	Expires time.Time
+	Stale   time.Time
+	Msg     snapshotMsg
+}
+
+// snapshotMsg is a dns.Msg in presentation format. Any OPT record is reduced to its UDP size and DO bit.
+type snapshotMsg struct {
+	Header   dns.MsgHdr
+	Question []dns.Question
+	Answer   []string     `json:",omitempty"`
+	Ns       []string     `json:",omitempty"`
+	Extra    []string     `json:",omitempty"`
+	EDNS     *snapshotOPT `json:",omitempty"`
+}
+
+type snapshotOPT struct {
+	UDPSize uint16
+	DO      bool
+}
+
+type snapshotZone struct {
+	Name   string
+	Parent string
+	// Expires is when the nameserver pool expires. It's zero for pools that never do, i.e. the root's.
+	Expires               time.Time
+	Nameservers           []snapshotNameserver
+	HostsWithoutAddresses []string `json:",omitempty"`
+	DNSKEYs               []string `json:",omitempty"`
+	DNSKEYExpires         time.Time
+}
+
+type snapshotNameserver struct {
+	Hostname string
+	Addr     string
+}
+
+//---
+
+// SaveSnapshot writes a snapshot of the cache, and the known zones, to path. The file is replaced atomically.
+func (s *Server) SaveSnapshot(path string) error {
+	return writeFileAtomically(path, s.WriteSnapshot)
+}
+
+// LoadSnapshot restores the cache, and the known zones, from the snapshot at path.
+func (s *Server) LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return s.ReadSnapshot(f)
+}
+
+// WriteSnapshot writes a snapshot of the cache, and the known zones, to w.
+func (s *Server) WriteSnapshot(w io.Writer) error {
+	now := time.Now()
+	snap := snapshot{
+		Version: snapshotVersion,
+		Saved:   now,
+		Cache:   s.cache.snapshot(now),
+	}
+	if s.resolver != nil {
+		if z, ok := s.resolver.zones.(*zones); ok {
+			snap.Zones = z.snapshot(now)
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snap)
+}
+
+// ReadSnapshot restores the cache, and the known zones, from the snapshot in r. Entries, and zones, that have
+// expired since the snapshot was saved are dropped.
+func (s *Server) ReadSnapshot(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+	if snap.Version != snapshotVersion {
+		return fmt.Errorf("%w [%d]", ErrUnsupportedSnapshot, snap.Version)
+	}
+
+	now := time.Now()
+	entries := s.cache.restore(snap, now)
+
+	zoneCount := 0
+	if s.resolver != nil {
+		if z, ok := s.resolver.zones.(*zones); ok {
+			zoneCount = z.restore(snap, now)
+		}
+	}
+
+	Info(fmt.Sprintf("restored %d cache entries and %d zones from a snapshot saved at %s", entries, zoneCount, snap.Saved.Format(time.RFC3339)))
+	return nil
+}
+
+// snapshotSaver saves a snapshot every Interval, until the Server is shutdown.
+func (s *Server) snapshotSaver() {
+	defer s.backgroundWG.Done()
+
+	interval := s.config.Snapshot.Interval
+	if interval <= 0 {
+		interval = DefaultSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.SaveSnapshot(s.config.Snapshot.Path); err != nil {
+				Warn(fmt.Sprintf("unable to save snapshot [%s]: %s", s.config.Snapshot.Path, err.Error()))
+			}
+		}
+	}
+}
+
+//---
+
+// writeFileAtomically replaces the file at path with what write writes, via a temporary file in the same directory,
+// so the file is never left partly written.
+func writeFileAtomically(path string, write func(io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+//---
+
+// snapshot returns every entry that's not yet removable, with its records' TTLs as they'd be returned at now.
+func (c *DNSCache) snapshot(now time.Time) []snapshotEntry {
+	var entries []snapshotEntry
+	for _, shard := range c.shards {
+		shard.mu.RLock()
+		for _, entry := range shard.items {
+			if entry.removable(now) {
+				continue
+			}
+
+			msg := entry.msg.Copy()
+			decrementTTLs(msg, now.Sub(entry.cached))
+
+			e := snapshotEntry{
+				Key:      entry.key,
+				BaseKey:  entry.baseKey,
+				Negative: entry.isNegative,
+				Auth:     entry.auth,
+				DOE:      entry.doe,
+				Expires:  entry.expires,
+				Stale:    entry.stale,
+				Msg:      newSnapshotMsg(msg),
+			}
+			if entry.subnet.IsValid() {
+				e.Subnet = entry.subnet.String()
+			}
+			entries = append(entries, e)
+		}
+		shard.mu.RUnlock()
+	}
+	return entries
+}
+
+// restore adds the entries in snap that aren't yet removable, and returns how many there were.
+func (c *DNSCache) restore(snap snapshot, now time.Time) int {
+	count := 0
+	for _, e := range snap.Cache {
+		entry := &cacheEntry{
+			key:        e.Key,
+			baseKey:    e.BaseKey,
+			isNegative: e.Negative,
+			auth:       e.Auth,
+			doe:        e.DOE,
+			expires:    e.Expires,
+			stale:      e.Stale,
+			cached:     snap.Saved,
+			frequency:  1,
+		}
+		if entry.removable(now) {
+			continue
+		}
+
+		baseKey := e.Key
+		if e.Subnet != "" {
+			subnet, err := netip.ParsePrefix(e.Subnet)
+			if err != nil || e.BaseKey == "" {
+				Warn(fmt.Sprintf("skipping snapshot cache entry [%s]: invalid subnet", e.Key))
+				continue
+			}
+			entry.subnet = subnet
+			baseKey = e.BaseKey
+		}
+
+		msg, err := e.Msg.msg()
+		if err != nil {
+			Warn(fmt.Sprintf("skipping snapshot cache entry [%s]: %s", e.Key, err.Error()))
+			continue
+		}
+		entry.msg = msg
+
+		c.insert(baseKey, entry)
+		count++
+	}
+	return count
+}
+
+//---
+
+// snapshot returns the zones whose nameserver pools have not expired, along with any DNSKEYs still valid at now.
+func (zones *zones) snapshot(now time.Time) []snapshotZone {
+	zones.lock.RLock()
+	defer zones.lock.RUnlock()
+
+	result := make([]snapshotZone, 0, len(zones.zones))
+	for _, z := range zones.zones {
+		impl, ok := z.(*zoneImpl)
+		if !ok || impl.expired() {
+			continue
+		}
+		pool, ok := impl.pool.(*nameserverPool)
+		if !ok {
+			continue
+		}
+
+		sz := snapshotZone{
+			Name:   impl.zoneName,
+			Parent: impl.parentName,
+		}
+
+		pool.updating.RLock()
+		if expires := pool.expires.Load(); expires > 0 {
+			sz.Expires = time.Unix(expires, 0)
+		}
+		for _, e := range append(append([]exchanger{}, pool.ipv4...), pool.ipv6...) {
+			if ns, ok := e.(*nameserver); ok {
+				sz.Nameservers = append(sz.Nameservers, snapshotNameserver{Hostname: ns.hostname, Addr: ns.addr})
+			}
+		}
+		sz.HostsWithoutAddresses = append(sz.HostsWithoutAddresses, pool.hostsWithoutAddresses...)
+		pool.updating.RUnlock()
+
+		impl.dnskeyLock.Lock()
+		if impl.dnskeyExpiry.After(now) {
+			// The keys expire with the lowest of their TTLs, so that's how we know when they were fetched.
+			fetched := impl.dnskeyExpiry.Add(-time.Duration(lowestTTL(impl.dnskeyRecords)) * time.Second)
+			sz.DNSKEYExpires = impl.dnskeyExpiry
+			sz.DNSKEYs = snapshotRecords(impl.dnskeyRecords, now.Sub(fetched))
+		}
+		impl.dnskeyLock.Unlock()
+
+		result = append(result, sz)
+	}
+	return result
+}
+
+// restore adds the zones in snap whose nameserver pools haven't expired, and returns how many there were.
+// Zones we already know of, such as the root, keep their nameservers, and only gain the snapshot's DNSKEYs.
+func (zones *zones) restore(snap snapshot, now time.Time) int {
+	count := 0
+	for _, sz := range snap.Zones {
+		if !sz.Expires.IsZero() && !sz.Expires.After(now) {
+			continue
+		}
+
+		var dnskeys []dns.RR
+		if sz.DNSKEYExpires.After(now) {
+			var err error
+			if dnskeys, err = parseSnapshotRecords(sz.DNSKEYs); err != nil {
+				Warn(fmt.Sprintf("skipping snapshot zone [%s]: %s", sz.Name, err.Error()))
+				continue
+			}
+			decrementTTLs(&dns.Msg{Answer: dnskeys}, now.Sub(snap.Saved))
+		}
+
+		if existing, ok := zones.get(sz.Name).(*zoneImpl); ok {
+			existing.dnskeyLock.Lock()
+			if sz.DNSKEYExpires.After(now) && existing.dnskeyExpiry.Before(now) {
+				existing.dnskeyRecords = dnskeys
+				existing.dnskeyExpiry = sz.DNSKEYExpires
+			}
+			existing.dnskeyLock.Unlock()
+			continue
+		}
+
+		name := canonicalName(sz.Name)
+		if name != "." && (name == canonicalName(sz.Parent) || !dns.IsSubDomain(sz.Parent, name)) {
+			Warn(fmt.Sprintf("skipping snapshot zone [%s]: not a subdomain of its parent [%s]", sz.Name, sz.Parent))
+			continue
+		}
+
+		pool := &nameserverPool{hostsWithoutAddresses: sz.HostsWithoutAddresses}
+		for _, ns := range sz.Nameservers {
+			addr, err := netip.ParseAddr(ns.Addr)
+			if err != nil {
+				continue
+			}
+			if addr.Is4() {
+				pool.ipv4 = append(pool.ipv4, &nameserver{hostname: ns.Hostname, addr: ns.Addr})
+			} else {
+				pool.ipv6 = append(pool.ipv6, &nameserver{hostname: ns.Hostname, addr: ns.Addr})
+			}
+		}
+		if !sz.Expires.IsZero() {
+			pool.expires.Store(sz.Expires.Unix())
+		}
+		pool.updateIPCount()
+
+		if pool.status() == PoolEmpty {
+			continue
+		}
+
+		z := &zoneImpl{
+			zoneName:   name,
+			parentName: canonicalName(sz.Parent),
+			pool:       pool,
+		}
+		if sz.DNSKEYExpires.After(now) {
+			z.dnskeyRecords = dnskeys
+			z.dnskeyExpiry = sz.DNSKEYExpires
+		}
+
+		zones.add(z)
+		count++
+	}
+	return count
+}
+
+//---
+
+func newSnapshotMsg(msg *dns.Msg) snapshotMsg {
+	m := snapshotMsg{
+		Header:   msg.MsgHdr,
+		Question: msg.Question,
+		Answer:   snapshotRecords(msg.Answer, 0),
+		Ns:       snapshotRecords(msg.Ns, 0),
+	}
+	for _, rr := range msg.Extra {
+		if opt, ok := rr.(*dns.OPT); ok {
+			m.EDNS = &snapshotOPT{UDPSize: opt.UDPSize(), DO: opt.Do()}
+			continue
+		}
+		m.Extra = append(m.Extra, rr.String())
+	}
+	return m
+}
+
+func (m snapshotMsg) msg() (*dns.Msg, error) {
+	msg := &dns.Msg{MsgHdr: m.Header, Question: m.Question}
+
+	var err error
+	if msg.Answer, err = parseSnapshotRecords(m.Answer); err != nil {
+		return nil, err
+	}
+	if msg.Ns, err = parseSnapshotRecords(m.Ns); err != nil {
+		return nil, err
+	}
+	if msg.Extra, err = parseSnapshotRecords(m.Extra); err != nil {
+		return nil, err
+	}
+	if m.EDNS != nil {
+		msg.SetEdns0(m.EDNS.UDPSize, m.EDNS.DO)
+	}
+	return msg, nil
+}
+
+// snapshotRecords returns records in presentation format, with their TTLs reduced by elapsed.
+func snapshotRecords(records []dns.RR, elapsed time.Duration) []string {
+	if len(records) == 0 {
+		return nil
+	}
+	copied := make([]dns.RR, len(records))
+	for i, rr := range records {
+		copied[i] = dns.Copy(rr)
+	}
+	decrementTTLs(&dns.Msg{Answer: copied}, max(elapsed, 0))
+
+	result := make([]string, len(copied))
+	for i, rr := range copied {
+		result[i] = rr.String()
+	}
+	return result
+}
+
+func parseSnapshotRecords(records []string) ([]dns.RR, error) {
+	if len(records) == 0 {
+		return nil, nil
+	}
+	result := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rr)
+	}
+	return result, nil
+}
+
+// lowestTTL returns the lowest TTL in records, or 0 when there are none.
+func lowestTTL(records []dns.RR) uint32 {
+	if len(records) == 0 {
+		return 0
+	}
+	ttl := records[0].Header().Ttl
+	for _, rr := range records[1:] {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+	return ttl
+}
@@ -0,0 +1,190 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotTestZone returns example.com., delegated from the root, with one nameserver and its DNSKEY.
+func snapshotTestZone(t *testing.T) *zoneImpl {
+	ns, err := dns.NewRR("example.com. 3600 IN NS ns1.example.com.")
+	require.NoError(t, err)
+	a, err := dns.NewRR("ns1.example.com. 3600 IN A 192.0.2.53")
+	require.NoError(t, err)
+	aaaa, err := dns.NewRR("ns1.example.com. 3600 IN AAAA 2001:db8::53")
+	require.NoError(t, err)
+	key, err := dns.NewRR("example.com. 3600 IN DNSKEY 257 3 13 dGVzdA==")
+	require.NoError(t, err)
+
+	return &zoneImpl{
+		zoneName:      "example.com.",
+		parentName:    ".",
+		pool:          newNameserverPool([]*dns.NS{ns.(*dns.NS)}, []dns.RR{a, aaaa}),
+		dnskeyRecords: []dns.RR{key},
+		dnskeyExpiry:  time.Now().Add(time.Hour),
+	}
+}
+
+func TestServer_Snapshot(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	s := NewServerWithConfig(&Config{ServeStale: ServeStaleConfig{Window: time.Hour}})
+	defer s.Shutdown(context.Background())
+
+	positive := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	negative := dns.Question{Name: "missing.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	scoped := dns.Question{Name: "cdn.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	stale := dns.Question{Name: "stale.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	expired := dns.Question{Name: "expired.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	m := staleTestAnswer(positive, "192.0.2.1")
+	m.SetEdns0(dns.DefaultMsgSize, true)
+	s.cache.set(positive, m)
+	s.cache.set(negative, negativeTestAnswer(negative, dns.RcodeNameError, 3600, 300))
+	s.cache.setScoped(scoped, staleTestAnswer(scoped, "192.0.2.2"), netip.MustParsePrefix("192.0.2.0/24"))
+	s.cache.set(stale, staleTestAnswer(stale, "192.0.2.3"))
+	s.cache.set(expired, staleTestAnswer(expired, "192.0.2.4"))
+
+	// As if it were cached 100 seconds ago.
+	s.cache.getShard("example.com.-1-1").items["example.com.-1-1"].cached = time.Now().Add(-100 * time.Second)
+	expireCacheEntry(s.cache, stale, 6*time.Minute)
+	expireCacheEntry(s.cache, expired, 2*time.Hour)
+
+	s.resolver.zones.add(snapshotTestZone(t))
+
+	// Execute
+	require.NoError(t, s.SaveSnapshot(path))
+
+	restored := NewServerWithConfig(&Config{ServeStale: ServeStaleConfig{Window: time.Hour}, Snapshot: SnapshotConfig{Path: path}})
+	defer restored.Shutdown(context.Background())
+
+	// Assertions - answers are returned with their remaining TTLs.
+	cached := restored.cache.get(positive, 1)
+	require.NotNil(t, cached)
+	require.Len(t, cached.Answer, 1)
+	assert.InDelta(t, 200, cached.Answer[0].Header().Ttl, 2)
+	assert.Equal(t, "192.0.2.1", cached.Answer[0].(*dns.A).A.String())
+	assert.True(t, cached.IsEdns0().Do())
+
+	cached = restored.cache.get(negative, 1)
+	require.NotNil(t, cached)
+	assert.Equal(t, dns.RcodeNameError, cached.Rcode)
+	assert.InDelta(t, 300, cached.Ns[0].Header().Ttl, 2)
+
+	assert.Nil(t, restored.cache.get(scoped, 1))
+	cached, scope := restored.cache.getScoped(scoped, 1, netip.MustParseAddr("192.0.2.1"))
+	require.NotNil(t, cached)
+	assert.Equal(t, 24, scope)
+
+	// Entries within their stale window can still be served stale; those beyond it are dropped.
+	assert.Nil(t, restored.cache.get(stale, 1))
+	staleResp, _, _ := restored.cache.getStale(stale, cachePlain, 1, netip.Addr{})
+	assert.NotNil(t, staleResp)
+
+	staleResp, _, _ = restored.cache.getStale(expired, cachePlain, 1, netip.Addr{})
+	assert.Nil(t, staleResp)
+
+	// The zone is restored, with its nameservers and DNSKEYs.
+	z, ok := restored.resolver.zones.get("example.com.").(*zoneImpl)
+	require.True(t, ok)
+	assert.Equal(t, ".", z.parent())
+	pool := z.pool.(*nameserverPool)
+	assert.Equal(t, uint32(1), pool.countIPv4())
+	assert.Equal(t, uint32(1), pool.countIPv6())
+	assert.Equal(t, "192.0.2.53", pool.ipv4[0].(*nameserver).addr)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), time.Unix(pool.expires.Load(), 0), 5*time.Second)
+
+	keys, err := z.dnskeys(context.Background())
+	require.NoError(t, err)
+	require.Len(t, keys, 1)
+	assert.Equal(t, dns.TypeDNSKEY, keys[0].Header().Rrtype)
+
+	// The root's nameservers are never expired, so it's kept as is.
+	assert.NotNil(t, restored.resolver.zones.get("."))
+}
+
+func TestServer_ReadSnapshot_Expired(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	s.resolver.zones.add(snapshotTestZone(t))
+
+	var buf bytes.Buffer
+	require.NoError(t, s.WriteSnapshot(&buf))
+
+	// Execute - as if it were loaded two hours later.
+	var snap snapshot
+	restored := NewServerWithConfig(&Config{})
+	defer restored.Shutdown(context.Background())
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &snap))
+	later := time.Now().Add(2 * time.Hour)
+
+	// Assertions
+	assert.Equal(t, 0, restored.cache.restore(snap, later))
+	assert.Equal(t, 0, restored.resolver.zones.(*zones).restore(snap, later))
+	assert.Nil(t, restored.cache.get(q, 1))
+	assert.Nil(t, restored.resolver.zones.get("example.com."))
+}
+
+func TestServer_WriteSnapshot(t *testing.T) {
+	// Setup
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	s.resolver.zones.add(snapshotTestZone(t))
+
+	// Execute
+	var buf bytes.Buffer
+	require.NoError(t, s.WriteSnapshot(&buf))
+
+	// Assertions - records are in their presentation format.
+	dump := buf.String()
+	assert.Contains(t, dump, `"example.com.\t300\tIN\tA\t192.0.2.1"`)
+	assert.Contains(t, dump, `"example.com.\t3600\tIN\tDNSKEY\t257 3 13 dGVzdA=="`)
+	assert.Contains(t, dump, `"Addr": "2001:db8::53"`)
+}
+
+func TestServer_Snapshot_Shutdown(t *testing.T) {
+	// Setup
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+
+	// Execute - a missing snapshot is not an error.
+	s := NewServerWithConfig(&Config{Snapshot: SnapshotConfig{Path: path}})
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cache.set(q, staleTestAnswer(q, "192.0.2.1"))
+	require.NoError(t, s.Shutdown(context.Background()))
+
+	// Assertions - the snapshot is saved on shutdown, and nothing else is left behind.
+	files, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "snapshot.json", files[0].Name())
+
+	restored := NewServerWithConfig(&Config{Snapshot: SnapshotConfig{Path: path}})
+	defer restored.Shutdown(context.Background())
+	assert.NotNil(t, restored.cache.get(q, 1))
+}
+
+func TestServer_ReadSnapshot_UnsupportedVersion(t *testing.T) {
+	s := NewServerWithConfig(&Config{})
+	defer s.Shutdown(context.Background())
+
+	err := s.ReadSnapshot(bytes.NewBufferString(`{"Version": 99}`))
+	assert.ErrorIs(t, err, ErrUnsupportedSnapshot)
+}
@@ -0,0 +1,122 @@
+package resolver
+
+import (
+	"github.com/miekg/dns"
+	"github.com/nsmithuk/resolver/dnssec"
+	"net/netip"
+	"sync/atomic"
+	"time"
+)
+
+// Serving stale answers. See https://datatracker.ietf.org/doc/html/rfc8767
+//
+// Entries are kept in the DNSCache for staleWindow after they expire. They're never returned as fresh answers, but
+// can be returned by getStale when resolving a fresh answer fails, or is taking too long.
+
+// removable returns true once entry is past both its expiry, and any stale window.
+func (entry *cacheEntry) removable(now time.Time) bool {
+	return now.After(entry.expires) && now.After(entry.stale)
+}
+
+// findStale returns the expired entry for a client at addr, within its stale window, along with its ECS scope.
+// As with getScoped, the most specific variant is preferred. shard's lock must be held.
+func (c *DNSCache) findStale(shard *cacheShard, baseKey string, client netip.Addr) (*cacheEntry, int) {
+	now := time.Now()
+	find := func(key string) *cacheEntry {
+		entry, exists := shard.items[key]
+		if !exists {
+			return nil
+		}
+		if now.Before(entry.expires) || !now.Before(entry.stale) {
+			return nil
+		}
+		return entry
+	}
+
+	if client.IsValid() {
+		for _, scope := range shard.scopeLengths(baseKey) {
+			subnet, err := client.Prefix(scope)
+			if err != nil {
+				continue
+			}
+			if entry := find(scopedKey(baseKey, subnet)); entry != nil {
+				return entry, scope
+			}
+		}
+	}
+
+	return find(baseKey), 0
+}
+
+// getStale returns a copy of the stale variant of the answer to q for a client at addr, with its records' TTLs set to
+// DefaultStaleAnswerTTL, and the DNSSEC state it was validated with, along with its ECS scope. recheck is true if
+// resolving a fresh answer has failed within the last failureRecheck, in which case the stale answer should be
+// returned without trying again.
+func (c *DNSCache) getStale(q dns.Question, variant cacheVariant, requestID uint16, client netip.Addr) (resp *Response, scope int, recheck bool) {
+	if c.staleWindow <= 0 {
+		return nil, 0, false
+	}
+
+	baseKey := variant.baseKey(q)
+	shard := c.getShard(baseKey)
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	entry, scope := c.findStale(shard, baseKey, client)
+	if entry == nil {
+		return nil, 0, false
+	}
+
+	msg := entry.msg.Copy()
+	msg.Id = requestID
+	msg.AuthenticatedData = entry.auth == dnssec.Secure
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = DefaultStaleAnswerTTL
+			}
+		}
+	}
+
+	failed := entry.failed.Load()
+	recheck = failed != 0 && time.Since(time.Unix(0, failed)) < c.failureRecheck
+	return &Response{Msg: msg, Auth: entry.auth, Doe: entry.doe}, scope, recheck
+}
+
+// staleFailed records that resolving a fresh variant of the answer to q, for a client at addr, has failed.
+func (c *DNSCache) staleFailed(q dns.Question, variant cacheVariant, client netip.Addr) {
+	if c.staleWindow <= 0 {
+		return
+	}
+
+	baseKey := variant.baseKey(q)
+	shard := c.getShard(baseKey)
+
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	if entry, _ := c.findStale(shard, baseKey, client); entry != nil {
+		entry.failed.Store(time.Now().UnixNano())
+	}
+}
+
+// staleReply returns the stale answer m as the reply to r, marked as stale with an Extended DNS Error.
+func (c *DNSCache) staleReply(m, r *dns.Msg, scope int) *dns.Msg {
+	atomic.AddUint64(&c.stats.Stale, 1)
+	m = replyClientSubnet(m, r, scope)
+	if opt := r.IsEdns0(); opt != nil {
+		if m.IsEdns0() == nil {
+			m.SetEdns0(MaxUDPResponseSize, opt.Do())
+		}
+		setExtendedError(m, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+	return m
+}
+
+func (s *Server) staleClientResponseTimeout() time.Duration {
+	if s.config.ServeStale.ClientResponseTimeout > 0 {
+		return s.config.ServeStale.ClientResponseTimeout
+	}
+	return DefaultStaleClientResponseTimeout
+}
@@ -0,0 +1,160 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// expireCacheEntry moves the answer to q's expiry, and stale window, into the past by ago.
+func expireCacheEntry(c *DNSCache, q dns.Question, ago time.Duration) {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		for _, entry := range shard.items {
+			if entry.key == fmt.Sprintf("%s-%d-%d", q.Name, q.Qtype, q.Qclass) {
+				entry.expires = entry.expires.Add(-ago)
+				entry.stale = entry.stale.Add(-ago)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func staleTestAnswer(q dns.Question, ip string) *dns.Msg {
+	m := new(dns.Msg)
+	m.Question = []dns.Question{q}
+	m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: net.ParseIP(ip)}}
+	return m
+}
+
+func TestDNSCache_GetStale(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{ServeStale: ServeStaleConfig{Window: time.Hour}}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, staleTestAnswer(q, "192.0.2.1"))
+
+	// Fresh answers aren't stale.
+	stale, _, _ := c.getStale(q, cachePlain, 1, netip.Addr{})
+	assert.Nil(t, stale)
+
+	// Execute
+	expireCacheEntry(c, q, 10*time.Minute)
+
+	// Assertions - it's no longer a fresh answer, but it's kept...
+	assert.Nil(t, c.get(q, 1))
+	stale, scope, recheck := c.getStale(q, cachePlain, 7, netip.Addr{})
+	require.NotNil(t, stale)
+	assert.Equal(t, uint16(7), stale.Msg.Id)
+	assert.Equal(t, uint32(DefaultStaleAnswerTTL), stale.Msg.Answer[0].Header().Ttl)
+	assert.Equal(t, 0, scope)
+	assert.False(t, recheck)
+
+	// ...and a failure to refresh it is remembered.
+	c.staleFailed(q, cachePlain, netip.Addr{})
+	_, _, recheck = c.getStale(q, cachePlain, 1, netip.Addr{})
+	assert.True(t, recheck)
+
+	// Once past the stale window, it's removed.
+	expireCacheEntry(c, q, time.Hour)
+	c.cleanExpired()
+	stale, _, _ = c.getStale(q, cachePlain, 1, netip.Addr{})
+	assert.Nil(t, stale)
+	assert.Equal(t, 0, c.Size())
+}
+
+func TestDNSCache_GetStale_Disabled(t *testing.T) {
+	// Setup
+	c := NewServerWithConfig(&Config{}).cache
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	c.set(q, staleTestAnswer(q, "192.0.2.1"))
+
+	// Execute
+	expireCacheEntry(c, q, 10*time.Minute)
+
+	// Assertions
+	stale, _, _ := c.getStale(q, cachePlain, 1, netip.Addr{})
+	assert.Nil(t, stale)
+	assert.Nil(t, c.get(q, 1))
+	assert.Equal(t, 0, c.Size())
+}
+
+// newStaleTestServer returns a Server serving stale answers, with example.com. A cached but expired.
+func newStaleTestServer(t *testing.T, resolve func(qmsg *dns.Msg) *Response) (*Server, *dns.Msg) {
+	s := NewServerWithConfig(&Config{ServeStale: ServeStaleConfig{Window: time.Hour, ClientResponseTimeout: 50 * time.Millisecond}})
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	s.resolver = newTestResolver(resolve)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+
+	s.cache.set(q.Question[0], staleTestAnswer(q.Question[0], "192.0.2.1"))
+	expireCacheEntry(s.cache, q.Question[0], 10*time.Minute)
+	return s, q
+}
+
+func TestServer_ProcessQuery_StaleOnFailure(t *testing.T) {
+	// Setup
+	var calls atomic.Int32
+	s, q := newStaleTestServer(t, func(qmsg *dns.Msg) *Response {
+		calls.Add(1)
+		return newResponseError(&net.OpError{Op: "read", Err: errors.New("connection refused")})
+	})
+
+	// Execute
+	w := newMockUDPResponseWriter()
+	s.processQuery(w, q)
+	s.processQuery(w, q)
+
+	// Assertions - the stale answer is returned, and marked as stale.
+	require.Len(t, w.msgs, 2)
+	for _, m := range w.msgs {
+		assert.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Len(t, m.Answer, 1)
+		assert.Equal(t, uint32(DefaultStaleAnswerTTL), m.Answer[0].Header().Ttl)
+		require.NotNil(t, extendedErrorOption(m))
+		assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, extendedErrorOption(m).InfoCode)
+	}
+
+	// Having just failed, the second query doesn't try resolving it again.
+	assert.Equal(t, int32(1), calls.Load())
+	assert.Equal(t, uint64(2), s.cache.Stats().Stale)
+}
+
+func TestServer_ProcessQuery_StaleOnTimeout(t *testing.T) {
+	// Setup - resolving blocks until released.
+	release := make(chan struct{})
+	var once sync.Once
+	s, q := newStaleTestServer(t, func(qmsg *dns.Msg) *Response {
+		<-release
+		return &Response{Msg: staleTestAnswer(qmsg.Question[0], "192.0.2.2")}
+	})
+	defer once.Do(func() { close(release) })
+
+	// Execute
+	w := newMockUDPResponseWriter()
+	start := time.Now()
+	s.processQuery(w, q)
+
+	// Assertions - the stale answer is returned once the client response timer fires...
+	require.NotNil(t, w.msg())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, "192.0.2.1", w.msg().Answer[0].(*dns.A).A.String())
+
+	// ...and the resolution carries on, refreshing the cache.
+	once.Do(func() { close(release) })
+	assert.Eventually(t, func() bool {
+		fresh := s.cache.get(q.Question[0], 1)
+		return fresh != nil && fresh.Answer[0].(*dns.A).A.String() == "192.0.2.2"
+	}, time.Second, 10*time.Millisecond)
+}
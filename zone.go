@@ -28,6 +28,9 @@ type zoneImpl struct {
 	pool  expiringExchanger
 	calls atomic.Uint64
 
+	// flights coalesces identical queries to the zone's nameservers.
+	flights flightGroup[*Response]
+
 	dnskeyRecords []dns.RR
 	dnskeyExpiry  time.Time
 	dnskeyLock    sync.Mutex
@@ -62,7 +65,20 @@ func (z *zoneImpl) exchange(ctx context.Context, m *dns.Msg) *Response {
 
 	z.calls.Add(1)
 
-	if Cache != nil {
+	// Any ECS option from the client is replaced with our own, which is only sent to the zones it's enabled for.
+	ecs := clientSubnetFromContext(ctx)
+	if ecs != nil && ecs.sentTo(z.zoneName) {
+		m = withClientSubnet(m, ecs.option())
+	} else {
+		ecs = nil
+		m = withClientSubnet(m, nil)
+	}
+
+	// Answers tailored to a client's subnet are not shared via the Cache. Nor are those to queries without DO, as
+	// they hold no DNSSEC records; returned for a query with DO, they'd fail validation. The Cache's key only holds
+	// the zone and question, so can't tell them apart.
+	cacheable := Cache != nil && ecs == nil && isSetDO(m)
+	if cacheable {
 		if msg, err := Cache.Get(z.zoneName, m.Question[0]); err != nil {
 			Warn(fmt.Errorf("error trying to perform a cache lookup for zone [%s]: %w", z.zoneName, err).Error())
 		} else if msg != nil {
@@ -86,11 +102,29 @@ func (z *zoneImpl) exchange(ctx context.Context, m *dns.Msg) *Response {
 	}
 
 	ctx = context.WithValue(ctx, ctxZoneName, z.zoneName)
-	response := z.pool.exchange(ctx, m)
+
+	// Identical queries already being sent to the zone's nameservers share their response.
+	response, shared, err := z.flights.do(ctx, zoneFlightKey(m), func(ctx context.Context) *Response {
+		return z.pool.exchange(ctx, m)
+	})
+	if err != nil {
+		return newResponseError(err)
+	}
+	if shared {
+		response = sharedResponse(response, m.Id)
+	}
 
 	//---
 
-	if Cache != nil && !response.IsEmpty() && !response.HasError() {
+	scope := 0
+	if ecs != nil && !response.IsEmpty() && !response.HasError() {
+		var err error
+		if scope, err = ecs.record(response.Msg); err != nil {
+			return newResponseError(fmt.Errorf("%w from zone [%s]", err, z.zoneName))
+		}
+	}
+
+	if cacheable && scope == 0 && !response.IsEmpty() && !response.HasError() {
 		go func(zone string, question dns.Question, msg *dns.Msg) {
 			// We never cache OPT records.
 			msg.Extra = removeRecordsOfType(msg.Extra, dns.TypeOPT)
@@ -187,3 +187,48 @@ func TestZone_DNSKeys_EmptyAnswer(t *testing.T) {
 	// We expect expiry to be in the future.
 	assert.Greater(t, z.dnskeyExpiry, time.Now())
 }
+
+func TestZone_Exchange_CachesOnlyWithDO(t *testing.T) {
+	// Setup
+	cache := NewMemoryCache(0)
+	previous := Cache
+	Cache = cache
+	defer func() { Cache = previous }()
+
+	query := func(do bool) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("example.com.", dns.TypeA)
+		if do {
+			m.SetEdns0(4096, true)
+		}
+		return m
+	}
+	answer := func(m *dns.Msg) *Response {
+		reply := new(dns.Msg)
+		reply.SetReply(m)
+		reply.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}}}
+		return &Response{Msg: reply}
+	}
+
+	mockPool := new(MockExpiringExchanger)
+	z := &zoneImpl{zoneName: "com.", pool: mockPool}
+	ctx := context.WithValue(context.Background(), CtxTrace, newTraceWithStart(time.Now()))
+
+	// Execute & Assertions - answers to queries without DO, which have no DNSSEC records, aren't cached...
+	plain := query(false)
+	mockPool.On("exchange", mock.Anything, plain).Return(answer(plain)).Twice()
+	z.exchange(ctx, plain)
+	time.Sleep(10 * time.Millisecond)
+	assert.Zero(t, cache.Len())
+
+	// ...while those with DO are, but only returned to queries with DO.
+	signed := query(true)
+	mockPool.On("exchange", mock.Anything, signed).Return(answer(signed)).Once()
+	z.exchange(ctx, signed)
+	assert.Eventually(t, func() bool { return cache.Len() == 1 }, time.Second, time.Millisecond)
+
+	z.exchange(ctx, plain)
+	response := z.exchange(ctx, query(true))
+	assert.NoError(t, response.Err)
+	mockPool.AssertNumberOfCalls(t, "exchange", 3)
+}